@@ -2,6 +2,7 @@ package check
 
 import (
 	"juno/common/io"
+	"juno/common/valid"
 	"log"
 	"net/http"
 	"os"
@@ -23,10 +24,32 @@ func DBErr(w http.ResponseWriter, err error) bool {
 	return false
 }
 
+// ServerErr is the same as DBErr but for non-database failures
+func ServerErr(w http.ResponseWriter, err error) bool {
+	if err != nil {
+		io.ErrServer(w, io.ERR_SERVER)
+		clog.Output(2, err.Error())
+		return true
+	}
+	return false
+}
+
 func InputErr(w http.ResponseWriter, r *http.Request, obj interface{}) bool {
 	if err := io.Input(r, obj); err != nil {
+		if ValidErr(w, err) {
+			return true
+		}
 		io.ErrClient(w, io.ERR_REQ)
 		return true
 	}
 	return false
 }
+
+// ValidErr sends field errors returned by validation
+func ValidErr(w http.ResponseWriter, err error) bool {
+	if errs, ok := err.(valid.Errors); ok {
+		io.ErrFields(w, errs)
+		return true
+	}
+	return false
+}
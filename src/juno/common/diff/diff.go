@@ -0,0 +1,560 @@
+// Package diff compares two values of the same type by reflection and reports changed leaves addressed by path:
+// exported struct fields by name ("Address.City"), slice and array items by index ("Phones[1]"),
+// map items by key ("Tags[home]"). Characters \ [ ] and . of map key are escaped by backslash ("Tags[a\.b]").
+// Fields tagged `diff:"-"` are skipped, `diff:"name"` renames the field in path.
+// Leaf of added or removed item (or pointed value) has nil on the missing side.
+// Set and Equal address value by the same path, so changes are replayed on the value
+package diff
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrPath is returned if path doesn't address leaf of value
+	ErrPath = errors.New("diff: invalid path")
+	// ErrValue is returned if value can't be converted to leaf type
+	ErrValue = errors.New("diff: value of wrong type")
+)
+
+// Change keeps previous and current value of changed leaf
+type Change struct {
+	Previous interface{}
+	Current  interface{}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// Compare returns changes between prev and next, they have to be of the same type (pointers are followed).
+// It panics if types differ
+func Compare(prev, next interface{}) map[string]Change {
+	a, b := reflect.ValueOf(prev), reflect.ValueOf(next)
+	if a.Type() != b.Type() {
+		panic("diff: values of different types " + a.Type().String() + " and " + b.Type().String())
+	}
+
+	changes := map[string]Change{}
+	compare(changes, "", a, b)
+	return changes
+}
+
+// compare walks a and b of the same type and records changed leaves under path
+func compare(changes map[string]Change, path string, a, b reflect.Value) {
+	switch a.Kind() {
+	case reflect.Ptr:
+		switch {
+		case a.IsNil() && b.IsNil():
+		case a.IsNil():
+			leaves(changes, path, b, true)
+		case b.IsNil():
+			leaves(changes, path, a, false)
+		default:
+			compare(changes, path, a.Elem(), b.Elem())
+		}
+
+	case reflect.Interface:
+		// dynamic value isn't addressable by path, so it's leaf
+		if !reflect.DeepEqual(value(a), value(b)) {
+			changes[path] = Change{value(a), value(b)}
+		}
+
+	case reflect.Struct:
+		if a.Type() == timeType {
+			if !a.Interface().(time.Time).Equal(b.Interface().(time.Time)) {
+				changes[path] = Change{value(a), value(b)}
+			}
+			return
+		}
+		for i := 0; i < a.NumField(); i++ {
+			name, ok := fieldName(a.Type().Field(i))
+			if ok {
+				compare(changes, join(path, name), a.Field(i), b.Field(i))
+			}
+		}
+
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < a.Len() || i < b.Len(); i++ {
+			item := fmt.Sprintf("%s[%d]", path, i)
+			switch {
+			case i >= a.Len():
+				leaves(changes, item, b.Index(i), true)
+			case i >= b.Len():
+				leaves(changes, item, a.Index(i), false)
+			default:
+				compare(changes, item, a.Index(i), b.Index(i))
+			}
+		}
+
+	case reflect.Map:
+		for _, key := range keys(a, b) {
+			item := mapItem(path, key)
+			av, bv := a.MapIndex(key), b.MapIndex(key)
+			switch {
+			case !av.IsValid():
+				leaves(changes, item, bv, true)
+			case !bv.IsValid():
+				leaves(changes, item, av, false)
+			default:
+				compare(changes, item, av, bv)
+			}
+		}
+
+	default:
+		// functions can't be compared, they aren't data anyway
+		if a.Type().Comparable() && value(a) != value(b) {
+			changes[path] = Change{value(a), value(b)}
+		}
+	}
+}
+
+// leaves records every leaf of v which exists on one side only, the missing side is nil
+func leaves(changes map[string]Change, path string, v reflect.Value, added bool) {
+	switch {
+	case v.Kind() == reflect.Ptr:
+		if !v.IsNil() {
+			leaves(changes, path, v.Elem(), added)
+		}
+
+	case v.Kind() == reflect.Struct && v.Type() != timeType:
+		for i := 0; i < v.NumField(); i++ {
+			if name, ok := fieldName(v.Type().Field(i)); ok {
+				leaves(changes, join(path, name), v.Field(i), added)
+			}
+		}
+
+	case v.Kind() == reflect.Slice || v.Kind() == reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			leaves(changes, fmt.Sprintf("%s[%d]", path, i), v.Index(i), added)
+		}
+
+	case v.Kind() == reflect.Map:
+		for _, key := range keys(v, v) {
+			leaves(changes, mapItem(path, key), v.MapIndex(key), added)
+		}
+
+	case v.Kind() != reflect.Func && value(v) != nil:
+		if added {
+			changes[path] = Change{nil, value(v)}
+		} else {
+			changes[path] = Change{value(v), nil}
+		}
+	}
+}
+
+// Set assigns val to leaf addressed by path in value pointed by ptr, missing items and pointed values are created.
+// Stored value may differ from leaf type (e.g. number decoded as float64), so it's converted if it's lossless.
+// Nil val removes item (or pointed value) the leaf belongs to, slice is cut at the item.
+// ErrValue is returned if there is no such item (e.g. nil for field of struct)
+func Set(ptr interface{}, path string, val interface{}) error {
+	v := reflect.ValueOf(ptr)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return ErrPath
+	}
+	steps, err := parse(path)
+	if err != nil {
+		return err
+	}
+
+	remove, err := set(v.Elem(), steps, val)
+	if remove {
+		return ErrValue
+	}
+	return err
+}
+
+// set assigns val to leaf addressed by steps in v, remove reports that nil val removes v from its container
+func set(v reflect.Value, steps []step, val interface{}) (remove bool, err error) {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			if val == nil {
+				return false, nil
+			}
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		remove, err := set(v.Elem(), steps, val)
+		if remove {
+			v.Set(reflect.Zero(v.Type()))
+		}
+		return false, err
+	}
+
+	if len(steps) == 0 {
+		if val == nil {
+			return true, nil
+		}
+		return false, assign(v, val)
+	}
+
+	s := steps[0]
+	switch v.Kind() {
+	case reflect.Struct:
+		f, ok := field(v, s)
+		if !ok {
+			return false, ErrPath
+		}
+		return set(f, steps[1:], val)
+
+	case reflect.Slice, reflect.Array:
+		i, err := strconv.Atoi(s.key)
+		if !s.index || err != nil || i < 0 || v.Kind() == reflect.Array && i >= v.Len() {
+			return false, ErrPath
+		}
+		if i >= v.Len() {
+			if val == nil {
+				return false, nil
+			}
+			v.Set(reflect.AppendSlice(v, reflect.MakeSlice(v.Type(), i+1-v.Len(), i+1-v.Len())))
+		}
+
+		remove, err := set(v.Index(i), steps[1:], val)
+		switch {
+		case remove && v.Kind() == reflect.Slice:
+			v.Set(v.Slice(0, i))
+		case remove:
+			v.Index(i).Set(reflect.Zero(v.Type().Elem()))
+		}
+		return false, err
+
+	case reflect.Map:
+		key, err := mapKey(v.Type().Key(), s)
+		if err != nil {
+			return false, err
+		}
+
+		// map item isn't addressable, so it's modified as copy
+		item := reflect.New(v.Type().Elem()).Elem()
+		if cur := v.MapIndex(key); cur.IsValid() {
+			item.Set(cur)
+		} else if val == nil {
+			return false, nil
+		}
+		remove, err := set(item, steps[1:], val)
+		switch {
+		case err != nil:
+		case remove:
+			v.SetMapIndex(key, reflect.Value{})
+		default:
+			if v.IsNil() {
+				v.Set(reflect.MakeMap(v.Type()))
+			}
+			v.SetMapIndex(key, item)
+		}
+		return false, err
+	}
+	return false, ErrPath
+}
+
+// Get returns leaf addressed by path in v, ok is false if it's missing (item or pointed value doesn't exist)
+func Get(v interface{}, path string) (val interface{}, ok bool, err error) {
+	leaf, ok, err := get(v, path)
+	if !ok || err != nil {
+		return nil, ok, err
+	}
+	return value(leaf), true, nil
+}
+
+// Equal checks that leaf addressed by path in v is equal to val converted to leaf type.
+// Nil val is equal to missing leaf
+func Equal(v interface{}, path string, val interface{}) (bool, error) {
+	leaf, ok, err := get(v, path)
+	switch {
+	case err != nil:
+		return false, err
+	case val == nil:
+		return !ok || value(leaf) == nil, nil
+	case !ok:
+		return false, nil
+	}
+
+	converted := reflect.New(leaf.Type()).Elem()
+	if err := assign(converted, val); err != nil {
+		return false, err
+	}
+	changes := map[string]Change{}
+	compare(changes, "", leaf, converted)
+	return len(changes) == 0, nil
+}
+
+// get walks v by path, pointers are followed
+func get(root interface{}, path string) (v reflect.Value, ok bool, err error) {
+	steps, err := parse(path)
+	if err != nil {
+		return v, false, err
+	}
+
+	v = reflect.ValueOf(root)
+	for i := 0; ; i++ {
+		for v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return v, false, nil
+			}
+			v = v.Elem()
+		}
+		if i == len(steps) {
+			return v, true, nil
+		}
+
+		s := steps[i]
+		switch v.Kind() {
+		case reflect.Struct:
+			if v, ok = field(v, s); !ok {
+				return v, false, ErrPath
+			}
+		case reflect.Slice, reflect.Array:
+			n, err := strconv.Atoi(s.key)
+			if !s.index || err != nil || n < 0 {
+				return v, false, ErrPath
+			}
+			if n >= v.Len() {
+				return v, false, nil
+			}
+			v = v.Index(n)
+		case reflect.Map:
+			key, err := mapKey(v.Type().Key(), s)
+			if err != nil {
+				return v, false, err
+			}
+			if v = v.MapIndex(key); !v.IsValid() {
+				return v, false, nil
+			}
+		default:
+			return v, false, ErrPath
+		}
+	}
+}
+
+// assign sets val to v converting it to type of v.
+// Numbers are converted if value is kept, strings and booleans are converted to named types
+func assign(v reflect.Value, val interface{}) error {
+	x := reflect.ValueOf(val)
+	switch {
+	case x.Type().AssignableTo(v.Type()):
+		v.Set(x)
+	case number(x.Kind()) && number(v.Kind()):
+		if unsigned(v.Kind()) && x.Convert(reflect.TypeOf(float64(0))).Float() < 0 {
+			return ErrValue
+		}
+		converted := x.Convert(v.Type())
+		if converted.Convert(x.Type()).Interface() != x.Interface() {
+			return ErrValue
+		}
+		v.Set(converted)
+	case x.Kind() == v.Kind() && (x.Kind() == reflect.String || x.Kind() == reflect.Bool):
+		v.Set(x.Convert(v.Type()))
+	default:
+		return ErrValue
+	}
+	return nil
+}
+
+func number(k reflect.Kind) bool {
+	return k >= reflect.Int && k <= reflect.Float64
+}
+
+func unsigned(k reflect.Kind) bool {
+	return k >= reflect.Uint && k <= reflect.Uintptr
+}
+
+// step is part of path: struct field name or index (key) of slice or map item
+type step struct {
+	key   string
+	index bool
+}
+
+// parse splits path to steps: "Addresses[1].City" is Addresses, [1], City. Escaped index is unescaped
+func parse(path string) ([]step, error) {
+	steps := []step{}
+	for rest := path; rest != ""; {
+		switch {
+		case rest[0] == '[':
+			key := []byte{}
+			end := 1
+			for ; end < len(rest) && rest[end] != ']'; end++ {
+				if rest[end] == '\\' {
+					end++
+					if end == len(rest) {
+						return nil, ErrPath
+					}
+				}
+				key = append(key, rest[end])
+			}
+			if end == len(rest) {
+				return nil, ErrPath
+			}
+			steps = append(steps, step{key: string(key), index: true})
+			rest = rest[end+1:]
+			if strings.HasPrefix(rest, ".") {
+				rest = rest[1:]
+			}
+		default:
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, ErrPath
+			}
+			steps = append(steps, step{key: rest[:end]})
+			rest = strings.TrimPrefix(rest[end:], ".")
+		}
+	}
+	return steps, nil
+}
+
+// Less orders paths step by step, indexes are compared as numbers, so "Phones[2]" goes before "Phones[10]"
+// and leaves of the same item follow each other. Invalid paths are compared as strings
+func Less(a, b string) bool {
+	sa, erra := parse(a)
+	sb, errb := parse(b)
+	if erra != nil || errb != nil {
+		return a < b
+	}
+
+	for i := 0; i < len(sa) && i < len(sb); i++ {
+		x, y := sa[i], sb[i]
+		switch {
+		case x == y:
+			continue
+		case x.index != y.index:
+			return !x.index
+		case x.index:
+			n, errn := strconv.Atoi(x.key)
+			m, errm := strconv.Atoi(y.key)
+			if errn == nil && errm == nil && n != m {
+				return n < m
+			}
+		}
+		return x.key < y.key
+	}
+	return len(sa) < len(sb)
+}
+
+// SortPaths sorts paths by Less
+func SortPaths(paths []string) {
+	sort.Slice(paths, func(i, j int) bool {
+		return Less(paths[i], paths[j])
+	})
+}
+
+// Root returns the first struct field name of path, so "Addresses[1].City" belongs to Addresses
+func Root(path string) string {
+	if end := strings.IndexAny(path, ".["); end >= 0 {
+		return path[:end]
+	}
+	return path
+}
+
+// Names returns names of struct fields (as they start paths) of value v
+func Names(v interface{}) []string {
+	t := reflect.TypeOf(v)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	names := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		if name, ok := fieldName(t.Field(i)); ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// field returns struct field addressed by step
+func field(v reflect.Value, s step) (reflect.Value, bool) {
+	if s.index || v.Type() == timeType {
+		return v, false
+	}
+	for i := 0; i < v.NumField(); i++ {
+		if name, ok := fieldName(v.Type().Field(i)); ok && name == s.key {
+			return v.Field(i), true
+		}
+	}
+	return v, false
+}
+
+// mapKey converts step to map key of type t, it's parsed unless key is string
+func mapKey(t reflect.Type, s step) (reflect.Value, error) {
+	if !s.index {
+		return reflect.Value{}, ErrPath
+	}
+
+	key := reflect.New(t)
+	if t.Kind() == reflect.String {
+		key.Elem().SetString(s.key)
+	} else if _, err := fmt.Sscan(s.key, key.Interface()); err != nil {
+		return reflect.Value{}, ErrPath
+	}
+	return key.Elem(), nil
+}
+
+// fieldName returns name of struct field in path, unexported and excluded fields are skipped
+func fieldName(f reflect.StructField) (string, bool) {
+	if f.PkgPath != "" {
+		return "", false
+	}
+
+	tag := f.Tag.Get("diff")
+	switch {
+	case tag == "-":
+		return "", false
+	case tag != "":
+		return tag, true
+	}
+	return f.Name, true
+}
+
+// keys returns union of keys of two maps ordered by their string form
+func keys(a, b reflect.Value) []reflect.Value {
+	seen := map[interface{}]bool{}
+	union := []reflect.Value{}
+	for _, m := range []reflect.Value{a, b} {
+		for _, key := range m.MapKeys() {
+			if !seen[key.Interface()] {
+				seen[key.Interface()] = true
+				union = append(union, key)
+			}
+		}
+	}
+
+	sort.Slice(union, func(i, j int) bool {
+		return fmt.Sprint(union[i].Interface()) < fmt.Sprint(union[j].Interface())
+	})
+	return union
+}
+
+// value returns interface of v with pointers followed, invalid and nil values are nil
+func value(v reflect.Value) interface{} {
+	if !v.IsValid() {
+		return nil
+	}
+	if (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil() {
+		return nil
+	}
+	if v.Kind() == reflect.Ptr {
+		return value(v.Elem())
+	}
+	return v.Interface()
+}
+
+// keyEscaper escapes map key in path, so it doesn't end index or start next step
+var keyEscaper = strings.NewReplacer(`\`, `\\`, `[`, `\[`, `]`, `\]`, `.`, `\.`)
+
+// mapItem appends escaped map key to path
+func mapItem(path string, key reflect.Value) string {
+	return path + "[" + keyEscaper.Replace(fmt.Sprint(key.Interface())) + "]"
+}
+
+// join appends field name to path
+func join(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
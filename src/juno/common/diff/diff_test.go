@@ -0,0 +1,224 @@
+package diff
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type address struct {
+	City string
+	Zip  string
+}
+
+type person struct {
+	Name      string
+	Age       int
+	Password  string `diff:"-"`
+	Addresses []address
+	Home      *address
+	Tags      map[string]string
+	Born      time.Time
+	Nick      string `diff:"nickname"`
+	note      string
+}
+
+func TestCompare(t *testing.T) {
+	born := time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+	prev := &person{
+		Name:      "John",
+		Age:       30,
+		Password:  "secret",
+		Addresses: []address{{"NY", "10003"}, {"LA", "90001"}},
+		Tags:      map[string]string{"a": "1", "b": "2"},
+		Born:      born,
+		Nick:      "j",
+		note:      "x",
+	}
+	next := &person{
+		Name:      "John",
+		Age:       31,
+		Password:  "changed",
+		Addresses: []address{{"NY", "10003"}, {"SF", "90001"}, {"DC", "20001"}},
+		Home:      &address{"NY", "10003"},
+		Tags:      map[string]string{"a": "1", "c": "3"},
+		Born:      born.In(time.FixedZone("EST", -5*3600)),
+		Nick:      "jo",
+		note:      "y",
+	}
+
+	want := map[string]Change{
+		"Age":               {30, 31},
+		"Addresses[1].City": {"LA", "SF"},
+		"Addresses[2].City": {nil, "DC"},
+		"Addresses[2].Zip":  {nil, "20001"},
+		"Home.City":         {nil, "NY"},
+		"Home.Zip":          {nil, "10003"},
+		"Tags[b]":           {"2", nil},
+		"Tags[c]":           {nil, "3"},
+		"nickname":          {"j", "jo"},
+	}
+	if got := Compare(prev, next); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+
+	if got := Compare(next, next); len(got) != 0 {
+		t.Fatalf("expected no changes of equal values, got %v", got)
+	}
+
+	next.Home, prev.Home = &address{"NY", "10003"}, &address{"NY", "10011"}
+	if got := Compare(prev.Home, next.Home); !reflect.DeepEqual(got, map[string]Change{"Zip": {"10011", "10003"}}) {
+		t.Fatalf("unexpected changes of pointers %v", got)
+	}
+}
+
+func TestCompareTypes(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("values of different types are compared")
+		}
+	}()
+	Compare(person{}, address{})
+}
+
+func TestSet(t *testing.T) {
+	prev := &person{
+		Name:      "John",
+		Age:       30,
+		Addresses: []address{{"NY", "10003"}, {"LA", "90001"}, {"SF", "94016"}},
+		Home:      &address{"NY", "10003"},
+		Tags:      map[string]string{"a": "1", "b": "2"},
+	}
+	next := &person{
+		Name:      "Will",
+		Age:       31,
+		Addresses: []address{{"NY", "10011"}},
+		Tags:      map[string]string{"a": "1", "c": "3"},
+		Born:      time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+
+	// changes are replayed in both directions, numbers are stored as float64
+	for _, c := range []struct{ from, to *person }{{prev, next}, {next, prev}} {
+		replayed := &person{}
+		for path, ch := range Compare(&person{}, c.from) {
+			if err := Set(replayed, path, ch.Current); err != nil {
+				t.Fatalf("%s: %v", path, err)
+			}
+		}
+		for path, ch := range Compare(c.from, c.to) {
+			if n, ok := ch.Current.(int); ok {
+				ch.Current = float64(n)
+			}
+			if err := Set(replayed, path, ch.Current); err != nil {
+				t.Fatalf("%s: %v", path, err)
+			}
+		}
+		if changes := Compare(replayed, c.to); len(changes) != 0 {
+			t.Fatalf("replayed value differs %v", changes)
+		}
+	}
+
+	invalid := []struct {
+		path string
+		val  interface{}
+	}{
+		{"Unknown", "x"},
+		{"Password", "x"},
+		{"Age", "x"},
+		{"Age", 30.5},
+		{"Name", nil},
+		{"Addresses[x].City", "x"},
+		{"Addresses[0].Street", "x"},
+		{"Name[0]", "x"},
+	}
+	for _, c := range invalid {
+		if err := Set(&person{}, c.path, c.val); err == nil {
+			t.Fatalf("%s: %v is set", c.path, c.val)
+		}
+	}
+}
+
+func TestEqual(t *testing.T) {
+	p := &person{Age: 30, Addresses: []address{{"NY", "10003"}}, Tags: map[string]string{"a": "1"}}
+
+	cases := []struct {
+		path  string
+		val   interface{}
+		equal bool
+	}{
+		{"Age", float64(30), true},
+		{"Age", int64(31), false},
+		{"Addresses[0].City", "NY", true},
+		{"Addresses[1].City", nil, true},
+		{"Addresses[0].City", nil, false},
+		{"Home.City", nil, true},
+		{"Tags[a]", "1", true},
+		{"Tags[b]", "1", false},
+	}
+	for _, c := range cases {
+		equal, err := Equal(p, c.path, c.val)
+		if err != nil || equal != c.equal {
+			t.Fatalf("%s: expected %v, got %v (%v)", c.path, c.equal, equal, err)
+		}
+	}
+
+	if _, err := Equal(p, "Age", "x"); err != ErrValue {
+		t.Fatalf("expected ErrValue, got %v", err)
+	}
+	if val, ok, err := Get(p, "Addresses[0].Zip"); val != "10003" || !ok || err != nil {
+		t.Fatalf("unexpected value %v, %v, %v", val, ok, err)
+	}
+	if names := Names(p); !reflect.DeepEqual(names, []string{"Name", "Age", "Addresses", "Home", "Tags", "Born", "nickname"}) {
+		t.Fatalf("unexpected names %v", names)
+	}
+	if root := Root("Addresses[1].City"); root != "Addresses" {
+		t.Fatalf("unexpected root %s", root)
+	}
+}
+
+func TestEscapedKeys(t *testing.T) {
+	prev := &person{Tags: map[string]string{"a.b": "1", "x]y": "2"}}
+	next := &person{Tags: map[string]string{"a.b": "3", `[c\d]`: "4"}}
+
+	changes := Compare(prev, next)
+	expected := map[string]Change{
+		`Tags[a\.b]`:     {"1", "3"},
+		`Tags[x\]y]`:     {"2", nil},
+		`Tags[\[c\\d\]]`: {nil, "4"},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Fatalf("unexpected changes %v", changes)
+	}
+
+	// escaped keys are replayed and found by the same paths
+	for path, ch := range changes {
+		if err := Set(prev, path, ch.Current); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if equal, err := Equal(prev, path, ch.Current); err != nil || !equal {
+			t.Fatalf("%s: expected %v, got %v", path, ch.Current, err)
+		}
+	}
+	if !reflect.DeepEqual(prev.Tags, next.Tags) {
+		t.Fatalf("replayed tags %v differ from %v", prev.Tags, next.Tags)
+	}
+	if root := Root(`Tags[a\.b]`); root != "Tags" {
+		t.Fatalf("unexpected root %s", root)
+	}
+
+	for _, path := range []string{`Tags[a\]`, `Tags[a\`} {
+		if _, _, err := Get(prev, path); err != ErrPath {
+			t.Fatalf("%s: expected ErrPath, got %v", path, err)
+		}
+	}
+}
+
+func TestSortPaths(t *testing.T) {
+	paths := []string{"Tags[b]", "Addresses[10].City", "Name", "Addresses[2].Zip", "Addresses[2].City", `Tags[a\.b]`, "Addresses[1]"}
+	SortPaths(paths)
+
+	expected := []string{"Addresses[1]", "Addresses[2].City", "Addresses[2].Zip", "Addresses[10].City", "Name", `Tags[a\.b]`, "Tags[b]"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Fatalf("unexpected order %v", paths)
+	}
+}
@@ -2,34 +2,72 @@ package io
 
 import (
 	"encoding/json"
+	"juno/common/valid"
 	"log"
 	"net/http"
 )
 
 // error messages displayed to client
 const (
-	ERR_DB           = "Oops! database problem, try again latter"
-	ERR_NOPROF       = "profile not found"
-	ERR_NOUSER       = "user not found"
+	ERR_DB        = "Oops! database problem, try again latter"
+	ERR_SERVER    = "Oops! something went wrong, try again latter"
+	ERR_NOPROF    = "profile not found"
+	ERR_NOUSER    = "user not found"
+	ERR_NOSESSION = "session not found"
+
+	ERR_CONFIRM_INVALID = "confirmation token is invalid"
+	ERR_CONFIRM_EXPIRED = "confirmation token is expired, request a new one"
+	ERR_CONFIRM_USED    = "account is already confirmed"
+
+	ERR_RESET_INVALID = "password reset token is invalid"
+	ERR_RESET_EXPIRED = "password reset token is expired, request a new one"
+
+	ERR_EMAIL_INVALID = "email change token is invalid"
+	ERR_EMAIL_EXPIRED = "email change token is expired, request the change again"
+	ERR_EMAIL_DUP     = "The email is already registered"
+
+	ERR_DISABLED = "account is disabled"
+
+	ERR_PRECONDITION = "profile has been modified, fetch it again"
+	ERR_CONFLICT     = "profile is being modified concurrently, try again"
 	ERR_REQ          = "something wrong with your request body"
+	ERR_INVALID      = "some fields are invalid"
 	ERR_FORBIDDEN    = "Forbidden"
 	ERR_UNAUTHORIZED = "Unauthorized"
 
 	JUNO_ERR_HEADER = "Juno-Err"
 )
 
-// Input obtains request json body and fills up object with data
+// Input obtains request json body and fills up object with data.
+// Value of wrong type is reported as valid.Errors with the field name
 func Input(r *http.Request, obj interface{}) error {
 	dec := json.NewDecoder(r.Body)
 	if err := dec.Decode(obj); err != nil {
 		// todo: r.Body also should be written to log, but it needs to implement some protections
-		// todo: json throws UnmarshalTypeError. we can handle it to determine bad field name and value to show to user.
 		log.Println(err)
-		return err
+		return typeErr(err)
+	}
+	return nil
+}
+
+// Unmarshal fills up object with json data the same way Input does
+func Unmarshal(data []byte, obj interface{}) error {
+	if err := json.Unmarshal(data, obj); err != nil {
+		log.Println(err)
+		return typeErr(err)
 	}
 	return nil
 }
 
+// typeErr reports value of wrong type as valid.Errors with the field name
+func typeErr(err error) error {
+	if e, ok := err.(*json.UnmarshalTypeError); ok && e.Field != "" {
+		msg := "must be " + e.Type.String() + ", not " + e.Value
+		return valid.Errors{{Field: e.Field, Code: valid.TYPE, Message: msg}}
+	}
+	return err
+}
+
 // Marshal object to json and send to net
 // If http code isn't set it will be set to 200
 func Output(w http.ResponseWriter, obj interface{}) {
@@ -58,6 +96,8 @@ func Output(w http.ResponseWriter, obj interface{}) {
 type ErrJSON struct {
 	Code    int
 	Message string
+	// Errors lists invalid fields, it's set for validation errors only
+	Errors valid.Errors `json:",omitempty"`
 }
 
 // Send error with code 400
@@ -74,5 +114,13 @@ func ErrServer(w http.ResponseWriter, msg string) {
 func Err(w http.ResponseWriter, msg string, code int) {
 	w.Header().Add(JUNO_ERR_HEADER, msg)
 	w.WriteHeader(code)
-	Output(w, ErrJSON{code, msg})
+	Output(w, ErrJSON{Code: code, Message: msg})
+}
+
+// ErrFields responds with code 422 and list of invalid fields
+func ErrFields(w http.ResponseWriter, errs valid.Errors) {
+	code := http.StatusUnprocessableEntity
+	w.Header().Add(JUNO_ERR_HEADER, errs.Error())
+	w.WriteHeader(code)
+	Output(w, ErrJSON{Code: code, Message: ERR_INVALID, Errors: errs})
 }
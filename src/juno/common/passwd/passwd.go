@@ -0,0 +1,65 @@
+// Package passwd hashes and verifies user passwords.
+// Hash is encoded together with algorithm and cost: "bcrypt-sha256$<bcrypt hash>",
+// so cost can be raised later and old hashes are still verifiable.
+// Password is pre-hashed by sha256, because bcrypt uses only first 72 bytes of the input.
+package passwd
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+)
+
+const ALGO = "bcrypt-sha256"
+
+// Cost is the current bcrypt cost. Hashes with lower cost are reported as outdated by Verify.
+var Cost = bcrypt.DefaultCost
+
+// dummy is verified when there is no user, so response time doesn't reveal registered emails
+var dummy, _ = Hash("dummy password")
+
+// Hash returns encoded salted hash of the password
+func Hash(plain string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword(prehash(plain), Cost)
+	if err != nil {
+		return "", err
+	}
+
+	return ALGO + "$" + string(hash), nil
+}
+
+// Verify checks password against encoded hash in constant time.
+// Value without algorithm prefix is considered as legacy plain text password.
+// rehash is true if password matches but stored value has to be replaced (legacy or outdated cost).
+func Verify(encoded, plain string) (ok, rehash bool) {
+	if !IsHash(encoded) {
+		ok = subtle.ConstantTimeCompare([]byte(encoded), []byte(plain)) == 1
+		return ok, ok
+	}
+
+	hash := []byte(strings.TrimPrefix(encoded, ALGO+"$"))
+	if bcrypt.CompareHashAndPassword(hash, prehash(plain)) != nil {
+		return false, false
+	}
+
+	cost, err := bcrypt.Cost(hash)
+	return true, err == nil && cost < Cost
+}
+
+// VerifyDummy spends the same time as Verify does. It's called when user isn't found
+func VerifyDummy(plain string) {
+	Verify(dummy, plain)
+}
+
+// IsHash checks that value is encoded by Hash, not plain text
+func IsHash(encoded string) bool {
+	return strings.HasPrefix(encoded, ALGO+"$")
+}
+
+// prehash fits password of any length into bcrypt input, base64 avoids zero bytes
+func prehash(plain string) []byte {
+	sum := sha256.Sum256([]byte(plain))
+	return []byte(base64.StdEncoding.EncodeToString(sum[:]))
+}
@@ -0,0 +1,73 @@
+package passwd
+
+import (
+	"golang.org/x/crypto/bcrypt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	Cost = bcrypt.MinCost
+	os.Exit(m.Run())
+}
+
+func TestHashVerify(t *testing.T) {
+	hash, err := Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, ALGO+"$") || strings.Contains(hash, "secret") {
+		t.Fatalf("unexpected hash format %q", hash)
+	}
+
+	if ok, rehash := Verify(hash, "secret"); !ok || rehash {
+		t.Fatalf("valid password: ok=%v rehash=%v", ok, rehash)
+	}
+	if ok, _ := Verify(hash, "wrong"); ok {
+		t.Fatal("wrong password is accepted")
+	}
+
+	other, _ := Hash("secret")
+	if other == hash {
+		t.Fatal("hashes of the same password have to be salted")
+	}
+}
+
+func TestVerifyLegacy(t *testing.T) {
+	if ok, rehash := Verify("plain", "plain"); !ok || !rehash {
+		t.Fatalf("legacy password: ok=%v rehash=%v", ok, rehash)
+	}
+	if ok, rehash := Verify("plain", "wrong"); ok || rehash {
+		t.Fatalf("wrong legacy password: ok=%v rehash=%v", ok, rehash)
+	}
+	if ok, _ := Verify(ALGO+"$broken", "pass"); ok {
+		t.Fatal("malformed hash is accepted")
+	}
+}
+
+func TestVerifyOutdated(t *testing.T) {
+	defer func(cost int) { Cost = cost }(Cost)
+
+	Cost = bcrypt.MinCost
+	hash, err := Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Cost = bcrypt.MinCost + 1
+	if ok, rehash := Verify(hash, "secret"); !ok || !rehash {
+		t.Fatalf("outdated cost: ok=%v rehash=%v", ok, rehash)
+	}
+}
+
+func TestVerifyLong(t *testing.T) {
+	prefix := strings.Repeat("x", 72)
+	hash, err := Hash(prefix + "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := Verify(hash, prefix+"2"); ok {
+		t.Fatal("password is truncated")
+	}
+}
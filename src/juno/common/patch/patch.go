@@ -0,0 +1,159 @@
+// Package patch modifies JSON documents by RFC 7396 JSON Merge Patch and RFC 6902 JSON Patch.
+// Documents are decoded JSON objects (map[string]interface{}), arrays aren't addressed by patches
+package patch
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+)
+
+// content types of patches
+const (
+	MERGE_PATCH = "application/merge-patch+json"
+	JSON_PATCH  = "application/json-patch+json"
+)
+
+var (
+	// ErrMalformed is returned if patch can't be parsed or addresses not existing member
+	ErrMalformed = errors.New("malformed patch")
+	// ErrTest is returned if "test" operation of JSON Patch fails
+	ErrTest = errors.New("patch test operation failed")
+)
+
+// Merge applies merge patch to document: null removes member, object is merged recursively,
+// any other value replaces member.
+func Merge(doc map[string]interface{}, data []byte) error {
+	patch := map[string]interface{}{}
+	if err := json.Unmarshal(data, &patch); err != nil {
+		return ErrMalformed
+	}
+
+	merge(doc, patch)
+	return nil
+}
+
+func merge(doc, patch map[string]interface{}) {
+	for key, val := range patch {
+		if val == nil {
+			delete(doc, key)
+			continue
+		}
+
+		sub, ok := val.(map[string]interface{})
+		if !ok {
+			doc[key] = val
+			continue
+		}
+
+		target, ok := doc[key].(map[string]interface{})
+		if !ok {
+			target = map[string]interface{}{}
+			doc[key] = target
+		}
+		merge(target, sub)
+	}
+}
+
+// Operation is one step of JSON Patch
+type Operation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// Apply applies JSON Patch to document. Operations are applied in order,
+// document is partially modified if some of them fails, so caller should apply patch to a copy.
+func Apply(doc map[string]interface{}, data []byte) error {
+	ops := []Operation{}
+	if err := json.Unmarshal(data, &ops); err != nil {
+		return ErrMalformed
+	}
+
+	for _, op := range ops {
+		if err := apply(doc, op); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func apply(doc map[string]interface{}, op Operation) error {
+	parent, key, err := locate(doc, op.Path)
+	if err != nil {
+		return err
+	}
+
+	switch op.Op {
+	case "add", "replace", "test":
+		var val interface{}
+		if len(op.Value) == 0 || json.Unmarshal(op.Value, &val) != nil {
+			return ErrMalformed
+		}
+		cur, exists := parent[key]
+		switch op.Op {
+		case "add":
+			parent[key] = val
+		case "replace":
+			if !exists {
+				return ErrMalformed
+			}
+			parent[key] = val
+		case "test":
+			if !exists || !reflect.DeepEqual(cur, val) {
+				return ErrTest
+			}
+		}
+
+	case "remove":
+		if _, exists := parent[key]; !exists {
+			return ErrMalformed
+		}
+		delete(parent, key)
+
+	case "move", "copy":
+		fromParent, fromKey, err := locate(doc, op.From)
+		if err != nil {
+			return err
+		}
+		val, exists := fromParent[fromKey]
+		if !exists {
+			return ErrMalformed
+		}
+		if op.Op == "move" {
+			delete(fromParent, fromKey)
+		}
+		parent[key] = val
+
+	default:
+		return ErrMalformed
+	}
+	return nil
+}
+
+// locate resolves JSON Pointer to parent object and member name
+func locate(doc map[string]interface{}, pointer string) (map[string]interface{}, string, error) {
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, "", ErrMalformed
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	parent := doc
+	for _, token := range tokens[:len(tokens)-1] {
+		next, ok := parent[unescape(token)].(map[string]interface{})
+		if !ok {
+			return nil, "", ErrMalformed
+		}
+		parent = next
+	}
+
+	return parent, unescape(tokens[len(tokens)-1]), nil
+}
+
+// unescape decodes reference token of JSON Pointer (RFC 6901)
+func unescape(token string) string {
+	token = strings.Replace(token, "~1", "/", -1)
+	return strings.Replace(token, "~0", "~", -1)
+}
@@ -0,0 +1,80 @@
+package patch
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestMerge(t *testing.T) {
+	doc := decode(t, `{"Name":"John","Age":30,"Address":{"City":"NY","Zip":"10003"}}`)
+
+	err := Merge(doc, []byte(`{"Age":31,"Phone":"+1","Name":null,"Address":{"Zip":null,"Street":"17th"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := decode(t, `{"Age":31,"Phone":"+1","Address":{"City":"NY","Street":"17th"}}`)
+	if !reflect.DeepEqual(doc, want) {
+		t.Fatalf("expected %v, got %v", want, doc)
+	}
+
+	if err := Merge(doc, []byte(`[1,2]`)); err != ErrMalformed {
+		t.Fatalf("expected ErrMalformed, got %v", err)
+	}
+}
+
+func TestApply(t *testing.T) {
+	doc := decode(t, `{"Name":"John","Age":30,"a/b":1,"Address":{"City":"NY"}}`)
+
+	ops := `[
+		{"op":"test","path":"/Name","value":"John"},
+		{"op":"replace","path":"/Name","value":"Will"},
+		{"op":"add","path":"/Phone","value":"+1"},
+		{"op":"remove","path":"/a~1b"},
+		{"op":"add","path":"/Address/Zip","value":"10003"},
+		{"op":"copy","from":"/Age","path":"/Years"},
+		{"op":"move","from":"/Years","path":"/Old"}
+	]`
+	if err := Apply(doc, []byte(ops)); err != nil {
+		t.Fatal(err)
+	}
+
+	want := decode(t, `{"Name":"Will","Age":30,"Old":30,"Phone":"+1","Address":{"City":"NY","Zip":"10003"}}`)
+	if !reflect.DeepEqual(doc, want) {
+		t.Fatalf("expected %v, got %v", want, doc)
+	}
+}
+
+func TestApplyErrors(t *testing.T) {
+	cases := []struct {
+		ops string
+		err error
+	}{
+		{`{"op":"add"}`, ErrMalformed},
+		{`[{"op":"test","path":"/Name","value":"Will"}]`, ErrTest},
+		{`[{"op":"test","path":"/Missing","value":null}]`, ErrTest},
+		{`[{"op":"replace","path":"/Missing","value":1}]`, ErrMalformed},
+		{`[{"op":"remove","path":"/Missing"}]`, ErrMalformed},
+		{`[{"op":"add","path":"Name","value":1}]`, ErrMalformed},
+		{`[{"op":"add","path":"/Name"}]`, ErrMalformed},
+		{`[{"op":"add","path":"/No/Name","value":1}]`, ErrMalformed},
+		{`[{"op":"move","from":"/Missing","path":"/Name"}]`, ErrMalformed},
+		{`[{"op":"drop","path":"/Name"}]`, ErrMalformed},
+	}
+
+	for _, c := range cases {
+		doc := decode(t, `{"Name":"John"}`)
+		if err := Apply(doc, []byte(c.ops)); err != c.err {
+			t.Errorf("%s: expected %v, got %v", c.ops, c.err, err)
+		}
+	}
+}
+
+func decode(t *testing.T, s string) map[string]interface{} {
+	doc := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(s), &doc); err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
@@ -0,0 +1,105 @@
+// Package token issues and verifies signed access tokens
+// and generates random secrets (refresh, confirmation tokens) that are stored as digests.
+package token
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalid = errors.New("token is invalid")
+	ErrExpired = errors.New("token is expired")
+)
+
+var b64 = base64.RawURLEncoding
+
+// Claims is the payload of access token
+type Claims struct {
+	UserID    string `json:"uid"`
+	SessionID string `json:"sid"`
+	// Roles is the bit string of user roles, so permissions are checked without db round-trip too
+	Roles  int64 `json:"rol"`
+	Expire int64 `json:"exp"`
+}
+
+// Signer signs and verifies access tokens with HMAC-SHA256.
+// Token looks like "<base64 claims>.<base64 signature>", so it's verified without db round-trip
+type Signer struct {
+	key []byte
+}
+
+// NewSigner creates signer. Key should be at least 32 random bytes
+func NewSigner(key []byte) Signer {
+	return Signer{key}
+}
+
+// Sign returns access token for claims
+func (s Signer) Sign(c Claims) (string, error) {
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+
+	body := b64.EncodeToString(payload)
+	return body + "." + b64.EncodeToString(s.mac(body)), nil
+}
+
+// Verify checks signature and expiration and returns token claims
+func (s Signer) Verify(tok string, now time.Time) (Claims, error) {
+	c := Claims{}
+
+	dot := strings.IndexByte(tok, '.')
+	if dot < 0 {
+		return c, ErrInvalid
+	}
+	body, sig := tok[:dot], tok[dot+1:]
+
+	got, err := b64.DecodeString(sig)
+	if err != nil || !hmac.Equal(got, s.mac(body)) {
+		return c, ErrInvalid
+	}
+
+	payload, err := b64.DecodeString(body)
+	if err != nil {
+		return c, ErrInvalid
+	}
+	if err := json.Unmarshal(payload, &c); err != nil || c.UserID == "" {
+		return c, ErrInvalid
+	}
+
+	if now.Unix() >= c.Expire {
+		return c, ErrExpired
+	}
+
+	return c, nil
+}
+
+func (s Signer) mac(body string) []byte {
+	m := hmac.New(sha256.New, s.key)
+	m.Write([]byte(body))
+	return m.Sum(nil)
+}
+
+// Random returns url safe random secret
+func Random() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return b64.EncodeToString(b), nil
+}
+
+// Digest returns value of secret that is preserved in storage instead of secret itself.
+// Secrets are random and long, so plain sha256 is enough (unlike passwords)
+func Digest(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
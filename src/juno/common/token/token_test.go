@@ -0,0 +1,34 @@
+package token
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSignVerify(t *testing.T) {
+	s := NewSigner([]byte("key"))
+	now := time.Now()
+
+	tok, err := s.Sign(Claims{UserID: "u1", SessionID: "s1", Expire: now.Add(time.Minute).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := s.Verify(tok, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.UserID != "u1" || c.SessionID != "s1" {
+		t.Fatalf("unexpected claims %#v", c)
+	}
+
+	if _, err = s.Verify(tok, now.Add(time.Hour)); err != ErrExpired {
+		t.Fatalf("expected ErrExpired, got %v", err)
+	}
+	if _, err = NewSigner([]byte("other")).Verify(tok, now); err != ErrInvalid {
+		t.Fatalf("foreign key: expected ErrInvalid, got %v", err)
+	}
+	if _, err = s.Verify("x"+tok, now); err != ErrInvalid {
+		t.Fatalf("tampered token: expected ErrInvalid, got %v", err)
+	}
+}
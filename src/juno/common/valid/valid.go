@@ -0,0 +1,173 @@
+// Package valid validates objects declaratively: each object declares list of fields with rules,
+// Struct checks them and returns all failures as field-level errors.
+package valid
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// error codes
+const (
+	REQUIRED = "required"
+	LENGTH   = "length"
+	FORMAT   = "format"
+	RANGE    = "range"
+	CHARS    = "chars"
+	TYPE     = "type"
+	// UNKNOWN and READONLY are reported by partial updates that touch not existing or immutable fields
+	UNKNOWN  = "unknown"
+	READONLY = "readonly"
+)
+
+// FieldError describes why field is invalid
+type FieldError struct {
+	Field   string
+	Code    string
+	Message string
+}
+
+// Errors is the list of field errors, it's returned as error
+type Errors []FieldError
+
+func (errs Errors) Error() string {
+	msgs := make([]string, 0, len(errs))
+	for _, e := range errs {
+		msgs = append(msgs, e.Field+": "+e.Message)
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Rule checks value and returns code and message if it's invalid.
+// Rules (except Required) consider empty value as valid, so optional fields are allowed to be empty
+type Rule func(value interface{}) (code, msg string, ok bool)
+
+// Field declares rules of struct field
+type Field struct {
+	Name  string
+	Rules []Rule
+}
+
+// Declare creates field declaration
+func Declare(name string, rules ...Rule) Field {
+	return Field{name, rules}
+}
+
+// Struct checks fields of obj (pointer or struct) against declared rules.
+// If only is not empty just listed fields are checked. It returns nil if all fields are valid
+func Struct(obj interface{}, fields []Field, only ...string) error {
+	v := reflect.Indirect(reflect.ValueOf(obj))
+
+	errs := Errors{}
+	for _, f := range fields {
+		if len(only) > 0 && !contains(only, f.Name) {
+			continue
+		}
+
+		fv := v.FieldByName(f.Name)
+		if !fv.IsValid() {
+			panic("valid: no field " + f.Name + " in " + v.Type().String())
+		}
+
+		// the first failed rule is reported only
+		for _, rule := range f.Rules {
+			if code, msg, ok := rule(fv.Interface()); !ok {
+				errs = append(errs, FieldError{f.Name, code, msg})
+				break
+			}
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// ################## Rules ####################
+
+// Required rejects zero value
+func Required(value interface{}) (string, string, bool) {
+	if isZero(value) {
+		return REQUIRED, "is required", false
+	}
+	return "", "", true
+}
+
+// Length limits count of characters in string
+func Length(min, max int) Rule {
+	return func(value interface{}) (string, string, bool) {
+		s, _ := value.(string)
+		if s == "" {
+			return "", "", true
+		}
+		if n := utf8.RuneCountInString(s); n < min || n > max {
+			return LENGTH, fmt.Sprintf("length must be between %d and %d characters", min, max), false
+		}
+		return "", "", true
+	}
+}
+
+// Match requires string to match regular expression, desc explains expected format to user
+func Match(re *regexp.Regexp, desc string) Rule {
+	return func(value interface{}) (string, string, bool) {
+		s, _ := value.(string)
+		if s == "" || re.MatchString(s) {
+			return "", "", true
+		}
+		return FORMAT, "must be " + desc, false
+	}
+}
+
+var emailRe = regexp.MustCompile(`^[^@\s<>]+@[^@\s<>]+\.[^@\s<>]+$`)
+
+// Email requires string to look like email
+var Email = Match(emailRe, "valid email address")
+
+// Range limits integer value
+func Range(min, max int) Rule {
+	return func(value interface{}) (string, string, bool) {
+		n := reflect.ValueOf(value)
+		switch n.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if i := n.Int(); i < int64(min) || i > int64(max) {
+				return RANGE, fmt.Sprintf("must be between %d and %d", min, max), false
+			}
+		}
+		return "", "", true
+	}
+}
+
+// Chars restricts string to characters of regexp class (e.g. `\p{L} -`), desc explains it to user
+func Chars(class, desc string) Rule {
+	re := regexp.MustCompile(`^[` + class + `]*$`)
+	return func(value interface{}) (string, string, bool) {
+		s, _ := value.(string)
+		if re.MatchString(s) {
+			return "", "", true
+		}
+		return CHARS, "may contain " + desc + " only", false
+	}
+}
+
+// ############## helper functions ##############
+
+func isZero(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+	v := reflect.ValueOf(value)
+	return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,59 @@
+package valid
+
+import (
+	"regexp"
+	"testing"
+)
+
+type sample struct {
+	Name  string
+	Email string
+	Code  string
+	Age   int
+}
+
+var sampleFields = []Field{
+	Declare("Name", Required, Length(2, 5), Chars(`\p{L} `, "letters and spaces")),
+	Declare("Email", Required, Email),
+	Declare("Code", Match(regexp.MustCompile(`^\d+$`), "digits")),
+	Declare("Age", Range(0, 150)),
+}
+
+func TestStruct(t *testing.T) {
+	if err := Struct(&sample{Name: "Jo", Email: "a@b.com"}, sampleFields); err != nil {
+		t.Fatalf("valid object: %v", err)
+	}
+
+	err := Struct(sample{Name: "<b>", Email: "wrong", Code: "x1", Age: -1}, sampleFields)
+	errs, ok := err.(Errors)
+	if !ok {
+		t.Fatalf("expected Errors, got %v", err)
+	}
+
+	want := []FieldError{
+		{"Name", CHARS, ""},
+		{"Email", FORMAT, ""},
+		{"Code", FORMAT, ""},
+		{"Age", RANGE, ""},
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("expected %d errors, got %v", len(want), errs)
+	}
+	for i, e := range errs {
+		if e.Field != want[i].Field || e.Code != want[i].Code || e.Message == "" {
+			t.Fatalf("error %d: expected %s/%s, got %#v", i, want[i].Field, want[i].Code, e)
+		}
+	}
+}
+
+func TestStructOnly(t *testing.T) {
+	err := Struct(&sample{Email: "a@b.com"}, sampleFields, "Email")
+	if err != nil {
+		t.Fatalf("only Email is checked, got %v", err)
+	}
+
+	errs, _ := Struct(&sample{}, sampleFields).(Errors)
+	if len(errs) != 2 || errs[0].Code != REQUIRED || errs[1].Code != REQUIRED {
+		t.Fatalf("expected required errors, got %v", errs)
+	}
+}
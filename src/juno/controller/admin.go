@@ -0,0 +1,311 @@
+package controller
+
+import (
+	"golang.org/x/net/context"
+	"juno/common/check"
+	"juno/common/io"
+	"juno/common/valid"
+	"juno/middle"
+	"juno/model"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// page size of user listing, deep pages are expensive, so offset is limited too
+const (
+	ADMIN_PAGE       = 20
+	ADMIN_PAGE_MAX   = 100
+	ADMIN_OFFSET_MAX = 100000
+)
+
+// adminParams is allow-list of user listing parameters, others are rejected
+var adminParams = map[string]bool{
+	"email": true, "confirm": true, "disabled": true, "from": true, "to": true, "offset": true, "limit": true,
+}
+
+// account is the user representation for admins, secrets (password hash, tokens) aren't exposed
+type account struct {
+	ID       string
+	Email    string
+	Roles    model.Roles
+	Confirm  bool
+	Disabled bool
+	Created  time.Time
+}
+
+// ################ Admin Handlers ##################
+
+// AdminUserList shows page of users selected by query parameters:
+// confirm, disabled (true|false), from, to (RFC 3339 registration time), email (substring), offset, limit.
+// Link to the next page is sent if the page is full
+func (c Controller) AdminUserList(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	query, errs := userQuery(params)
+	if check.ValidErr(w, errs) {
+		return
+	}
+
+	users, err := c.stg.UserList(ctx, query)
+	if check.DBErr(w, err) {
+		return
+	}
+
+	accounts := make([]account, 0, len(users))
+	for _, u := range users {
+		accounts = append(accounts, account{u.ID, u.Email, u.AllRoles(), u.Confirm, u.Disabled, u.Created})
+	}
+
+	resp := map[string]interface{}{
+		"users": accounts,
+	}
+	if len(users) == query.Limit {
+		params.Set("offset", strconv.Itoa(query.Offset+query.Limit))
+		resp["next"] = c.apiurl + "/admin/user?" + params.Encode()
+	}
+	io.Output(w, resp)
+}
+
+// AdminUserConfirm confirms account without token
+func (c Controller) AdminUserConfirm(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userid, _ := middle.CtxParam(ctx, "userid")
+
+	user, err := c.stg.UserSet(ctx, userid, model.Fields{"confirm": true}, nil)
+	if c.dbErrOrEmpty(w, err, io.ERR_NOUSER) {
+		return
+	}
+
+	c.adminAudit(ctx, userid, model.AUDIT_ADMIN_CONFIRM, nil, true)
+
+	resp := map[string]string{
+		"message": "Account is confirmed",
+		"id":      user.ID,
+	}
+	io.Output(w, resp)
+}
+
+// AdminUserDisable disables account and revokes its sessions.
+// Access tokens are stateless, so already issued ones are valid until they expire
+func (c Controller) AdminUserDisable(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userid, _ := middle.CtxParam(ctx, "userid")
+
+	user, err := c.stg.UserSet(ctx, userid, model.Fields{"disabled": true}, nil)
+	if c.dbErrOrEmpty(w, err, io.ERR_NOUSER) {
+		return
+	}
+	if check.DBErr(w, c.stg.SessionDeleteByUser(ctx, userid)) {
+		return
+	}
+
+	c.adminAudit(ctx, userid, model.AUDIT_ADMIN_DISABLE, false, true)
+
+	resp := map[string]string{
+		"message": "Account is disabled",
+		"id":      user.ID,
+	}
+	io.Output(w, resp)
+}
+
+// AdminUserEnable enables disabled account
+func (c Controller) AdminUserEnable(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userid, _ := middle.CtxParam(ctx, "userid")
+
+	user, err := c.stg.UserSet(ctx, userid, model.Fields{"disabled": false}, nil)
+	if c.dbErrOrEmpty(w, err, io.ERR_NOUSER) {
+		return
+	}
+
+	c.adminAudit(ctx, userid, model.AUDIT_ADMIN_ENABLE, true, false)
+
+	resp := map[string]string{
+		"message": "Account is enabled",
+		"id":      user.ID,
+	}
+	io.Output(w, resp)
+}
+
+// AdminProfileUpdate modifies profile of any user (unconfirmed account too), storage marks the change in history as admin one
+func (c Controller) AdminProfileUpdate(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	in := &profileInput{}
+	if check.InputErr(w, r, in) {
+		return
+	}
+	profile := &in.Profile
+
+	ctx, failed := withReason(ctx, w, r, in.Reason)
+	if failed {
+		return
+	}
+	if check.ValidErr(w, profile.Validate()) {
+		return
+	}
+
+	profile.ID, _ = middle.CtxParam(ctx, "userid")
+	if c.ifMatch(w, r, profile) {
+		return
+	}
+
+	profile, err := c.stg.ProfileUpdate(ctx, profile)
+	if c.revisionErr(w, r, err) || c.dbErrOrEmpty(w, err, io.ERR_NOPROF) {
+		return
+	}
+
+	c.checkpoint(ctx, profile.ID)
+	w.Header().Set("ETag", etag(profile.Rev))
+	io.Output(w, profile)
+}
+
+// AdminUserDelete removes account with profile and history, and revokes its sessions.
+// Audit trail of the account is kept
+func (c Controller) AdminUserDelete(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userid, _ := middle.CtxParam(ctx, "userid")
+
+	user, err := c.stg.UserGet(ctx, userid)
+	if c.dbErrOrEmpty(w, err, io.ERR_NOUSER) {
+		return
+	}
+
+	err = c.stg.UserDelete(ctx, userid)
+	if c.dbErrOrEmpty(w, err, io.ERR_NOUSER) {
+		return
+	}
+	if check.DBErr(w, c.stg.SessionDeleteByUser(ctx, userid)) {
+		return
+	}
+
+	c.adminAudit(ctx, userid, model.AUDIT_ADMIN_DELETE, user.Email, nil)
+
+	resp := map[string]string{
+		"message": "Account is deleted",
+		"id":      userid,
+	}
+	io.Output(w, resp)
+}
+
+// AdminHistoryCheck verifies that replaying history of the profile reproduces the stored profile
+func (c Controller) AdminHistoryCheck(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userid, _ := middle.CtxParam(ctx, "userid")
+
+	// unconfirmed accounts are checked too
+	profile, err := c.stg.ProfileAdminGet(ctx, userid)
+	if c.dbErrOrEmpty(w, err, io.ERR_NOPROF) {
+		return
+	}
+
+	changes, err := c.fullHistory(ctx, userid, time.Time{})
+	if c.dbErrOrEmpty(w, err, io.ERR_NOPROF) {
+		return
+	}
+
+	// profile could be updated after it was read, such changes aren't checked
+	io.Output(w, model.CheckHistory(profile, upTo(changes, profile.Rev)))
+}
+
+// AdminHistoryVerify walks hash chain of profile history and reports the first broken link.
+// Signed checkpoint is verified too if history key is configured
+func (c Controller) AdminHistoryVerify(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userid, _ := middle.CtxParam(ctx, "userid")
+
+	head, checkpoint, err := c.stg.HistoryHead(ctx, userid)
+	if c.dbErrOrEmpty(w, err, io.ERR_NOPROF) {
+		return
+	}
+
+	changes, err := c.fullHistory(ctx, userid, time.Time{})
+	if c.dbErrOrEmpty(w, err, io.ERR_NOPROF) {
+		return
+	}
+
+	// profile could be updated after its head was read, such changes aren't verified
+	io.Output(w, model.VerifyChain(userid, upTo(changes, head.Rev), head, checkpoint, c.historyKey))
+}
+
+// ##################### Helper Functions ##################
+
+// userQuery builds user query from url parameters, it returns valid.Errors if some of them are invalid or unknown
+func userQuery(params url.Values) (*model.UserQuery, error) {
+	query := &model.UserQuery{
+		Email: params.Get("email"),
+		Limit: ADMIN_PAGE,
+	}
+	errs := valid.Errors{}
+
+	for name := range params {
+		if !adminParams[name] {
+			errs = append(errs, valid.FieldError{Field: name, Code: valid.UNKNOWN, Message: "unknown parameter"})
+		}
+	}
+
+	flags := []struct {
+		name string
+		val  **bool
+	}{
+		{"confirm", &query.Confirm},
+		{"disabled", &query.Disabled},
+	}
+	for _, f := range flags {
+		if v := params.Get(f.name); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				errs = append(errs, valid.FieldError{Field: f.name, Code: valid.TYPE, Message: "must be true or false"})
+				continue
+			}
+			*f.val = &b
+		}
+	}
+
+	times := []struct {
+		name string
+		val  *time.Time
+	}{
+		{"from", &query.CreatedFrom},
+		{"to", &query.CreatedTo},
+	}
+	for _, tm := range times {
+		if v := params.Get(tm.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				errs = append(errs, valid.FieldError{Field: tm.name, Code: valid.FORMAT, Message: "must be RFC 3339 time like 2006-01-02T15:04:05Z"})
+				continue
+			}
+			*tm.val = t
+		}
+	}
+
+	ints := []struct {
+		name     string
+		val      *int
+		min, max int
+	}{
+		{"offset", &query.Offset, 0, ADMIN_OFFSET_MAX},
+		{"limit", &query.Limit, 1, ADMIN_PAGE_MAX},
+	}
+	for _, i := range ints {
+		if v := params.Get(i.name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < i.min || n > i.max {
+				msg := "must be integer from " + strconv.Itoa(i.min) + " to " + strconv.Itoa(i.max)
+				errs = append(errs, valid.FieldError{Field: i.name, Code: valid.RANGE, Message: msg})
+				continue
+			}
+			*i.val = n
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return query, nil
+}
+
+// adminAudit appends record of admin action to audit trail of the user
+func (c Controller) adminAudit(ctx context.Context, userid, action string, prev, cur interface{}) {
+	c.auditRecord(ctx, &model.AuditRecord{
+		UserID:   userid,
+		Admin:    model.CtxUser(ctx).ID,
+		Action:   action,
+		Previous: prev,
+		Current:  cur,
+	})
+}
@@ -1,23 +1,62 @@
 package controller
 
 import (
+	"encoding/json"
 	"golang.org/x/net/context"
+	"io/ioutil"
 	"juno/common/check"
 	"juno/common/io"
+	"juno/common/patch"
+	"juno/common/token"
+	"juno/common/valid"
+	"juno/mailer"
 	"juno/middle"
 	"juno/model"
 	"juno/model/storage"
+	"log"
+	"mime"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// lifetime of issued tokens
+const (
+	ACCESS_TTL  = 15 * time.Minute
+	REFRESH_TTL = 30 * 24 * time.Hour
+)
+
+// PATCH_RETRIES is how many times patch is applied if profile is modified concurrently
+const PATCH_RETRIES = 3
+
+// reason of profile change is supplied by header or by "Reason" body field, it's recorded in history
+const (
+	REASON_HEADER = "X-Change-Reason"
+	REASON_MAX    = 500
+)
+
+// profileInput is body of profile update, it may carry reason of the change
+type profileInput struct {
+	model.Profile
+	Reason string
+}
+
 // Controller provides handler for each routes
-// It keeps storage object
+// It keeps storage object, token signer and mailer
 type Controller struct {
-	stg storage.Storage
+	stg    storage.Storage
+	tokens token.Signer
+	mail   mailer.Mailer
+	// apiurl is public versioned url of the api, it's used to build links in letters
+	apiurl string
+	// historyKey signs checkpoints of profile history, they aren't made if it's nil
+	historyKey []byte
 }
 
-func New(stg storage.Storage) Controller {
-	return Controller{stg}
+func New(stg storage.Storage, tokens token.Signer, mail mailer.Mailer, apiurl string, historyKey []byte) Controller {
+	return Controller{stg, tokens, mail, apiurl, historyKey}
 }
 
 // ################ User Handlers ##################
@@ -29,22 +68,37 @@ func (c Controller) UserCreate(ctx context.Context, w http.ResponseWriter, r *ht
 	}
 
 	// Validate says which field is invalid
-	if msg := user.Validate(); msg != "" {
-		io.ErrClient(w, msg)
+	if check.ValidErr(w, user.Validate()) {
+		return
+	}
+
+	// password is never stored as plain text
+	if err := user.SetPassword(user.Password); check.ServerErr(w, err) {
+		return
+	}
+
+	// account is confirmed by token sent to email only, roles are granted by admin only
+	user.Confirm = false
+	user.Roles = model.ROLE_USER
+	user.Disabled = false
+	confirmToken, err := user.NewConfirmToken()
+	if check.ServerErr(w, err) {
 		return
 	}
 
 	// we check dublicates on insert
-	user, err := c.stg.UserInsert(ctx, user)
+	user, err = c.stg.UserInsert(ctx, user)
 	if err != nil {
 		if c.stg.IsErrDup(err) {
-			io.ErrClient(w, "The email is already registered")
+			io.ErrClient(w, io.ERR_EMAIL_DUP)
 			return
 		}
 		check.DBErr(w, err)
 		return
 	}
 
+	c.sendConfirmation(user, confirmToken)
+
 	// success
 	resp := map[string]string{
 		"message": "Please, check your mailbox for confirmation letter",
@@ -53,14 +107,32 @@ func (c Controller) UserCreate(ctx context.Context, w http.ResponseWriter, r *ht
 	io.Output(w, resp)
 }
 
+// UserConfirm confirms account by token sent to email
 func (c Controller) UserConfirm(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-	userid, _ := middle.CtxParam(ctx, "userid")
+	confirmToken, _ := middle.CtxParam(ctx, "token")
+	digest := token.Digest(confirmToken)
+
+	// requester is identified by token, not by context user
+	ctx = system(ctx)
+
+	user, err := c.stg.UserSearch(ctx, storage.Eq("confirmtoken", digest))
+	if c.dbErrOrEmpty(w, err, io.ERR_CONFIRM_INVALID) {
+		return
+	}
+	if user.Confirm {
+		io.Err(w, io.ERR_CONFIRM_USED, http.StatusConflict)
+		return
+	}
+	if time.Now().After(user.ConfirmExpire) {
+		io.Err(w, io.ERR_CONFIRM_EXPIRED, http.StatusGone)
+		return
+	}
 
-	// execute getAndModify on storage
+	// execute getAndModify on storage, the filter protects from concurrent confirmation or resend
 	fields := model.Fields{"confirm": true}
-	filter := model.Fields{"confirm": false}
-	user, err := c.stg.UserSet(ctx, userid, fields, filter)
-	if c.dbErrOrEmpty(w, err, io.ERR_NOUSER) {
+	filter := storage.Eq("confirm", false).Eq("confirmtoken", digest)
+	user, err = c.stg.UserSet(ctx, user.ID, fields, filter)
+	if c.dbErrOrEmpty(w, err, io.ERR_CONFIRM_INVALID) {
 		return
 	}
 
@@ -72,19 +144,297 @@ func (c Controller) UserConfirm(ctx context.Context, w http.ResponseWriter, r *h
 	io.Output(w, resp)
 }
 
+// UserConfirmResend rotates confirmation token of unconfirmed account and sends it again.
+// Response is the same for any email, so registered emails can't be enumerated
+func (c Controller) UserConfirmResend(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	input := &model.User{}
+	if check.InputErr(w, r, input) {
+		return
+	}
+
+	resp := map[string]string{
+		"message": "If the email is registered and isn't confirmed, new confirmation letter is sent",
+	}
+
+	ctx = system(ctx)
+	user, err := c.stg.UserSearch(ctx, storage.Eq("email", input.Email).Eq("confirm", false))
+	if c.stg.IsErrNotFound(err) {
+		io.Output(w, resp)
+		return
+	}
+	if check.DBErr(w, err) {
+		return
+	}
+
+	// previous token becomes invalid
+	confirmToken, err := user.NewConfirmToken()
+	if check.ServerErr(w, err) {
+		return
+	}
+	fields := model.Fields{"confirmtoken": user.ConfirmToken, "confirmexpire": user.ConfirmExpire}
+	user, err = c.stg.UserSet(ctx, user.ID, fields, storage.Eq("confirm", false))
+	if c.stg.IsErrNotFound(err) {
+		io.Output(w, resp)
+		return
+	}
+	if check.DBErr(w, err) {
+		return
+	}
+
+	c.sendConfirmation(user, confirmToken)
+	io.Output(w, resp)
+}
+
+// ################ Password Handlers ##################
+
+// passwordInput is the body of password endpoints
+type passwordInput struct {
+	Email       string
+	Token       string
+	OldPassword string
+	Password    string
+}
+
+// PasswordForgot sends password reset token to email.
+// Response is the same for any email, so registered emails can't be enumerated
+func (c Controller) PasswordForgot(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	input := &passwordInput{}
+	if check.InputErr(w, r, input) {
+		return
+	}
+
+	resp := map[string]string{
+		"message": "If the email is registered, password reset letter is sent",
+	}
+
+	ctx = system(ctx)
+	user, err := c.stg.UserSearch(ctx, storage.Eq("email", input.Email))
+	if c.stg.IsErrNotFound(err) {
+		io.Output(w, resp)
+		return
+	}
+	if check.DBErr(w, err) {
+		return
+	}
+
+	// previous reset token becomes invalid
+	resetToken, err := user.NewResetToken()
+	if check.ServerErr(w, err) {
+		return
+	}
+	fields := model.Fields{"resettoken": user.ResetToken, "resetexpire": user.ResetExpire}
+	if _, err = c.stg.UserSet(ctx, user.ID, fields, nil); check.DBErr(w, err) {
+		return
+	}
+
+	c.send(mailer.PasswordReset, mailer.Letter{Email: user.Email, Token: resetToken})
+	io.Output(w, resp)
+}
+
+// PasswordReset sets new password by reset token and revokes all sessions
+func (c Controller) PasswordReset(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	input := &passwordInput{}
+	if check.InputErr(w, r, input) {
+		return
+	}
+	if check.ValidErr(w, (&model.User{Password: input.Password}).Validate("Password")) {
+		return
+	}
+
+	// requester is identified by token, not by context user
+	ctx = system(ctx)
+	digest := token.Digest(input.Token)
+	user, err := c.stg.UserSearch(ctx, storage.Eq("resettoken", digest))
+	if c.dbErrOrEmpty(w, err, io.ERR_RESET_INVALID) {
+		return
+	}
+	if time.Now().After(user.ResetExpire) {
+		io.Err(w, io.ERR_RESET_EXPIRED, http.StatusGone)
+		return
+	}
+
+	// the filter makes the token single-use even for concurrent requests
+	filter := storage.Eq("resettoken", digest)
+	if c.setPassword(ctx, w, user, input.Password, filter, io.ERR_RESET_INVALID) {
+		return
+	}
+
+	resp := map[string]string{
+		"message": "Password is changed, please login again",
+	}
+	io.Output(w, resp)
+}
+
+// PasswordChange sets new password of context user, the old one is required.
+// All sessions are revoked, so user has to login again
+func (c Controller) PasswordChange(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	input := &passwordInput{}
+	if check.InputErr(w, r, input) {
+		return
+	}
+	if check.ValidErr(w, (&model.User{Password: input.Password}).Validate("Password")) {
+		return
+	}
+
+	// context user may keep only ID (bearer auth), so fetch the whole object
+	user, err := c.stg.UserGet(ctx, model.CtxUser(ctx).ID)
+	if c.dbErrOrEmpty(w, err, io.ERR_NOUSER) {
+		return
+	}
+
+	if ok, _ := user.CheckPassword(input.OldPassword); !ok {
+		io.Err(w, io.ERR_FORBIDDEN, http.StatusForbidden)
+		return
+	}
+
+	// password is checked by loaded user, stored hashes aren't queried
+	if c.setPassword(ctx, w, user, input.Password, nil, io.ERR_NOUSER) {
+		return
+	}
+
+	resp := map[string]string{
+		"message": "Password is changed, please login again",
+	}
+	io.Output(w, resp)
+}
+
+// ################ Email Handlers ##################
+
+// EmailChange requests login change of context user.
+// The old email stays active until the new one is confirmed by token sent to it
+func (c Controller) EmailChange(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	input := &model.User{}
+	if check.InputErr(w, r, input) {
+		return
+	}
+	if check.ValidErr(w, input.Validate("Email")) {
+		return
+	}
+
+	user, err := c.stg.UserGet(ctx, model.CtxUser(ctx).ID)
+	if c.dbErrOrEmpty(w, err, io.ERR_NOUSER) {
+		return
+	}
+	if input.Email == user.Email {
+		io.ErrClient(w, "the email is already used as login")
+		return
+	}
+
+	// early check, unique index is checked again on confirmation.
+	// Foreign accounts aren't accessible by user, so the check is done on behalf of system
+	_, err = c.stg.UserSearch(system(ctx), storage.Eq("email", input.Email))
+	if err == nil {
+		io.Err(w, io.ERR_EMAIL_DUP, http.StatusConflict)
+		return
+	}
+	if !c.stg.IsErrNotFound(err) && check.DBErr(w, err) {
+		return
+	}
+
+	// previous request becomes invalid
+	emailToken, err := user.NewEmailToken()
+	if check.ServerErr(w, err) {
+		return
+	}
+	fields := model.Fields{"newemail": input.Email, "emailtoken": user.EmailToken, "emailexpire": user.EmailExpire}
+	if _, err = c.stg.UserSet(ctx, user.ID, fields, nil); c.dbErrOrEmpty(w, err, io.ERR_NOUSER) {
+		return
+	}
+
+	c.audit(ctx, user.ID, model.AUDIT_EMAIL_REQUEST, user.Email, input.Email)
+
+	c.send(mailer.EmailConfirmation, mailer.Letter{
+		Email: input.Email,
+		Link:  c.apiurl + "/user/email/confirm/" + emailToken,
+	})
+	c.send(mailer.Change, mailer.Letter{
+		Email: user.Email,
+		What:  "Change of your login email to " + input.Email + " has been requested.",
+	})
+
+	resp := map[string]string{
+		"message": "Please, check new mailbox for confirmation letter",
+	}
+	io.Output(w, resp)
+}
+
+// EmailConfirm replaces login by requested email
+func (c Controller) EmailConfirm(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	emailToken, _ := middle.CtxParam(ctx, "token")
+	digest := token.Digest(emailToken)
+
+	// requester is identified by token, not by context user
+	ctx = system(ctx)
+
+	user, err := c.stg.UserSearch(ctx, storage.Eq("emailtoken", digest))
+	if c.dbErrOrEmpty(w, err, io.ERR_EMAIL_INVALID) {
+		return
+	}
+	if time.Now().After(user.EmailExpire) {
+		io.Err(w, io.ERR_EMAIL_EXPIRED, http.StatusGone)
+		return
+	}
+
+	// the filter makes the token single-use, unique index on email protects from duplicates
+	prev := user.Email
+	fields := model.Fields{"email": user.NewEmail, "newemail": "", "emailtoken": ""}
+	user, err = c.stg.UserSet(ctx, user.ID, fields, storage.Eq("emailtoken", digest))
+	if c.stg.IsErrDup(err) {
+		io.Err(w, io.ERR_EMAIL_DUP, http.StatusConflict)
+		return
+	}
+	if c.dbErrOrEmpty(w, err, io.ERR_EMAIL_INVALID) {
+		return
+	}
+
+	c.audit(ctx, user.ID, model.AUDIT_EMAIL_CHANGE, prev, user.Email)
+	c.send(mailer.Change, mailer.Letter{
+		Email: prev,
+		What:  "Your login email has been changed to " + user.Email + ".",
+	})
+
+	resp := map[string]string{
+		"message": "Email is changed",
+		"email":   user.Email,
+	}
+	io.Output(w, resp)
+}
+
+// UserAudit shows audit trail of context user
+func (c Controller) UserAudit(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	user := model.CtxUser(ctx)
+
+	recs, err := c.stg.AuditGet(ctx, user.ID)
+	if c.dbErrOrEmpty(w, err, io.ERR_NOUSER) {
+		return
+	}
+
+	io.Output(w, recs)
+}
+
 // ################ Profile Handlers ##################
 
 // ProfileUpdate Handler allows to modify own user profile.
 func (c Controller) ProfileUpdate(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	// read profile from input
-	profile := &model.Profile{}
-	if check.InputErr(w, r, profile) {
+	in := &profileInput{}
+	if check.InputErr(w, r, in) {
+		return
+	}
+	profile := &in.Profile
+
+	ctx, failed := withReason(ctx, w, r, in.Reason)
+	if failed {
 		return
 	}
 
 	// Validate says which field is invalid
-	if msg := profile.Validate(); msg != "" {
-		io.ErrClient(w, msg)
+	if check.ValidErr(w, profile.Validate()) {
+		return
+	}
+
+	// update is conditional if client sends revision it has seen
+	if c.ifMatch(w, r, profile) {
 		return
 	}
 
@@ -95,47 +445,449 @@ func (c Controller) ProfileUpdate(ctx context.Context, w http.ResponseWriter, r
 	// txn.HistoryUpdate(history)
 	// txn.Execute()
 	profile, err := c.stg.ProfileUpdate(ctx, profile)
-	if c.dbErrOrEmpty(w, err, io.ERR_NOPROF) {
+	if c.revisionErr(w, r, err) || c.dbErrOrEmpty(w, err, io.ERR_NOPROF) {
 		return
 	}
 
+	c.checkpoint(ctx, profile.ID)
+	w.Header().Set("ETag", etag(profile.Rev))
 	io.Output(w, profile)
 }
 
-// ProfileUpdate Handler allows to view just own profile history.
-func (c Controller) ProfileHistory(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-	profid, _ := middle.CtxParam(ctx, "profid")
+// ProfilePatch modifies only fields of own profile supplied by merge patch (RFC 7396) or by JSON Patch (RFC 6902).
+// Patch is applied to the fetched revision and the update is atomic against it,
+// so concurrent modification of untouched fields isn't lost
+func (c Controller) ProfilePatch(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	var apply func(map[string]interface{}, []byte) error
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch ct {
+	case patch.MERGE_PATCH, "application/json":
+		apply = patch.Merge
+	case patch.JSON_PATCH:
+		apply = patch.Apply
+	default:
+		io.Err(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+		return
+	}
 
-	changes, err := c.stg.HistoryGet(ctx, profid)
-	if c.dbErrOrEmpty(w, err, io.ERR_NOPROF) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		io.ErrClient(w, io.ERR_REQ)
+		return
+	}
+
+	expected := &model.Profile{}
+	if c.ifMatch(w, r, expected) {
+		return
+	}
+
+	ctx, failed := withReason(ctx, w, r, "")
+	if failed {
 		return
 	}
 
-	io.Output(w, changes)
+	profid := model.CtxUser(ctx).ID
+	for attempt := 1; ; attempt++ {
+		base, err := c.stg.ProfileGet(ctx, profid)
+		if c.dbErrOrEmpty(w, err, io.ERR_NOPROF) {
+			return
+		}
+		if expected.Rev != 0 && expected.Rev != base.Rev {
+			io.Err(w, io.ERR_PRECONDITION, http.StatusPreconditionFailed)
+			return
+		}
+
+		profile, err := patchProfile(base, data, apply)
+		if c.patchErr(w, err) {
+			return
+		}
+		if check.ValidErr(w, profile.Validate()) {
+			return
+		}
+
+		profile, err = c.stg.ProfileUpdate(ctx, profile)
+		if c.stg.IsErrConflict(err) && expected.Rev == 0 && attempt < PATCH_RETRIES {
+			// profile has been modified concurrently, apply patch to the new revision
+			continue
+		}
+		if c.revisionErr(w, r, err) || c.dbErrOrEmpty(w, err, io.ERR_NOPROF) {
+			return
+		}
+
+		c.checkpoint(ctx, profile.ID)
+		w.Header().Set("ETag", etag(profile.Rev))
+		io.Output(w, profile)
+		return
+	}
 }
 
+// ProfileGet shows current profile, or the profile as it was at time of asOf parameter (owner and admins only)
 func (c Controller) ProfileGet(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	profid, _ := middle.CtxParam(ctx, "profid")
 
+	if _, ok := r.URL.Query()["asOf"]; ok {
+		c.profileAsOf(ctx, w, r, profid)
+		return
+	}
+
 	profile, err := c.stg.ProfileGet(ctx, profid)
 	if c.dbErrOrEmpty(w, err, io.ERR_NOPROF) {
 		return
 	}
 
+	w.Header().Set("ETag", etag(profile.Rev))
 	io.Output(w, profile)
 }
 
-func (c Controller) ProfileAll(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-	profiles, err := c.stg.ProfileSearch(ctx, nil)
+// ################ Session Handlers ##################
+
+// SessionCreate exchanges credentials for access and refresh tokens
+func (c Controller) SessionCreate(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	creds := &model.User{}
+	if check.InputErr(w, r, creds) {
+		return
+	}
+
+	user, err := middle.Credentials(ctx, c.stg, creds.Email, creds.Password)
+	if err == middle.ErrCredentials {
+		io.Err(w, io.ERR_FORBIDDEN, http.StatusForbidden)
+		return
+	}
+	if err == middle.ErrDisabled {
+		io.Err(w, io.ERR_DISABLED, http.StatusForbidden)
+		return
+	}
+	if check.DBErr(w, err) {
+		return
+	}
+
+	refresh, err := token.Random()
+	if check.ServerErr(w, err) {
+		return
+	}
+
+	// from now on request is done on behalf of authenticated user
+	ctx = model.SetCtxUser(ctx, user)
+	session := &model.Session{
+		UserID:  user.ID,
+		Refresh: token.Digest(refresh),
+		Expire:  time.Now().Add(REFRESH_TTL),
+	}
+	session, err = c.stg.SessionInsert(ctx, session)
+	if check.DBErr(w, err) {
+		return
+	}
+
+	c.outputTokens(w, session, user, refresh)
+}
+
+// SessionRefresh exchanges refresh token for new pair of tokens.
+// Refresh token is rotated, so each of them is used only once
+func (c Controller) SessionRefresh(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	input := map[string]string{}
+	if check.InputErr(w, r, &input) {
+		return
+	}
+
+	// requester is identified by refresh token, not by context user
+	ctx = system(ctx)
+	prev := token.Digest(input["refresh_token"])
+	session, err := c.stg.SessionByRefresh(ctx, prev)
+	if c.stg.IsErrNotFound(err) {
+		io.Err(w, io.ERR_UNAUTHORIZED, http.StatusUnauthorized)
+		return
+	}
 	if check.DBErr(w, err) {
 		return
 	}
 
-	io.Output(w, profiles)
+	// roles may be changed since session is created, so they are fetched again
+	user, err := c.stg.UserGet(ctx, session.UserID)
+	if c.stg.IsErrNotFound(err) {
+		io.Err(w, io.ERR_UNAUTHORIZED, http.StatusUnauthorized)
+		return
+	}
+	if check.DBErr(w, err) {
+		return
+	}
+	if user.Disabled {
+		io.Err(w, io.ERR_DISABLED, http.StatusForbidden)
+		return
+	}
+
+	refresh, err := token.Random()
+	if check.ServerErr(w, err) {
+		return
+	}
+
+	// the filter guarantees that concurrent refresh with the same token fails
+	fields := model.Fields{"refresh": token.Digest(refresh), "expire": time.Now().Add(REFRESH_TTL)}
+	filter := storage.Eq("refresh", prev)
+	session, err = c.stg.SessionSet(ctx, session.ID, fields, filter)
+	if c.stg.IsErrNotFound(err) {
+		io.Err(w, io.ERR_UNAUTHORIZED, http.StatusUnauthorized)
+		return
+	}
+	if check.DBErr(w, err) {
+		return
+	}
+
+	c.outputTokens(w, session, user, refresh)
+}
+
+// SessionDelete revokes session of current access token.
+// Access tokens are stateless, so already issued one is valid until it expires
+func (c Controller) SessionDelete(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	auth := model.CtxAuth(ctx)
+	if auth.Method != model.AUTH_BEARER {
+		io.ErrClient(w, "Session can be revoked by access token only")
+		return
+	}
+
+	err := c.stg.SessionDelete(ctx, auth.SessionID)
+	if c.dbErrOrEmpty(w, err, io.ERR_NOSESSION) {
+		return
+	}
+
+	resp := map[string]string{
+		"message": "Session is revoked",
+	}
+	io.Output(w, resp)
 }
 
 // ##################### Helper Functions ##################
 
+// sendConfirmation delivers confirmation link to user
+func (c Controller) sendConfirmation(user *model.User, confirmToken string) {
+	c.send(mailer.Confirmation, mailer.Letter{
+		Email: user.Email,
+		Link:  c.apiurl + "/user/confirm/" + confirmToken,
+	})
+}
+
+// setPassword hashes and stores new password, clears reset token, revokes sessions and notifies user.
+// It returns true if error has been sent to client
+func (c Controller) setPassword(ctx context.Context, w http.ResponseWriter, user *model.User, pass string, filter *storage.Query, notFound string) bool {
+	if err := user.SetPassword(pass); check.ServerErr(w, err) {
+		return true
+	}
+
+	fields := model.Fields{"password": user.Password, "resettoken": ""}
+	_, err := c.stg.UserSet(ctx, user.ID, fields, filter)
+	if c.dbErrOrEmpty(w, err, notFound) {
+		return true
+	}
+
+	// refresh tokens are revoked, access tokens are stateless and live until expiration (ACCESS_TTL)
+	if check.DBErr(w, c.stg.SessionDeleteByUser(ctx, user.ID)) {
+		return true
+	}
+
+	c.send(mailer.Change, mailer.Letter{Email: user.Email, What: "Your password has been changed."})
+	return false
+}
+
+// audit appends record to audit trail of the user
+func (c Controller) audit(ctx context.Context, userid, action string, prev, cur interface{}) {
+	c.auditRecord(ctx, &model.AuditRecord{
+		UserID:   userid,
+		Action:   action,
+		Previous: prev,
+		Current:  cur,
+	})
+}
+
+// auditRecord timestamps record and appends it to audit trail.
+// The change has been already applied, so failure is logged only
+func (c Controller) auditRecord(ctx context.Context, rec *model.AuditRecord) {
+	rec.Time = time.Now()
+	if _, err := c.stg.AuditInsert(ctx, rec); err != nil {
+		log.Printf("can't write audit record %#v: %v", rec, err)
+	}
+}
+
+// checkpoint signs head of profile history and stores it, so removed tail of history is detected.
+// The change has been already applied, so failure is logged only
+func (c Controller) checkpoint(ctx context.Context, profid string) {
+	if c.historyKey == nil {
+		return
+	}
+
+	head, _, err := c.stg.HistoryHead(ctx, profid)
+	if err == nil && head.Hash != "" {
+		head.Time = time.Now()
+		head.Sign(profid, c.historyKey)
+		err = c.stg.HistoryCheckpoint(ctx, profid, head)
+	}
+	if err != nil {
+		log.Printf("can't make checkpoint of profile %s history: %v", profid, err)
+	}
+}
+
+// send builds letter and passes it to mailer.
+// Mailer is expected to be asynchronous, so failure means letter is lost. It's logged and isn't reported to client
+func (c Controller) send(build func(mailer.Letter) (mailer.Message, error), data mailer.Letter) {
+	msg, err := build(data)
+	if err == nil {
+		err = c.mail.Send(msg)
+	}
+	if err != nil {
+		log.Printf("can't send letter to %s: %v", data.Email, err)
+	}
+}
+
+// outputTokens signs access token for session of the user and sends it together with refresh token
+func (c Controller) outputTokens(w http.ResponseWriter, session *model.Session, user *model.User, refresh string) {
+	claims := token.Claims{
+		UserID:    session.UserID,
+		SessionID: session.ID,
+		Roles:     int64(user.Roles),
+		Expire:    time.Now().Add(ACCESS_TTL).Unix(),
+	}
+	access, err := c.tokens.Sign(claims)
+	if check.ServerErr(w, err) {
+		return
+	}
+
+	resp := map[string]interface{}{
+		"access_token":  access,
+		"token_type":    "Bearer",
+		"expires_in":    int(ACCESS_TTL.Seconds()),
+		"refresh_token": refresh,
+	}
+	io.Output(w, resp)
+}
+
+// system puts system user to context, so BL acts on behalf of itself (e.g. when requester is identified by token)
+func system(ctx context.Context) context.Context {
+	return model.SetCtxUser(ctx, model.System())
+}
+
+// patchProfile applies patch to copy of profile. Only existing fields except ID can be patched,
+// removed field gets zero value
+func patchProfile(base *model.Profile, data []byte, apply func(map[string]interface{}, []byte) error) (*model.Profile, error) {
+	raw, err := json.Marshal(base)
+	if err != nil {
+		return nil, err
+	}
+	doc := map[string]interface{}{}
+	if err = json.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	orig := map[string]interface{}{}
+	for k, v := range doc {
+		orig[k] = v
+	}
+
+	if err = apply(doc, data); err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(doc))
+	for k := range doc {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	errs := valid.Errors{}
+	for _, k := range keys {
+		prev, known := orig[k]
+		switch {
+		case !known:
+			errs = append(errs, valid.FieldError{Field: k, Code: valid.UNKNOWN, Message: "isn't profile field"})
+		case k == "ID" && doc[k] != prev:
+			errs = append(errs, valid.FieldError{Field: k, Code: valid.READONLY, Message: "can't be modified"})
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	if raw, err = json.Marshal(doc); err != nil {
+		return nil, err
+	}
+	profile := &model.Profile{}
+	if err = io.Unmarshal(raw, profile); err != nil {
+		return nil, err
+	}
+
+	profile.ID = base.ID
+	profile.Rev = base.Rev
+	return profile, nil
+}
+
+// patchErr responds to patch errors. It returns true if error has been sent to client
+func (c Controller) patchErr(w http.ResponseWriter, err error) bool {
+	switch err {
+	case nil:
+		return false
+	case patch.ErrMalformed:
+		io.ErrClient(w, err.Error())
+	case patch.ErrTest:
+		io.Err(w, err.Error(), http.StatusConflict)
+	default:
+		if !check.ValidErr(w, err) {
+			check.ServerErr(w, err)
+		}
+	}
+	return true
+}
+
+// etag represents profile revision as strong entity tag
+func etag(rev int64) string {
+	return `"` + strconv.FormatInt(rev, 10) + `"`
+}
+
+// ifMatch sets expected revision of profile by If-Match header, "*" or missing header means any revision.
+// It returns true if error has been sent to client (header doesn't contain revision tag)
+func (c Controller) ifMatch(w http.ResponseWriter, r *http.Request, profile *model.Profile) bool {
+	profile.Rev = 0
+
+	tag := strings.TrimSpace(r.Header.Get("If-Match"))
+	if tag == "" || tag == "*" {
+		return false
+	}
+
+	rev, err := strconv.ParseInt(strings.Trim(tag, `"`), 10, 64)
+	if err != nil || rev <= 0 {
+		io.Err(w, io.ERR_PRECONDITION, http.StatusPreconditionFailed)
+		return true
+	}
+	profile.Rev = rev
+	return false
+}
+
+// withReason puts reason of the change (body one or header) to request origin in context.
+// It returns true if error has been sent to client (reason is too long)
+func withReason(ctx context.Context, w http.ResponseWriter, r *http.Request, reason string) (context.Context, bool) {
+	if reason == "" {
+		reason = r.Header.Get(REASON_HEADER)
+	}
+	if len(reason) > REASON_MAX {
+		msg := "must be at most " + strconv.Itoa(REASON_MAX) + " bytes"
+		check.ValidErr(w, valid.Errors{valid.FieldError{Field: "Reason", Code: valid.LENGTH, Message: msg}})
+		return ctx, true
+	}
+
+	origin := model.CtxOrigin(ctx)
+	origin.Reason = reason
+	return model.SetCtxOrigin(ctx, origin), false
+}
+
+// revisionErr responds to revision conflict: 412 if client has sent revision, 409 otherwise.
+// It returns true if error has been sent to client
+func (c Controller) revisionErr(w http.ResponseWriter, r *http.Request, err error) bool {
+	if !c.stg.IsErrConflict(err) {
+		return false
+	}
+	if r.Header.Get("If-Match") != "" {
+		io.Err(w, io.ERR_PRECONDITION, http.StatusPreconditionFailed)
+		return true
+	}
+	io.Err(w, io.ERR_CONFLICT, http.StatusConflict)
+	return true
+}
+
 func (c Controller) dbErrOrEmpty(w http.ResponseWriter, err error, msg string) bool {
 	if c.stg.IsErrNotFound(err) {
 		io.Err(w, msg, http.StatusNotFound)
@@ -0,0 +1,411 @@
+package controller
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"golang.org/x/net/context"
+	"juno/common/check"
+	"juno/common/io"
+	"juno/common/valid"
+	"juno/middle"
+	"juno/model"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// page size of profile history
+const (
+	HISTORY_PAGE     = 100
+	HISTORY_PAGE_MAX = 1000
+)
+
+// historyFields maps field parameter values to profile fields, they are taken from model as paths of changes are
+var historyFields = lowerNames(model.ProfileFields())
+
+// historyFieldList is listed in error of field parameter
+var historyFieldList = strings.ToLower(strings.Join(model.ProfileFields(), ", "))
+
+// historyParams is allow-list of history parameters, others are rejected
+var historyParams = map[string]bool{
+	"since": true, "until": true, "field": true, "actor": true, "auth": true, "ip": true, "request": true,
+	"order": true, "limit": true, "cursor": true,
+}
+
+// historyAuth lists authentication methods history is filtered by
+var historyAuth = map[string]bool{
+	model.AUTH_NONE: true, model.AUTH_BASIC: true, model.AUTH_BEARER: true,
+}
+
+// ################ History Handlers ##################
+
+// ProfileHistory shows page of profile history to the owner (or those permitted to write the profile).
+// Parameters: since, until (RFC 3339 change time), field (comma separated profile fields, case insensitive),
+// actor (ID of user who made changes), order (asc by default or desc), limit, cursor.
+// Link header to the next page is sent if the page is full
+func (c Controller) ProfileHistory(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	profid, _ := middle.CtxParam(ctx, "profid")
+
+	params := r.URL.Query()
+	query, errs := historyQuery(params, profid)
+	if check.ValidErr(w, errs) {
+		return
+	}
+
+	changes, err := c.stg.HistoryGet(ctx, profid, query)
+	if c.dbErrOrEmpty(w, err, io.ERR_NOPROF) {
+		return
+	}
+
+	if len(changes) == query.Limit {
+		last := changes[len(changes)-1].Rev
+		params.Set("cursor", encodeCursor(&cursor{params.Get("order"), []interface{}{last}, profid}))
+		w.Header().Set("Link", "<"+c.apiurl+"/profile/"+profid+"/history?"+params.Encode()+`>; rel="next"`)
+	}
+	io.Output(w, changes)
+}
+
+// profileAsOf shows profile as it was at asOf time, it's rebuilt by replaying history up to that time.
+// History is permitted to the owner and admins only, others get not found error, as well as time before the first change
+func (c Controller) profileAsOf(ctx context.Context, w http.ResponseWriter, r *http.Request, profid string) {
+	asOf, err := time.Parse(time.RFC3339Nano, r.URL.Query().Get("asOf"))
+	if err != nil {
+		check.ValidErr(w, valid.Errors{valid.FieldError{Field: "asOf", Code: valid.FORMAT, Message: "must be RFC 3339 time"}})
+		return
+	}
+
+	changes, err := c.fullHistory(ctx, profid, asOf)
+	if c.dbErrOrEmpty(w, err, io.ERR_NOPROF) {
+		return
+	}
+	// profile didn't exist yet
+	if len(changes) == 0 {
+		io.Err(w, io.ERR_NOPROF, http.StatusNotFound)
+		return
+	}
+
+	profile, err := model.Replay(profid, changes)
+	if check.ServerErr(w, err) {
+		return
+	}
+
+	// past revision can't be modified, so ETag isn't sent
+	io.Output(w, profile)
+}
+
+// revert is the body of revert request, profile is reverted either to revision or to the state at time
+type revert struct {
+	Rev    int64
+	Time   time.Time
+	Reason string
+}
+
+// ProfileRevert reverts own profile to earlier revision, it's rebuilt by replaying history and saved as new update,
+// so the revert appears in history too. The update is atomic against the revision it was rebuilt from:
+// 412 is returned if If-Match header doesn't match it, 409 if profile has been modified concurrently
+func (c Controller) ProfileRevert(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	profid, _ := middle.CtxParam(ctx, "profid")
+	if profid != model.CtxUser(ctx).ID {
+		io.Err(w, io.ERR_NOPROF, http.StatusNotFound)
+		return
+	}
+
+	req := &revert{}
+	if check.InputErr(w, r, req) {
+		return
+	}
+
+	ctx, failed := withReason(ctx, w, r, req.Reason)
+	if failed {
+		return
+	}
+
+	expected := &model.Profile{}
+	if c.ifMatch(w, r, expected) {
+		return
+	}
+
+	current, err := c.stg.ProfileGet(ctx, profid)
+	if c.dbErrOrEmpty(w, err, io.ERR_NOPROF) {
+		return
+	}
+	if expected.Rev != 0 && expected.Rev != current.Rev {
+		io.Err(w, io.ERR_PRECONDITION, http.StatusPreconditionFailed)
+		return
+	}
+
+	switch {
+	case (req.Rev == 0) == req.Time.IsZero():
+		check.ValidErr(w, valid.Errors{valid.FieldError{Field: "Rev", Code: valid.REQUIRED, Message: "either Rev or Time is required"}})
+		return
+	case req.Rev < 0 || req.Rev >= current.Rev:
+		msg := "must be revision from 1 to " + strconv.FormatInt(current.Rev-1, 10)
+		check.ValidErr(w, valid.Errors{valid.FieldError{Field: "Rev", Code: valid.RANGE, Message: msg}})
+		return
+	}
+
+	changes, err := c.fullHistory(ctx, profid, req.Time)
+	if c.dbErrOrEmpty(w, err, io.ERR_NOPROF) {
+		return
+	}
+	changes = upTo(changes, current.Rev)
+	if req.Rev != 0 {
+		changes = upTo(changes, req.Rev)
+	}
+
+	profile, err := model.Replay(profid, changes)
+	if check.ServerErr(w, err) {
+		return
+	}
+	if profile.Rev == current.Rev {
+		check.ValidErr(w, valid.Errors{valid.FieldError{Field: "Time", Code: valid.RANGE, Message: "profile hasn't been modified since"}})
+		return
+	}
+
+	// values valid in the past might not satisfy current rules
+	if check.ValidErr(w, profile.Validate()) {
+		return
+	}
+
+	profile.Rev = current.Rev
+	profile, err = c.stg.ProfileUpdate(ctx, profile)
+	if c.revisionErr(w, r, err) || c.dbErrOrEmpty(w, err, io.ERR_NOPROF) {
+		return
+	}
+
+	c.checkpoint(ctx, profile.ID)
+	w.Header().Set("ETag", etag(profile.Rev))
+	io.Output(w, profile)
+}
+
+// diff is net difference between two revisions of profile, fields that have been changed back aren't listed
+type diff struct {
+	From   int64
+	To     int64
+	Fields map[string]model.ChangedField
+}
+
+// ProfileDiff shows net difference between revisions of profile, parameters: from (required), to (current by default).
+// Previous values belong to "from" revision, current ones to "to" revision, so reverse order is allowed
+func (c Controller) ProfileDiff(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	profid, _ := middle.CtxParam(ctx, "profid")
+
+	changes, err := c.fullHistory(ctx, profid, time.Time{})
+	if c.dbErrOrEmpty(w, err, io.ERR_NOPROF) {
+		return
+	}
+
+	current := int64(1)
+	if len(changes) > 0 {
+		current = changes[len(changes)-1].Rev
+	}
+	res, errs := diffQuery(r.URL.Query(), current)
+	if check.ValidErr(w, errs) {
+		return
+	}
+
+	from, err := model.Replay(profid, upTo(changes, res.From))
+	if check.ServerErr(w, err) {
+		return
+	}
+	to, err := model.Replay(profid, upTo(changes, res.To))
+	if check.ServerErr(w, err) {
+		return
+	}
+
+	res.Fields = from.Substract(to).Fields
+	io.Output(w, res)
+}
+
+// ##################### Helper Functions ##################
+
+// diffQuery reads revisions of diff from url parameters, they are checked against current revision.
+// It returns valid.Errors if some of parameters are invalid
+func diffQuery(params url.Values, current int64) (*diff, error) {
+	res := &diff{To: current}
+	errs := valid.Errors{}
+
+	for name := range params {
+		if name != "from" && name != "to" {
+			errs = append(errs, valid.FieldError{Field: name, Code: valid.UNKNOWN, Message: "unknown parameter"})
+		}
+	}
+	if params.Get("from") == "" {
+		errs = append(errs, valid.FieldError{Field: "from", Code: valid.REQUIRED, Message: "is required"})
+	}
+
+	revs := []struct {
+		name string
+		val  *int64
+	}{
+		{"from", &res.From},
+		{"to", &res.To},
+	}
+	for _, rev := range revs {
+		if v := params.Get(rev.name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 1 || n > current {
+				msg := "must be revision from 1 to " + strconv.FormatInt(current, 10)
+				errs = append(errs, valid.FieldError{Field: rev.name, Code: valid.RANGE, Message: msg})
+				continue
+			}
+			*rev.val = n
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return res, nil
+}
+
+// upTo cuts changes (ordered by revision) made after rev
+func upTo(changes []*model.Change, rev int64) []*model.Change {
+	for i, change := range changes {
+		if change.Rev > rev {
+			return changes[:i]
+		}
+	}
+	return changes
+}
+
+// fullHistory reads changes of profile page by page in revision order, it stops at the first change made after until.
+// Zero until reads the whole history
+func (c Controller) fullHistory(ctx context.Context, profid string, until time.Time) ([]*model.Change, error) {
+	query := &model.HistoryQuery{Limit: HISTORY_PAGE_MAX}
+	if !until.IsZero() {
+		// storage may keep time with millisecond precision, the rest is checked here
+		query.Until = until.Add(time.Millisecond)
+	}
+
+	changes := []*model.Change{}
+	for {
+		page, err := c.stg.HistoryGet(ctx, profid, query)
+		if err != nil {
+			return nil, err
+		}
+		for _, change := range page {
+			if !until.IsZero() && change.Time.After(until) {
+				return changes, nil
+			}
+			changes = append(changes, change)
+		}
+		if len(page) < query.Limit {
+			return changes, nil
+		}
+		query.After = page[len(page)-1].Rev
+	}
+}
+
+// historyQuery builds history query from url parameters, it returns valid.Errors if some of them are invalid
+func historyQuery(params url.Values, profid string) (*model.HistoryQuery, error) {
+	query := &model.HistoryQuery{
+		Actor:     params.Get("actor"),
+		Auth:      params.Get("auth"),
+		IP:        params.Get("ip"),
+		RequestID: params.Get("request"),
+		Limit:     HISTORY_PAGE,
+	}
+	errs := valid.Errors{}
+
+	for name := range params {
+		if !historyParams[name] {
+			errs = append(errs, valid.FieldError{Field: name, Code: valid.UNKNOWN, Message: "unknown parameter"})
+		}
+	}
+
+	times := []struct {
+		name string
+		val  *time.Time
+	}{
+		{"since", &query.Since},
+		{"until", &query.Until},
+	}
+	for _, t := range times {
+		if v := params.Get(t.name); v != "" {
+			tm, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				errs = append(errs, valid.FieldError{Field: t.name, Code: valid.FORMAT, Message: "must be RFC 3339 time"})
+				continue
+			}
+			*t.val = tm
+		}
+	}
+
+	for _, name := range strings.Split(params.Get("field"), ",") {
+		if name == "" {
+			continue
+		}
+		field := historyFields[strings.ToLower(name)]
+		if field == "" {
+			errs = append(errs, valid.FieldError{Field: "field", Code: valid.FORMAT, Message: "must be list of " + historyFieldList})
+			break
+		}
+		query.Fields = append(query.Fields, field)
+	}
+
+	if query.Auth != "" && !historyAuth[query.Auth] {
+		errs = append(errs, valid.FieldError{Field: "auth", Code: valid.FORMAT, Message: "must be none, basic or bearer"})
+	}
+
+	switch order := params.Get("order"); order {
+	case "", "asc":
+	case "desc":
+		query.Desc = true
+	default:
+		errs = append(errs, valid.FieldError{Field: "order", Code: valid.FORMAT, Message: "must be asc or desc"})
+	}
+
+	if v := params.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > HISTORY_PAGE_MAX {
+			msg := "must be integer from 1 to " + strconv.Itoa(HISTORY_PAGE_MAX)
+			errs = append(errs, valid.FieldError{Field: "limit", Code: valid.RANGE, Message: msg})
+		} else {
+			query.Limit = n
+		}
+	}
+
+	if v := params.Get("cursor"); v != "" {
+		after, ok := decodeHistoryCursor(v, params.Get("order"), profid)
+		if !ok {
+			errs = append(errs, valid.FieldError{Field: "cursor", Code: valid.FORMAT, Message: "must be cursor of the next link with the same order"})
+		}
+		query.After = after
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return query, nil
+}
+
+// decodeHistoryCursor parses cursor parameter, the cursor is valid for the same profile and order only
+func decodeHistoryCursor(param, order, profid string) (int64, bool) {
+	data, err := base64.RawURLEncoding.DecodeString(param)
+	if err != nil {
+		return 0, false
+	}
+	cur := &cursor{}
+	if err = json.Unmarshal(data, cur); err != nil || cur.Sort != order || cur.ID != profid || len(cur.Values) != 1 {
+		return 0, false
+	}
+
+	rev, ok := cur.Values[0].(float64)
+	if !ok || rev < 1 || rev != math.Trunc(rev) || rev > math.MaxInt64/2 {
+		return 0, false
+	}
+	return int64(rev), true
+}
+
+// lowerNames maps lower case names to names
+func lowerNames(names []string) map[string]string {
+	lower := make(map[string]string, len(names))
+	for _, name := range names {
+		lower[strings.ToLower(name)] = name
+	}
+	return lower
+}
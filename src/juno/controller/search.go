@@ -0,0 +1,268 @@
+package controller
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"golang.org/x/net/context"
+	"juno/common/check"
+	"juno/common/io"
+	"juno/common/valid"
+	"juno/model"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// page size of profile search
+const (
+	PROFILE_PAGE     = 100
+	PROFILE_PAGE_MAX = 1000
+)
+
+// page size of text search, relevance order can't be walked by cursor, so offset is limited
+const (
+	TEXT_PAGE       = 20
+	TEXT_PAGE_MAX   = 100
+	TEXT_OFFSET_MAX = 1000
+	TEXT_LENGTH_MAX = 200
+	TEXT_TERMS_MAX  = 10
+)
+
+// profileSorts maps sort parameter names to sortable profile fields
+var profileSorts = map[string]string{
+	"firstname": "FirstName",
+	"lastname":  "LastName",
+	"age":       "Age",
+}
+
+// profileParams is allow-list of search parameters, others are rejected
+var profileParams = map[string]bool{
+	"firstname": true, "lastname": true, "age_from": true, "age_to": true,
+	"phone": true, "address": true, "sort": true, "limit": true, "cursor": true,
+}
+
+// cursor is decoded form of opaque cursor parameter.
+// Sort is kept in it, so cursor of one order can't be applied to another
+type cursor struct {
+	Sort   string        `json:"s"`
+	Values []interface{} `json:"v"`
+	ID     string        `json:"id"`
+}
+
+// ################ Search Handlers ##################
+
+// ProfileAll shows page of profiles selected by query parameters:
+// firstname, lastname (prefix), age_from, age_to, phone, address (substring),
+// sort (comma separated firstname, lastname, age, "-" prefix means descending), limit, cursor.
+// Link header to the next page is sent if the page is full
+func (c Controller) ProfileAll(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	query, errs := profileQuery(params)
+	if check.ValidErr(w, errs) {
+		return
+	}
+
+	profiles, err := c.stg.ProfileSearch(ctx, query)
+	if check.DBErr(w, err) {
+		return
+	}
+
+	// body stays plain array for existing clients, so next page is linked by header
+	if len(profiles) == query.Limit {
+		last := query.Cursor(profiles[len(profiles)-1])
+		params.Set("cursor", encodeCursor(&cursor{params.Get("sort"), last.Values, last.ID}))
+		w.Header().Set("Link", "<"+c.apiurl+"/profile/all?"+params.Encode()+`>; rel="next"`)
+	}
+	io.Output(w, profiles)
+}
+
+// ProfileText finds profiles by words of names and address, parameters: q (text), offset, limit.
+// Profiles are ordered by relevance, matched fields are highlighted.
+// Link header to the next page is sent if the page is full
+func (c Controller) ProfileText(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	query, errs := textQuery(params)
+	if check.ValidErr(w, errs) {
+		return
+	}
+
+	hits, err := c.stg.ProfileText(ctx, query)
+	if check.DBErr(w, err) {
+		return
+	}
+	for _, hit := range hits {
+		hit.Highlights = hit.Profile.Highlight(query.Terms)
+	}
+
+	if len(hits) == query.Limit && query.Offset+query.Limit <= TEXT_OFFSET_MAX {
+		params.Set("offset", strconv.Itoa(query.Offset+query.Limit))
+		w.Header().Set("Link", "<"+c.apiurl+"/profile/search?"+params.Encode()+`>; rel="next"`)
+	}
+	io.Output(w, hits)
+}
+
+// ##################### Helper Functions ##################
+
+// textQuery builds text query from url parameters, it returns valid.Errors if some of them are invalid
+func textQuery(params url.Values) (*model.TextQuery, error) {
+	query := &model.TextQuery{Limit: TEXT_PAGE}
+	errs := valid.Errors{}
+
+	for name := range params {
+		if name != "q" && name != "offset" && name != "limit" {
+			errs = append(errs, valid.FieldError{Field: name, Code: valid.UNKNOWN, Message: "unknown parameter"})
+		}
+	}
+
+	text := params.Get("q")
+	switch {
+	case text == "":
+		errs = append(errs, valid.FieldError{Field: "q", Code: valid.REQUIRED, Message: "is required"})
+	case len(text) > TEXT_LENGTH_MAX:
+		errs = append(errs, valid.FieldError{Field: "q", Code: valid.LENGTH, Message: "must be at most " + strconv.Itoa(TEXT_LENGTH_MAX) + " bytes"})
+	default:
+		seen := map[string]bool{}
+		for _, term := range model.Tokenize(text) {
+			if !seen[term] {
+				seen[term] = true
+				query.Terms = append(query.Terms, term)
+			}
+		}
+		if len(query.Terms) == 0 || len(query.Terms) > TEXT_TERMS_MAX {
+			msg := "must contain from 1 to " + strconv.Itoa(TEXT_TERMS_MAX) + " words"
+			errs = append(errs, valid.FieldError{Field: "q", Code: valid.FORMAT, Message: msg})
+		}
+	}
+
+	ints := []struct {
+		name     string
+		val      *int
+		min, max int
+	}{
+		{"offset", &query.Offset, 0, TEXT_OFFSET_MAX},
+		{"limit", &query.Limit, 1, TEXT_PAGE_MAX},
+	}
+	for _, i := range ints {
+		if v := params.Get(i.name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < i.min || n > i.max {
+				msg := "must be integer from " + strconv.Itoa(i.min) + " to " + strconv.Itoa(i.max)
+				errs = append(errs, valid.FieldError{Field: i.name, Code: valid.RANGE, Message: msg})
+				continue
+			}
+			*i.val = n
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return query, nil
+}
+
+// profileQuery builds profile query from url parameters, it returns valid.Errors if some of them are invalid.
+// Only allowed parameters are accepted, their values are never interpreted as storage operators
+func profileQuery(params url.Values) (*model.ProfileQuery, error) {
+	query := &model.ProfileQuery{
+		FirstName: params.Get("firstname"),
+		LastName:  params.Get("lastname"),
+		Phone:     params.Get("phone"),
+		Address:   params.Get("address"),
+		Limit:     PROFILE_PAGE,
+	}
+	errs := valid.Errors{}
+
+	for name := range params {
+		if !profileParams[name] {
+			errs = append(errs, valid.FieldError{Field: name, Code: valid.UNKNOWN, Message: "unknown parameter"})
+		}
+	}
+
+	ints := []struct {
+		name     string
+		set      func(int)
+		min, max int
+	}{
+		{"age_from", func(n int) { query.AgeFrom = &n }, 0, 150},
+		{"age_to", func(n int) { query.AgeTo = &n }, 0, 150},
+		{"limit", func(n int) { query.Limit = n }, 1, PROFILE_PAGE_MAX},
+	}
+	for _, i := range ints {
+		if v := params.Get(i.name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < i.min || n > i.max {
+				msg := "must be integer from " + strconv.Itoa(i.min) + " to " + strconv.Itoa(i.max)
+				errs = append(errs, valid.FieldError{Field: i.name, Code: valid.RANGE, Message: msg})
+				continue
+			}
+			i.set(n)
+		}
+	}
+
+	seen := map[string]bool{}
+	for _, name := range strings.Split(params.Get("sort"), ",") {
+		if name == "" {
+			continue
+		}
+		key := model.SortKey{Desc: strings.HasPrefix(name, "-")}
+		key.Field = profileSorts[strings.TrimPrefix(name, "-")]
+		if key.Field == "" || seen[key.Field] {
+			errs = append(errs, valid.FieldError{Field: "sort", Code: valid.FORMAT, Message: "must be list of distinct firstname, lastname, age, optionally prefixed by -"})
+			break
+		}
+		seen[key.Field] = true
+		query.Sort = append(query.Sort, key)
+	}
+
+	if v := params.Get("cursor"); v != "" {
+		after, ok := decodeCursor(v, params.Get("sort"), query.Sort)
+		if !ok {
+			errs = append(errs, valid.FieldError{Field: "cursor", Code: valid.FORMAT, Message: "must be cursor of the next link with the same sort"})
+		}
+		query.After = after
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return query, nil
+}
+
+// encodeCursor makes opaque cursor parameter
+func encodeCursor(cur *cursor) string {
+	data, _ := json.Marshal(cur)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor parses cursor parameter and checks that its values match the sort keys by number and type
+func decodeCursor(param, sort string, keys []model.SortKey) (*model.ProfileCursor, bool) {
+	data, err := base64.RawURLEncoding.DecodeString(param)
+	if err != nil {
+		return nil, false
+	}
+	cur := &cursor{}
+	if err = json.Unmarshal(data, cur); err != nil || cur.Sort != sort || len(cur.Values) != len(keys) {
+		return nil, false
+	}
+
+	after := &model.ProfileCursor{ID: cur.ID}
+	for i, key := range keys {
+		switch (&model.Profile{}).Field(key.Field).(type) {
+		case string:
+			v, ok := cur.Values[i].(string)
+			if !ok {
+				return nil, false
+			}
+			after.Values = append(after.Values, v)
+		case int:
+			v, ok := cur.Values[i].(float64)
+			if !ok || v != math.Trunc(v) || math.Abs(v) > math.MaxInt32 {
+				return nil, false
+			}
+			after.Values = append(after.Values, int(v))
+		}
+	}
+	return after, true
+}
@@ -1,55 +1,130 @@
 package main
 
 import (
-	"github.com/dimfeld/httptreemux"
-	"juno/controller"
-	"juno/middle"
+	"golang.org/x/net/context"
+	"juno/common/token"
+	"juno/mailer"
+	"juno/model"
 	"juno/model/storage"
+	"juno/server"
 	"log"
 	"net/http"
 	"os"
+	"time"
 )
 
-const VER = "v1"
-
 func main() {
 	// get config var
 	port := envMustGet("JUNO_PORT")
-	murl := envMustGet("JUNO_MONGO_URL")
 
-	// initialize mongo
-	s := storage.MgoMustConnect(murl)
+	// initialize storage
+	s := storageMustInit()
 	defer s.Close()
 
-	// controller have to work with storage
-	c := controller.New(s)
+	// the first admin can't be granted by api
+	if email := os.Getenv("JUNO_ADMIN_EMAIL"); email != "" {
+		adminMustGrant(s, email)
+	}
 
-	// init router. httptreemux is fast and convinient
-	r := httptreemux.New()
+	// letters are sent in background, so slow mail server doesn't block handlers
+	m := mailer.NewAsync(mailerMustInit(), 1000, 5, time.Second)
+	defer m.Close()
 
-	// some of the endpoints are available in anonymous mode and some of them aren't.
-	// we can perform different middleware operations - with auth checks and without.
+	publicURL := os.Getenv("JUNO_PUBLIC_URL")
+	if publicURL == "" {
+		publicURL = "http://localhost:" + port
+	}
 
-	// build middleware that creates context and pass it to handlers
-	rc := middle.Context(r, s)
-	// add version
-	rc = middle.Version(rc, VER)
-	rc.Handle("POST", "/user", c.UserCreate)
-	rc.Handle("GET", "/user/:userid/confirm", c.UserConfirm)
+	cfg := server.Config{
+		Storage:   s,
+		TokenKey:  tokenKeyMustGet(),
+		BasicAuth: os.Getenv("JUNO_BASIC_AUTH") != "off",
+		Mailer:    m,
+		PublicURL: publicURL,
+	}
+	if key := os.Getenv("JUNO_HISTORY_KEY"); key != "" {
+		cfg.HistoryKey = []byte(key)
+	}
 
-	rc.Handle("GET", "/profile/:profid", c.ProfileGet)
-	rc.Handle("GET", "/profile/all", c.ProfileAll)
+	// Fire up the server
+	log.Panic(http.ListenAndServe("localhost:"+port, server.New(cfg)))
+}
 
-	// Add middleware that checks authentication.
-	ra := middle.Authentication(rc, s)
-	ra.Handle("PUT", "/profile", c.ProfileUpdate)
-	ra.Handle("GET", "/profile/:profid/history", c.ProfileHistory)
+// mailerMustInit selects mailer by JUNO_MAILER env variable.
+// "dump" (default) writes letters to JUNO_MAIL_FILE or to stderr, "smtp" requires JUNO_SMTP_ADDR
+func mailerMustInit() mailer.Mailer {
+	from := os.Getenv("JUNO_MAIL_FROM")
+	if from == "" {
+		from = "juno@localhost"
+	}
 
-	// add middleware that decorates router and checks that Content-Type is application/json
-	rj := middle.JSONContentType(r)
+	switch backend := os.Getenv("JUNO_MAILER"); backend {
+	case "", "dump":
+		path := os.Getenv("JUNO_MAIL_FILE")
+		if path == "" {
+			return mailer.NewDump(os.Stderr, from)
+		}
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			log.Panic(err)
+		}
+		return mailer.NewDump(f, from)
+	case "smtp":
+		m, err := mailer.NewSMTP(envMustGet("JUNO_SMTP_ADDR"), os.Getenv("JUNO_SMTP_USER"), os.Getenv("JUNO_SMTP_PASS"), from)
+		if err != nil {
+			log.Panic(err)
+		}
+		return m
+	default:
+		log.Panicf("unknown mailer %s", backend)
+	}
+	return nil
+}
 
-	// Fire up the server
-	log.Panic(http.ListenAndServe("localhost:"+port, rj))
+// tokenKeyMustGet reads access token key from JUNO_TOKEN_KEY env variable.
+// If it's missing random key is generated, so issued tokens become invalid on restart
+func tokenKeyMustGet() []byte {
+	if key := os.Getenv("JUNO_TOKEN_KEY"); key != "" {
+		return []byte(key)
+	}
+
+	log.Println("JUNO_TOKEN_KEY isn't set, random key is used")
+	key, err := token.Random()
+	if err != nil {
+		log.Panic(err)
+	}
+	return []byte(key)
+}
+
+// storageMustInit selects storage backend by JUNO_STORAGE env variable.
+// "mongo" (default) requires JUNO_MONGO_URL, "memory" requires nothing and is intended for tests and local development
+func storageMustInit() storage.Storage {
+	switch backend := os.Getenv("JUNO_STORAGE"); backend {
+	case "", "mongo":
+		return storage.MgoMustConnect(envMustGet("JUNO_MONGO_URL"))
+	case "memory":
+		log.Println("in-memory storage is used, all data will be lost on exit")
+		return storage.MemNew()
+	default:
+		log.Panicf("unknown storage backend %s", backend)
+	}
+	return nil
+}
+
+// adminMustGrant grants admin role to registered user, so admin api becomes available
+func adminMustGrant(stg storage.Storage, email string) {
+	ctx, release := stg.Reserve(model.SetCtxUser(context.Background(), model.System()))
+	defer release()
+
+	user, err := stg.UserSearch(ctx, storage.Eq("email", email))
+	if err != nil {
+		log.Panicf("can't find admin %s: %v", email, err)
+	}
+
+	fields := model.Fields{"roles": user.Roles | model.ROLE_ADMIN}
+	if _, err = stg.UserSet(ctx, user.ID, fields, nil); err != nil {
+		log.Panic(err)
+	}
 }
 
 // several env variables are required.
@@ -1,166 +1,1386 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"github.com/bndr/gopencils"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/net/context"
 	"juno/common/io"
+	"juno/common/passwd"
+	"juno/common/valid"
+	"juno/mailer"
 	"juno/model"
+	"juno/model/storage"
+	"juno/server"
 	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"reflect"
+	"regexp"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
-var apiurl string = fmt.Sprintf("http://localhost:%s/%s", os.Getenv("JUNO_PORT"), VER)
+// TestMain makes password hashing cheap, every test registers and logs in users many times
+func TestMain(m *testing.M) {
+	passwd.Cost = bcrypt.MinCost
+	os.Exit(m.Run())
+}
 
-// acceptance test for juno server. Server should be up and running
+// acceptance test for juno server. Each test boots own server on top of in-memory storage
 func TestJunoLiveCircle(t *testing.T) {
+	t.Parallel()
+	srv := startServer()
+	defer srv.Close()
+	apiurl := srv.url
 
 	sufix := rand()
 	email, pass := "user"+sufix+"@mail.com", "pass"+sufix
-	auth := &gopencils.BasicAuth{email, pass}
+	auth := &gopencils.BasicAuth{Username: email, Password: pass}
+
+	//############# register and confirm new user ################
+	userid, err := createUser(apiurl, email, pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = createUser(apiurl, email, pass)
+	if err == nil {
+		t.Fatal("second registration should be considered as an error")
+	}
+
+	_, err = getProfile(apiurl, userid)
+	if err == nil {
+		t.Fatal("unconfirmed user shouldn't have profile")
+	}
+
+	_, err = confirm(apiurl, userid)
+	if err == nil {
+		t.Fatal("user id mustn't be enough to confirm account")
+	}
+
+	confirmToken := srv.confirmToken(t, email)
+	profid, err := confirm(apiurl, confirmToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = confirm(apiurl, confirmToken)
+	if err == nil {
+		t.Fatal("second confirmation should be considered as an error")
+	}
+
+	//############### fill up and update profile ##############
+	profile, err := getProfile(apiurl, profid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	profile.FirstName = "John"
+	profile.LastName = "Smith"
+	profile.Address = "100 E. 17th Street, New York"
+	profile.Phone = "+1-212-674-4300"
+	profile.Age = 30
+	profile, err = updateProfile(apiurl, auth, profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	profile.FirstName = "Will"
+	profile, err = updateProfile(apiurl, auth, profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if profile.FirstName != "Will" {
+		t.Fatal("profile hasn't been updated")
+	}
+
+	changes, err := getHistory(apiurl, auth, profid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Logf("profile changes: %v", changes)
+	if len(changes) != 2 {
+		t.Fatalf("history changes: expected 2, but get %d", len(changes))
+	}
+
+	// ########## check anonymoues access ############
+	profiles, err := allProfiles(apiurl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(profiles) < 1 {
+		t.Fatal("can't obtain profiles")
+	}
+
+	profile = profiles[0]
+	profile.FirstName = "Anon"
+	profile, err = updateProfile(apiurl, nil, profile)
+	if err == nil {
+		t.Fatalf("anon update profile: expected error, but get profile %v", profile)
+	}
+
+	profile, err = getProfile(apiurl, profiles[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err = getHistory(apiurl, nil, profid)
+	if err == nil {
+		t.Fatalf("anon view history: expected error, but get changes %v", changes)
+	}
+}
+
+func TestJunoArbitraryAccess(t *testing.T) {
+	t.Parallel()
+	srv := startServer()
+	defer srv.Close()
+	apiurl := srv.url
+
+	userid := rand()
+	_, err := confirm(apiurl, userid)
+	if err == nil {
+		t.Fatal("Arbitrary confirm should return error")
+	}
+
+	_, err = getProfile(apiurl, userid)
+	if err == nil {
+		t.Fatal("Arbitrary profile access should return error")
+	}
+}
+
+func TestJunoCrossAccess(t *testing.T) {
+	t.Parallel()
+	srv := startServer()
+	defer srv.Close()
+	apiurl := srv.url
+
+	sufix := rand()
+	email1, pass1 := "test1"+sufix+"@mail.com", "pass1"+sufix
+	email2, pass2 := "test2"+sufix+"@mail.com", "pass2"+sufix
+
+	auth1, profile1 := register(t, srv, email1, pass1)
+	auth2, profile2 := register(t, srv, email2, pass2)
+
+	profile1.FirstName = "hacked"
+
+	profile, err := updateProfile(apiurl, auth2, profile1)
+	if err == nil {
+		t.Fatalf("cross update profile: expected error, but get profile %v", profile)
+	}
+
+	changes, err := getHistory(apiurl, auth1, profile2.ID)
+	if err == nil {
+		t.Fatalf("cross view history: expected error, but get changes %v", changes)
+	}
+}
+
+// confirmation token expires and is rotated by resend, account can't be confirmed by registration request
+func TestJunoConfirm(t *testing.T) {
+	t.Parallel()
+	srv := startServer()
+	defer srv.Close()
+	apiurl := srv.url
+
+	email := "confirm" + rand() + "@mail.com"
+	api := gopencils.Api(apiurl)
+	outmap := map[string]interface{}{}
+	res, err := api.Res("user", &outmap).Post(map[string]interface{}{"Email": email, "Password": "password", "Confirm": true})
+	if err = checkErr(res, err); err != nil {
+		t.Fatal(err)
+	}
+	userid, _ := outmap["id"].(string)
+	if _, err = getProfile(apiurl, userid); err == nil {
+		t.Fatal("account is confirmed by registration request")
+	}
+
+	// expired token
+	expired := srv.confirmToken(t, email)
+	ctx, release := srv.stg.Reserve(model.SetCtxUser(context.Background(), model.System()))
+	defer release()
+	if _, err = srv.stg.UserSet(ctx, userid, model.Fields{"confirmexpire": time.Now().Add(-time.Minute)}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = confirm(apiurl, expired); err == nil {
+		t.Fatal("expired token is accepted")
+	}
+
+	// resend rotates token, the same response for unknown email
+	for _, e := range []string{email, "unknown" + email} {
+		res, err = api.Res("user").Res("confirm").Res("resend", &outmap).Post(map[string]string{"Email": e})
+		if err = checkErr(res, err); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := srv.mail.Last("unknown" + email); ok {
+		t.Fatal("letter is sent to unknown email")
+	}
+
+	resent := srv.confirmToken(t, email)
+	if resent == expired {
+		t.Fatal("resend hasn't rotated token")
+	}
+	if _, err = confirm(apiurl, resent); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// invalid input is rejected with list of invalid fields
+func TestJunoValidation(t *testing.T) {
+	t.Parallel()
+	srv := startServer()
+	defer srv.Close()
+	apiurl := srv.url
+
+	sufix := rand()
+	email, pass := "valid"+sufix+"@mail.com", "pass"+sufix
+	auth, profile := register(t, srv, email, pass)
+
+	cases := []struct {
+		name  string
+		path  string
+		auth  *gopencils.BasicAuth
+		body  interface{}
+		field string
+		code  string
+	}{
+		{"html in address", "profile", auth, map[string]interface{}{"ID": profile.ID, "Address": "New&nbsp;<York>"}, "Address", valid.CHARS},
+		{"negative age", "profile", auth, map[string]interface{}{"ID": profile.ID, "Age": -1}, "Age", valid.RANGE},
+		{"age of wrong type", "profile", auth, map[string]interface{}{"ID": profile.ID, "Age": "thirty"}, "Age", valid.TYPE},
+		{"empty email", "user", nil, map[string]interface{}{"Password": pass}, "Email", valid.REQUIRED},
+		{"malformed email", "user", nil, map[string]interface{}{"Email": "no-at-sign", "Password": pass}, "Email", valid.FORMAT},
+		{"short password", "user", nil, map[string]interface{}{"Email": "short" + email, "Password": "123"}, "Password", valid.LENGTH},
+	}
+
+	for _, c := range cases {
+		api := gopencils.Api(apiurl, c.auth)
+		res := api.Res(c.path, &map[string]interface{}{})
+		var err error
+		if c.path == "profile" {
+			res, err = res.Put(c.body)
+		} else {
+			res, err = res.Post(c.body)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res.Raw.StatusCode != http.StatusUnprocessableEntity {
+			t.Fatalf("%s: expected 422, got %d", c.name, res.Raw.StatusCode)
+		}
+		errJSON := &io.ErrJSON{}
+		if err = json.NewDecoder(res.Raw.Body).Decode(errJSON); err != nil {
+			t.Fatal(err)
+		}
+		if len(errJSON.Errors) != 1 || errJSON.Errors[0].Field != c.field || errJSON.Errors[0].Code != c.code {
+			t.Fatalf("%s: expected %s/%s error, got %#v", c.name, c.field, c.code, errJSON.Errors)
+		}
+	}
+}
+
+// user resets forgotten password by token from letter, and changes password knowing the old one
+func TestJunoPassword(t *testing.T) {
+	t.Parallel()
+	srv := startServer()
+	defer srv.Close()
+	apiurl := srv.url
+
+	sufix := rand()
+	email, pass := "reset"+sufix+"@mail.com", "pass"+sufix
+	auth, profile := register(t, srv, email, pass)
+
+	session, err := login(apiurl, email, pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the same response for unknown email
+	for _, e := range []string{"unknown" + email, email} {
+		if err = postJSON(apiurl, "user/password/forgot", map[string]string{"Email": e}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	resetToken := srv.letterToken(t, email, resetTokenRe)
+
+	newPass := "new" + pass
+	if err = postJSON(apiurl, "user/password/reset", map[string]string{"Token": "wrong", "Password": newPass}); err == nil {
+		t.Fatal("wrong reset token is accepted")
+	}
+	if err = postJSON(apiurl, "user/password/reset", map[string]string{"Token": resetToken, "Password": newPass}); err != nil {
+		t.Fatal(err)
+	}
+	if err = postJSON(apiurl, "user/password/reset", map[string]string{"Token": resetToken, "Password": "third"}); err == nil {
+		t.Fatal("reset token has been used twice")
+	}
+
+	// old credentials and sessions are invalidated
+	if _, err = updateProfile(apiurl, auth, profile); err == nil {
+		t.Fatal("old password is still accepted")
+	}
+	if _, err = refresh(apiurl, session.Refresh); err == nil {
+		t.Fatal("session survived password reset")
+	}
+	auth = &gopencils.BasicAuth{Username: email, Password: newPass}
+	if _, err = updateProfile(apiurl, auth, profile); err != nil {
+		t.Fatal(err)
+	}
+
+	// change password
+	if err = putJSON(apiurl, auth, "user/password", map[string]string{"OldPassword": "wrong", "Password": pass}); err == nil {
+		t.Fatal("password is changed without old one")
+	}
+	if err = putJSON(apiurl, auth, "user/password", map[string]string{"OldPassword": newPass, "Password": pass}); err != nil {
+		t.Fatal(err)
+	}
+	if msg, _ := srv.mail.Last(email); !strings.Contains(msg.Text, "password has been changed") {
+		t.Fatalf("user isn't notified about change: %s", msg.Text)
+	}
+	if _, err = login(apiurl, email, pass); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// user changes login email, the old one works until the new one is confirmed
+func TestJunoEmailChange(t *testing.T) {
+	t.Parallel()
+	srv := startServer()
+	defer srv.Close()
+	apiurl := srv.url
+
+	sufix := rand()
+	email, pass := "old"+sufix+"@mail.com", "pass"+sufix
+	otherEmail := "other" + sufix + "@mail.com"
+	newEmail := "new" + sufix + "@mail.com"
+	auth, profile := register(t, srv, email, pass)
+	otherAuth, _ := register(t, srv, otherEmail, pass)
+
+	if err := postJSONAuth(apiurl, auth, "user/email", map[string]string{"Email": otherEmail}); err == nil {
+		t.Fatal("registered email is accepted")
+	}
+
+	// both users request the same email, the second confirmation conflicts
+	if err := postJSONAuth(apiurl, auth, "user/email", map[string]string{"Email": newEmail}); err != nil {
+		t.Fatal(err)
+	}
+	emailToken := srv.letterToken(t, newEmail, emailLink)
+	if msg, _ := srv.mail.Last(email); !strings.Contains(msg.Text, newEmail) {
+		t.Fatalf("old email isn't notified: %s", msg.Text)
+	}
+
+	if err := postJSONAuth(apiurl, otherAuth, "user/email", map[string]string{"Email": newEmail}); err != nil {
+		t.Fatal(err)
+	}
+	otherToken := srv.letterToken(t, newEmail, emailLink)
+
+	// old email is active until confirmation
+	if _, err := updateProfile(apiurl, auth, profile); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := getJSON(apiurl, nil, "user/email/confirm/"+emailToken, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := getJSON(apiurl, nil, "user/email/confirm/"+emailToken, nil); err == nil {
+		t.Fatal("email token has been used twice")
+	}
+	if err := getJSON(apiurl, nil, "user/email/confirm/"+otherToken, nil); err == nil || !strings.Contains(err.Error(), "409") {
+		t.Fatalf("duplicate email: expected conflict, got %v", err)
+	}
+
+	if _, err := updateProfile(apiurl, auth, profile); err == nil {
+		t.Fatal("old email is still accepted")
+	}
+	auth = &gopencils.BasicAuth{Username: newEmail, Password: pass}
+	if _, err := updateProfile(apiurl, auth, profile); err != nil {
+		t.Fatal(err)
+	}
+
+	recs := []*model.AuditRecord{}
+	if err := getJSON(apiurl, auth, "user/audit", &recs); err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 2 || recs[1].Action != model.AUDIT_EMAIL_CHANGE || recs[1].Previous != email || recs[1].Current != newEmail {
+		t.Fatalf("unexpected audit trail %#v", recs)
+	}
+}
+
+// users registered before password hashing keep plain text password, it has to be rehashed on login
+func TestJunoLegacyPassword(t *testing.T) {
+	t.Parallel()
+	srv := startServer()
+	defer srv.Close()
+	apiurl, stg := srv.url, srv.stg
+
+	email, pass := "legacy"+rand()+"@mail.com", "pass"+rand()
+	ctx, release := stg.Reserve(model.SetCtxUser(context.Background(), model.System()))
+	defer release()
+
+	user, err := stg.UserInsert(ctx, &model.User{Email: email, Password: pass, Confirm: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	auth := &gopencils.BasicAuth{Username: email, Password: pass}
+	profile := &model.Profile{ID: user.ID, FirstName: "legacy"}
+	if _, err = updateProfile(apiurl, auth, profile); err != nil {
+		t.Fatal(err)
+	}
+
+	user, err = stg.UserGet(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !passwd.IsHash(user.Password) {
+		t.Fatalf("legacy password hasn't been rehashed: %q", user.Password)
+	}
+
+	// rehashed password still works, wrong one doesn't
+	if _, err = updateProfile(apiurl, auth, profile); err != nil {
+		t.Fatal(err)
+	}
+	wrong := &gopencils.BasicAuth{Username: email, Password: "wrong"}
+	if _, err = updateProfile(apiurl, wrong, profile); err == nil {
+		t.Fatal("wrong password is accepted")
+	}
+}
+
+// admin role is carried by access token and permits to modify foreign profile
+func TestJunoRoles(t *testing.T) {
+	t.Parallel()
+	srv := startServer()
+	defer srv.Close()
+	apiurl := srv.url
+
+	adminEmail, adminPass := "admin"+rand()+"@mail.com", "password"
+	_, adminProfile := register(t, srv, adminEmail, adminPass)
+	userEmail, userPass := "user"+rand()+"@mail.com", "password"
+	_, userProfile := register(t, srv, userEmail, userPass)
+
+	ctx, release := srv.stg.Reserve(model.SetCtxUser(context.Background(), model.System()))
+	defer release()
+	if _, err := srv.stg.UserSet(ctx, adminProfile.ID, model.Fields{"roles": model.ROLE_ADMIN}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := login(apiurl, userEmail, userPass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = updateProfileBearer(apiurl, user.Access, &model.Profile{ID: adminProfile.ID, FirstName: "hacked"}); err == nil {
+		t.Fatal("user has modified foreign profile")
+	}
+
+	admin, err := login(apiurl, adminEmail, adminPass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	moderated := &model.Profile{ID: userProfile.ID, FirstName: "Moderated"}
+	if _, err = updateProfileBearer(apiurl, admin.Access, moderated); err != nil {
+		t.Fatal(err)
+	}
+
+	profile, err := getProfile(apiurl, userProfile.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.FirstName != "Moderated" {
+		t.Fatalf("admin change hasn't been applied: %#v", profile)
+	}
+}
+
+// admin lists, confirms, disables, moderates and deletes accounts
+func TestJunoAdmin(t *testing.T) {
+	t.Parallel()
+	srv := startServer()
+	defer srv.Close()
+	apiurl := srv.url
+
+	admin, adminProfile := register(t, srv, "admin"+rand()+"@mail.com", "password")
+	ctx, release := srv.stg.Reserve(model.SetCtxUser(context.Background(), model.System()))
+	defer release()
+	if _, err := srv.stg.UserSet(ctx, adminProfile.ID, model.Fields{"roles": model.ROLE_ADMIN}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	mark := rand()
+	user, userProfile := register(t, srv, "user"+mark+"@mail.com", "password")
+	if _, err := listUsers(apiurl, user, nil); err == nil {
+		t.Fatal("user has access to admin api")
+	}
+
+	// unconfirmed account is found and confirmed by admin
+	pending := "pending" + mark + "@mail.com"
+	pendingID, err := createUser(apiurl, pending, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, err := listUsers(apiurl, admin, map[string]string{"email": "PENDING" + mark, "confirm": "false"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Users) != 1 || page.Users[0].ID != pendingID || page.Users[0].Confirm {
+		t.Fatalf("unexpected users %#v", page.Users)
+	}
+	// history of unconfirmed account is inspected by admin
+	report := &model.HistoryReport{}
+	if err = getJSON(apiurl, admin, "admin/user/"+pendingID+"/history/check", report); err != nil || !report.Consistent {
+		t.Fatalf("unexpected history check of unconfirmed account %#v: %v", report, err)
+	}
+	chain := &model.ChainReport{}
+	if err = getJSON(apiurl, admin, "admin/user/"+pendingID+"/history/verify", chain); err != nil || !chain.Valid {
+		t.Fatalf("unexpected history verification of unconfirmed account %#v: %v", chain, err)
+	}
+	// profile of unconfirmed account is edited by admin
+	if err = putJSON(apiurl, admin, "admin/user/"+pendingID+"/profile", &model.Profile{FirstName: "Pending"}); err != nil {
+		t.Fatalf("unconfirmed profile isn't updated by admin: %v", err)
+	}
+	if err = postJSONAuth(apiurl, admin, "admin/user/"+pendingID+"/confirm", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = getProfile(apiurl, pendingID); err != nil {
+		t.Fatalf("account isn't confirmed by admin: %v", err)
+	}
+
+	// pagination
+	page, err = listUsers(apiurl, admin, map[string]string{"email": mark, "limit": "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Users) != 1 || page.Next == "" {
+		t.Fatalf("expected full page with next link, got %#v", page)
+	}
+	invalid := []map[string]string{
+		{"limit": "1000"},
+		{"confirm": "maybe"},
+		{"emial": mark},
+		{"role": "admin"},
+	}
+	for _, q := range invalid {
+		if _, err = listUsers(apiurl, admin, q); err == nil || !strings.Contains(err.Error(), "422") {
+			t.Fatalf("%v: expected 422 error, got %v", q, err)
+		}
+	}
+
+	// admin change is marked in history
+	moderated := &model.Profile{FirstName: "Moderated"}
+	if err = putJSON(apiurl, admin, "admin/user/"+userProfile.ID+"/profile", moderated); err != nil {
+		t.Fatal(err)
+	}
+	changes, err := getHistory(apiurl, user, userProfile.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := changes[len(changes)-1]; last.Admin != adminProfile.ID || last.Fields["FirstName"].Current != "Moderated" {
+		t.Fatalf("unexpected admin change %#v", last)
+	}
+
+	// disabled account can't authenticate
+	if err = postJSONAuth(apiurl, admin, "admin/user/"+userProfile.ID+"/disable", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = updateProfile(apiurl, user, userProfile); err == nil {
+		t.Fatal("disabled user has updated profile")
+	}
+	if err = postJSONAuth(apiurl, admin, "admin/user/"+userProfile.ID+"/enable", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = updateProfile(apiurl, user, userProfile); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = deleteJSON(apiurl, admin, "admin/user/"+userProfile.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = getProfile(apiurl, userProfile.ID); err == nil {
+		t.Fatal("profile of deleted user is available")
+	}
+}
+
+// profile update is conditional if If-Match header is sent
+func TestJunoETag(t *testing.T) {
+	t.Parallel()
+	srv := startServer()
+	defer srv.Close()
+	apiurl := srv.url
+
+	auth, profile := register(t, srv, "etag"+rand()+"@mail.com", "password")
+
+	tag, err := profileETag(apiurl, profile.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag == "" {
+		t.Fatal("no ETag in profile response")
+	}
+
+	profile.FirstName = "First"
+	next, err := updateProfileIfMatch(apiurl, auth, profile, tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next == "" || next == tag {
+		t.Fatalf("revision hasn't been changed: %q -> %q", tag, next)
+	}
+
+	// stale revision is rejected and profile isn't modified
+	profile.FirstName = "Stale"
+	_, err = updateProfileIfMatch(apiurl, auth, profile, tag)
+	if err == nil || !strings.Contains(err.Error(), "412") {
+		t.Fatalf("expected 412 error, got %v", err)
+	}
+	got, err := getProfile(apiurl, profile.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.FirstName != "First" {
+		t.Fatalf("stale update has been applied: %#v", got)
+	}
+	if _, err = updateProfileIfMatch(apiurl, auth, profile, "garbage"); err == nil {
+		t.Fatal("malformed If-Match is accepted")
+	}
+
+	// unconditional update is still allowed
+	if _, err = updateProfile(apiurl, auth, profile); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// PATCH modifies only supplied fields and history records exactly them
+func TestJunoPatch(t *testing.T) {
+	t.Parallel()
+	srv := startServer()
+	defer srv.Close()
+	apiurl := srv.url
+
+	auth, profile := register(t, srv, "patch"+rand()+"@mail.com", "password")
+	profile.LastName, profile.Age = "Smith", 30
+	if _, err := updateProfile(apiurl, auth, profile); err != nil {
+		t.Fatal(err)
+	}
+
+	// merge patch
+	got, err := patchProfile(apiurl, auth, "application/merge-patch+json", `{"FirstName":"Merged","Phone":null}`, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.FirstName != "Merged" || got.LastName != "Smith" || got.Age != 30 {
+		t.Fatalf("unexpected patched profile %#v", got)
+	}
+	changes, err := getHistory(apiurl, auth, profile.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := changes[len(changes)-1]; len(last.Fields) != 1 || last.Fields["FirstName"].Current != "Merged" {
+		t.Fatalf("expected FirstName change only, got %#v", last.Fields)
+	}
+
+	// json patch
+	ops := `[{"op":"test","path":"/Age","value":30},{"op":"replace","path":"/Age","value":31},{"op":"remove","path":"/LastName"}]`
+	if got, err = patchProfile(apiurl, auth, "application/json-patch+json", ops, ""); err != nil {
+		t.Fatal(err)
+	}
+	if got.Age != 31 || got.LastName != "" || got.FirstName != "Merged" {
+		t.Fatalf("unexpected patched profile %#v", got)
+	}
+	if _, err = patchProfile(apiurl, auth, "application/json-patch+json", ops, ""); err == nil || !strings.Contains(err.Error(), "409") {
+		t.Fatalf("failed test operation: expected 409 error, got %v", err)
+	}
+
+	// invalid patches
+	invalid := []struct {
+		ct, body, code string
+	}{
+		{"application/merge-patch+json", `{"Unknown":1}`, "422"},
+		{"application/merge-patch+json", `{"ID":"other"}`, "422"},
+		{"application/merge-patch+json", `{"Age":200}`, "422"},
+		{"application/merge-patch+json", `{"Age":"old"}`, "422"},
+		{"application/merge-patch+json", `[]`, "400"},
+		{"text/plain", `{}`, "415"},
+	}
+	for _, c := range invalid {
+		_, err = patchProfile(apiurl, auth, c.ct, c.body, "")
+		if err == nil || !strings.Contains(err.Error(), c.code) {
+			t.Fatalf("%s %s: expected %s error, got %v", c.ct, c.body, c.code, err)
+		}
+	}
+
+	// stale revision
+	if _, err = patchProfile(apiurl, auth, "application/merge-patch+json", `{"Age":32}`, `"1"`); err == nil || !strings.Contains(err.Error(), "412") {
+		t.Fatalf("stale revision: expected 412 error, got %v", err)
+	}
+}
+
+// profiles are searched by filters and walked page by page with next links
+func TestJunoSearch(t *testing.T) {
+	t.Parallel()
+	srv := startServer()
+	defer srv.Close()
+	apiurl := srv.url
+
+	ids := []string{}
+	for i, age := range []int{35, 25, 30} {
+		auth, profile := register(t, srv, "search"+strconv.Itoa(i)+rand()+"@mail.com", "password")
+		profile.FirstName, profile.LastName, profile.Age = "Anna", "Searched", age
+		if _, err := updateProfile(apiurl, auth, profile); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, profile.ID)
+	}
+
+	query := map[string]string{"lastname": "search", "age_from": "26", "sort": "-age"}
+	page, next, err := searchProfiles(apiurl, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 2 || page[0].ID != ids[0] || page[1].ID != ids[2] || next != "" {
+		t.Fatalf("unexpected page %v, next %s", page, next)
+	}
+
+	// walk by next links
+	query = map[string]string{"firstname": "ANN", "sort": "age", "limit": "2"}
+	seen := []string{}
+	for {
+		page, next, err = searchProfiles(apiurl, query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range page {
+			seen = append(seen, p.ID)
+		}
+		if next == "" {
+			break
+		}
+		link, err := url.Parse(next)
+		if err != nil {
+			t.Fatal(err)
+		}
+		query = map[string]string{}
+		for name := range link.Query() {
+			query[name] = link.Query().Get(name)
+		}
+	}
+	if expected := []string{ids[1], ids[2], ids[0]}; !reflect.DeepEqual(seen, expected) {
+		t.Fatalf("expected profiles %v, got %v", expected, seen)
+	}
+
+	// only allowed parameters and fields
+	invalid := []map[string]string{
+		{"confirm": "false"},
+		{"firstname[$ne]": "x"},
+		{"sort": "password"},
+		{"sort": "age,age"},
+		{"age_to": "many"},
+		{"limit": "0"},
+		{"cursor": "garbage"},
+		{"sort": "-age", "cursor": query["cursor"]},
+	}
+	for _, q := range invalid {
+		if _, _, err = searchProfiles(apiurl, q); err == nil || !strings.Contains(err.Error(), "422") {
+			t.Fatalf("%v: expected 422 error, got %v", q, err)
+		}
+	}
+}
+
+// history is paged by cursor and filtered by changed field and time
+func TestJunoHistoryQuery(t *testing.T) {
+	t.Parallel()
+	srv := startServer()
+	defer srv.Close()
+	apiurl := srv.url
+
+	auth, profile := register(t, srv, "history"+rand()+"@mail.com", "password")
+	for _, change := range []func(){
+		func() { profile.Phone = "+1 555 0001" },
+		func() { profile.FirstName = "Bob" },
+		func() { profile.Phone = "+1 555 0002" },
+	} {
+		change()
+		if _, err := updateProfile(apiurl, auth, profile); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// walk phone changes newest first by next links
+	query := map[string]string{"field": "phone", "order": "desc", "limit": "1"}
+	revs := []int64{}
+	for {
+		page, next, err := historyPage(apiurl, auth, profile.ID, query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range page {
+			revs = append(revs, c.Rev)
+		}
+		if next == "" {
+			break
+		}
+		link, err := url.Parse(next)
+		if err != nil {
+			t.Fatal(err)
+		}
+		query = map[string]string{}
+		for name := range link.Query() {
+			query[name] = link.Query().Get(name)
+		}
+	}
+	if expected := []int64{5, 3}; !reflect.DeepEqual(revs, expected) {
+		t.Fatalf("expected revisions %v, got %v", expected, revs)
+	}
+
+	since := time.Now().Add(time.Hour).Format(time.RFC3339)
+	if page, _, err := historyPage(apiurl, auth, profile.ID, map[string]string{"since": since}); err != nil || len(page) != 0 {
+		t.Fatalf("future changes: expected empty page, got %v, %v", page, err)
+	}
+
+	invalid := []map[string]string{
+		{"field": "password"},
+		{"order": "up"},
+		{"since": "yesterday"},
+		{"limit": "1001"},
+		{"rev": "1"},
+		{"cursor": query["cursor"]},
+	}
+	for _, q := range invalid {
+		if _, _, err := historyPage(apiurl, auth, profile.ID, q); err == nil || !strings.Contains(err.Error(), "422") {
+			t.Fatalf("%v: expected 422 error, got %v", q, err)
+		}
+	}
+}
+
+// profile is rebuilt at any instant for the owner and admins, replayed history matches stored profile
+func TestJunoAsOf(t *testing.T) {
+	t.Parallel()
+	srv := startServer()
+	defer srv.Close()
+	apiurl := srv.url
+
+	admin, adminProfile := register(t, srv, "admin"+rand()+"@mail.com", "password")
+	ctx, release := srv.stg.Reserve(model.SetCtxUser(context.Background(), model.System()))
+	defer release()
+	if _, err := srv.stg.UserSet(ctx, adminProfile.ID, model.Fields{"roles": model.ROLE_ADMIN}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	auth, profile := register(t, srv, "asof"+rand()+"@mail.com", "password")
+	time.Sleep(10 * time.Millisecond)
+	between := time.Now().Format(time.RFC3339Nano)
+	time.Sleep(10 * time.Millisecond)
+
+	profile.FirstName, profile.Age = "Bob", 40
+	if _, err := updateProfile(apiurl, auth, profile); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		auth *gopencils.BasicAuth
+		asOf string
+		name string
+		age  int
+	}{
+		{auth, between, "user name", 0},
+		{admin, between, "user name", 0},
+		{auth, time.Now().Format(time.RFC3339Nano), "Bob", 40},
+	}
+	for _, c := range cases {
+		got, err := profileAsOf(apiurl, c.auth, profile.ID, c.asOf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.ID != profile.ID || got.FirstName != c.name || got.Age != c.age {
+			t.Fatalf("as of %s: unexpected profile %#v", c.asOf, got)
+		}
+	}
+
+	other, _ := register(t, srv, "other"+rand()+"@mail.com", "password")
+	errs := []struct {
+		auth *gopencils.BasicAuth
+		asOf string
+		code string
+	}{
+		{nil, between, "401"},
+		{other, between, "404"},
+		{auth, "yesterday", "422"},
+		{auth, "2000-01-01T00:00:00Z", "404"},
+	}
+	for _, e := range errs {
+		if _, err := profileAsOf(apiurl, e.auth, profile.ID, e.asOf); err == nil || !strings.Contains(err.Error(), e.code) {
+			t.Fatalf("as of %s: expected %s error, got %v", e.asOf, e.code, err)
+		}
+	}
+
+	report := &model.HistoryReport{}
+	if err := getJSON(apiurl, admin, "admin/user/"+profile.ID+"/history/check", report); err != nil {
+		t.Fatal(err)
+	}
+	if !report.Consistent || report.Rev != 3 || report.Replayed != 3 {
+		t.Fatalf("unexpected report %#v", report)
+	}
+	if err := getJSON(apiurl, auth, "admin/user/"+profile.ID+"/history/check", nil); err == nil {
+		t.Fatal("user has access to history check")
+	}
+}
+
+// owner reverts profile to earlier revision, the revert is a new revision in history
+func TestJunoRevert(t *testing.T) {
+	t.Parallel()
+	srv := startServer()
+	defer srv.Close()
+	apiurl := srv.url
+
+	auth, profile := register(t, srv, "revert"+rand()+"@mail.com", "password")
+	time.Sleep(10 * time.Millisecond)
+	between := time.Now()
+	time.Sleep(10 * time.Millisecond)
+
+	profile.FirstName = "Bob"
+	if _, err := updateProfile(apiurl, auth, profile); err != nil {
+		t.Fatal(err)
+	}
+	profile.Phone = "+1 555 0001"
+	if _, err := updateProfile(apiurl, auth, profile); err != nil {
+		t.Fatal(err)
+	}
+
+	// revision 3 has Bob without phone
+	reverted, err := revertProfile(apiurl, auth, profile.ID, map[string]interface{}{"Rev": 3}, `"4"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reverted.FirstName != "Bob" || reverted.Phone != "" {
+		t.Fatalf("unexpected reverted profile %#v", reverted)
+	}
+
+	// revision at time before Bob
+	reverted, err = revertProfile(apiurl, auth, profile.ID, map[string]interface{}{"Time": between}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reverted.FirstName != "user name" || reverted.Phone != "" {
+		t.Fatalf("unexpected reverted profile %#v", reverted)
+	}
+
+	changes, err := getHistory(apiurl, auth, profile.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 5 || changes[4].Rev != 6 || changes[4].Fields["FirstName"].Current != "user name" {
+		t.Fatalf("revert isn't in history: %#v", changes)
+	}
+
+	other, _ := register(t, srv, "other"+rand()+"@mail.com", "password")
+	errs := []struct {
+		auth *gopencils.BasicAuth
+		body map[string]interface{}
+		tag  string
+		code string
+	}{
+		{other, map[string]interface{}{"Rev": 2}, "", "404"},
+		{auth, map[string]interface{}{"Rev": 2}, `"5"`, "412"},
+		{auth, map[string]interface{}{"Rev": 6}, "", "422"},
+		{auth, map[string]interface{}{}, "", "422"},
+		{auth, map[string]interface{}{"Rev": 2, "Time": between}, "", "422"},
+		{auth, map[string]interface{}{"Time": time.Now()}, "", "422"},
+	}
+	for _, e := range errs {
+		if _, err := revertProfile(apiurl, e.auth, profile.ID, e.body, e.tag); err == nil || !strings.Contains(err.Error(), e.code) {
+			t.Fatalf("revert %v: expected %s error, got %v", e.body, e.code, err)
+		}
+	}
+}
+
+// diff folds changes between revisions, fields changed back aren't listed
+func TestJunoDiff(t *testing.T) {
+	t.Parallel()
+	srv := startServer()
+	defer srv.Close()
+	apiurl := srv.url
+
+	auth, profile := register(t, srv, "diff"+rand()+"@mail.com", "password")
+	profile.FirstName, profile.Phone = "Bob", "+1 555 0001"
+	if _, err := updateProfile(apiurl, auth, profile); err != nil {
+		t.Fatal(err)
+	}
+	profile.FirstName, profile.Age = "user name", 30
+	if _, err := updateProfile(apiurl, auth, profile); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		query  map[string]string
+		from   int64
+		to     int64
+		fields map[string]model.ChangedField
+	}{
+		{map[string]string{"from": "2"}, 2, 4, map[string]model.ChangedField{"Phone": {Previous: "", Current: "+1 555 0001"}, "Age": {Previous: 0.0, Current: 30.0}}},
+		{map[string]string{"from": "4", "to": "2"}, 4, 2, map[string]model.ChangedField{"Phone": {Previous: "+1 555 0001", Current: ""}, "Age": {Previous: 30.0, Current: 0.0}}},
+		{map[string]string{"from": "1", "to": "3"}, 1, 3, map[string]model.ChangedField{"FirstName": {Previous: "", Current: "Bob"}, "Phone": {Previous: "", Current: "+1 555 0001"}}},
+		{map[string]string{"from": "3", "to": "3"}, 3, 3, map[string]model.ChangedField{}},
+	}
+	for _, c := range cases {
+		res, err := profileDiff(apiurl, auth, profile.ID, c.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.From != c.from || res.To != c.to || !reflect.DeepEqual(res.Fields, c.fields) {
+			t.Fatalf("%v: unexpected diff %#v", c.query, res)
+		}
+	}
+
+	other, _ := register(t, srv, "other"+rand()+"@mail.com", "password")
+	if _, err := profileDiff(apiurl, other, profile.ID, map[string]string{"from": "2"}); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("foreign diff: expected 404 error, got %v", err)
+	}
+
+	invalid := []map[string]string{
+		{},
+		{"to": "3"},
+		{"from": "0"},
+		{"from": "2", "to": "5"},
+		{"from": "x"},
+		{"from": "2", "rev": "3"},
+	}
+	for _, q := range invalid {
+		if _, err := profileDiff(apiurl, auth, profile.ID, q); err == nil || !strings.Contains(err.Error(), "422") {
+			t.Fatalf("%v: expected 422 error, got %v", q, err)
+		}
+	}
+}
+
+// history records who made the change, from where and why
+func TestJunoHistoryOrigin(t *testing.T) {
+	t.Parallel()
+	srv := startServer()
+	defer srv.Close()
+	apiurl := srv.url
+
+	admin, adminProfile := register(t, srv, "admin"+rand()+"@mail.com", "password")
+	ctx, release := srv.stg.Reserve(model.SetCtxUser(context.Background(), model.System()))
+	defer release()
+	if _, err := srv.stg.UserSet(ctx, adminProfile.ID, model.Fields{"roles": model.ROLE_ADMIN}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	auth, profile := register(t, srv, "origin"+rand()+"@mail.com", "password")
+	profile.FirstName = "Bob"
+	headers := map[string]string{"X-Change-Reason": "typo", "X-Request-ID": "req-1", "User-Agent": "juno-test"}
+	reqID, err := putProfileWith(apiurl, auth, "profile", profile, headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reqID != "req-1" {
+		t.Fatalf("expected request id req-1, got %q", reqID)
+	}
+
+	// body reason takes precedence over header
+	headers["X-Request-ID"] = "req-2"
+	body := map[string]interface{}{"FirstName": "Will", "Reason": "moderation"}
+	reqID, err = putProfileWith(apiurl, admin, "admin/user/"+profile.ID+"/profile", body, headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes, _, err := historyPage(apiurl, auth, profile.ID, map[string]string{"order": "desc", "limit": "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner := model.Origin{IP: "127.0.0.1", UserAgent: "juno-test", RequestID: "req-1", Reason: "typo"}
+	if c := changes[1]; c.Actor != profile.ID || c.Auth != model.AUTH_BASIC || c.Origin != owner {
+		t.Fatalf("unexpected owner change %#v", c)
+	}
+	if c := changes[0]; c.Actor != adminProfile.ID || c.Admin != adminProfile.ID || c.Reason != "moderation" || c.RequestID != reqID {
+		t.Fatalf("unexpected admin change %#v", c)
+	}
+
+	changes, _, err = historyPage(apiurl, auth, profile.ID, map[string]string{"actor": adminProfile.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Actor != adminProfile.ID {
+		t.Fatalf("expected the admin change only, got %#v", changes)
+	}
+
+	filters := []struct {
+		query map[string]string
+		count int
+	}{
+		{map[string]string{"request": "req-1"}, 1},
+		{map[string]string{"ip": "127.0.0.1", "auth": model.AUTH_BASIC}, 3},
+		{map[string]string{"auth": model.AUTH_BEARER}, 0},
+	}
+	for _, f := range filters {
+		changes, _, err = historyPage(apiurl, auth, profile.ID, f.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(changes) != f.count {
+			t.Fatalf("%v: expected %d changes, got %#v", f.query, f.count, changes)
+		}
+	}
+	if _, _, err = historyPage(apiurl, auth, profile.ID, map[string]string{"auth": "magic"}); err == nil || !strings.Contains(err.Error(), "422") {
+		t.Fatalf("unknown auth method: expected 422 error, got %v", err)
+	}
+
+	headers["X-Change-Reason"] = strings.Repeat("x", 501)
+	if _, err := putProfileWith(apiurl, auth, "profile", profile, headers); err == nil || !strings.Contains(err.Error(), "422") {
+		t.Fatalf("long reason: expected 422 error, got %v", err)
+	}
+}
+
+// history is hash chained and signed checkpoint follows each update
+func TestJunoHistoryVerify(t *testing.T) {
+	t.Parallel()
+	srv := startServer()
+	defer srv.Close()
+	apiurl := srv.url
+
+	admin, adminProfile := register(t, srv, "admin"+rand()+"@mail.com", "password")
+	ctx, release := srv.stg.Reserve(model.SetCtxUser(context.Background(), model.System()))
+	defer release()
+	if _, err := srv.stg.UserSet(ctx, adminProfile.ID, model.Fields{"roles": model.ROLE_ADMIN}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	auth, profile := register(t, srv, "chain"+rand()+"@mail.com", "password")
+	profile.FirstName = "Bob"
+	if _, err := updateProfile(apiurl, auth, profile); err != nil {
+		t.Fatal(err)
+	}
 
-	//############# register and confirm new user ################
-	userid, err := createUser(email, pass)
+	changes, err := getHistory(apiurl, auth, profile.ID)
 	if err != nil {
 		t.Fatal(err)
 	}
+	if len(changes) != 2 || changes[0].Hash == "" || changes[1].Hash != changes[1].Digest(profile.ID, changes[0].Hash) {
+		t.Fatalf("history isn't chained: %#v", changes)
+	}
 
-	_, err = createUser(email, pass)
-	if err == nil {
-		t.Fatal("second registration should be considered as an error")
+	report := &model.ChainReport{}
+	if err := getJSON(apiurl, admin, "admin/user/"+profile.ID+"/history/verify", report); err != nil {
+		t.Fatal(err)
+	}
+	if !report.Valid || report.Length != 2 || report.Head != 3 || report.Checkpoint != 3 {
+		t.Fatalf("unexpected report %#v", report)
+	}
+	if err := getJSON(apiurl, auth, "admin/user/"+profile.ID+"/history/verify", nil); err == nil {
+		t.Fatal("user has access to history verification")
 	}
+}
 
-	_, err = getProfile(userid)
-	if err == nil {
-		t.Fatal("unconfirmed user shouldn't have profile")
+// profiles are found by any word of names and address, matched fields are highlighted
+func TestJunoText(t *testing.T) {
+	t.Parallel()
+	srv := startServer()
+	defer srv.Close()
+	apiurl := srv.url
+
+	ids := []string{}
+	for i, name := range []string{"Marie-Anne", "Anne", "Bob"} {
+		auth, profile := register(t, srv, "text"+strconv.Itoa(i)+rand()+"@mail.com", "password")
+		profile.FirstName, profile.LastName, profile.Address = name, "Curie", "Rue d'Ulm 5"
+		if _, err := updateProfile(apiurl, auth, profile); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, profile.ID)
 	}
 
-	profid, err := confirm(userid)
+	hits, next, err := textSearch(apiurl, map[string]string{"q": "ANNE ulm", "limit": "1"})
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	_, err = confirm(userid)
-	if err == nil {
-		t.Fatal("second confirmation should be considered as an error")
+	if len(hits) != 1 || hits[0].Profile.ID != ids[0] || next == "" {
+		t.Fatalf("unexpected hits %#v, next %s", hits, next)
+	}
+	if hl := hits[0].Highlights; hl["FirstName"] != "Marie-<em>Anne</em>" || hl["Address"] != "Rue d'<em>Ulm</em> 5" || hl["LastName"] != "" {
+		t.Fatalf("unexpected highlights %#v", hl)
 	}
 
-	//############### fill up and update profile ##############
-	profile, err := getProfile(profid)
+	link, err := url.Parse(next)
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	profile.FirstName = "John"
-	profile.LastName = "Smith"
-	profile.Address = "100 E. 17th Street, New&nbsp;<York>"
-	profile.Phone = "+1-212-674-4300"
-	profile.Age = 30
-	profile, err = updateProfile(auth, profile)
+	hits, _, err = textSearch(apiurl, map[string]string{"q": link.Query().Get("q"), "offset": link.Query().Get("offset")})
 	if err != nil {
 		t.Fatal(err)
 	}
+	if len(hits) != 2 || hits[0].Profile.ID != ids[1] || hits[1].Profile.ID != ids[2] {
+		t.Fatalf("unexpected second page %#v", hits)
+	}
 
-	profile.FirstName = "Will"
-	profile, err = updateProfile(auth, profile)
-	if err != nil {
-		t.Fatal(err)
+	invalid := []map[string]string{
+		{},
+		{"q": "..."},
+		{"q": "curie", "sort": "age"},
+		{"q": "curie", "offset": "-1"},
+		{"q": "a b c d e f g h i j k"},
 	}
+	for _, q := range invalid {
+		if _, _, err = textSearch(apiurl, q); err == nil || !strings.Contains(err.Error(), "422") {
+			t.Fatalf("%v: expected 422 error, got %v", q, err)
+		}
+	}
+}
 
-	if profile.FirstName != "Will" {
-		t.Fatal("profile hasn't been updated")
+// operator-like credentials and tokens don't match stored users
+func TestJunoInjection(t *testing.T) {
+	t.Parallel()
+	srv := startServer()
+	defer srv.Close()
+	apiurl := srv.url
+
+	_, profile := register(t, srv, "injection"+rand()+"@mail.com", "password")
+
+	for _, email := range []string{`{"$ne": ""}`, `{"$gt": ""}`, "$where"} {
+		if _, err := login(apiurl, email, "password"); err == nil || !strings.Contains(err.Error(), "403") {
+			t.Fatalf("login %s: expected 403 error, got %v", email, err)
+		}
+		auth := &gopencils.BasicAuth{Username: email, Password: "password"}
+		if _, err := updateProfile(apiurl, auth, profile); err == nil || !strings.Contains(err.Error(), "403") {
+			t.Fatalf("basic auth %s: expected 403 error, got %v", email, err)
+		}
 	}
 
-	changes, err := getHistory(auth, profid)
-	if err != nil {
-		t.Fatal(err)
+	creds := map[string]interface{}{"Email": map[string]string{"$ne": ""}, "Password": "password"}
+	if err := postJSON(apiurl, "session", creds); err == nil || !strings.Contains(err.Error(), "422") {
+		t.Fatalf("operator in body: expected 422 error, got %v", err)
 	}
+	if _, err := confirm(apiurl, "$ne"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("operator as token: expected 404 error, got %v", err)
+	}
+}
 
-	t.Logf("profile changes: %v", changes)
-	if len(changes) != 2 {
-		t.Fatalf("history changes: expected 2, but get %d", len(changes))
+// user logins, works with access token, refreshes it and logs out
+func TestJunoSession(t *testing.T) {
+	t.Parallel()
+	srv := startServer()
+	defer srv.Close()
+	apiurl := srv.url
+
+	sufix := rand()
+	email, pass := "session"+sufix+"@mail.com", "pass"+sufix
+	_, profile := register(t, srv, email, pass)
+
+	if _, err := login(apiurl, email, "wrong"); err == nil {
+		t.Fatal("login with wrong password should fail")
 	}
 
-	// ########## check anonymoues access ############
-	profiles, err := allProfiles()
+	session, err := login(apiurl, email, pass)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(profiles) < 1 {
-		t.Fatal("can't obtain profiles")
-	}
 
-	profile = profiles[0]
-	profile.FirstName = "Anon"
-	profile, err = updateProfile(nil, profile)
-	if err == nil {
-		t.Fatalf("anon update profile: expected error, but get profile %v", profile)
+	profile.LastName = "Bearer"
+	if _, err = updateProfileBearer(apiurl, session.Access, profile); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = updateProfileBearer(apiurl, session.Access+"x", profile); err == nil {
+		t.Fatal("forged access token is accepted")
 	}
 
-	profile, err = getProfile(profiles[0].ID)
+	// refresh token is rotated
+	next, err := refresh(apiurl, session.Refresh)
 	if err != nil {
 		t.Fatal(err)
 	}
+	if _, err = refresh(apiurl, session.Refresh); err == nil {
+		t.Fatal("refresh token has been used twice")
+	}
+	if _, err = updateProfileBearer(apiurl, next.Access, profile); err != nil {
+		t.Fatal(err)
+	}
 
-	changes, err = getHistory(nil, profid)
-	if err == nil {
-		t.Fatalf("anon view history: expected error, but get changes %v", changes)
+	// revoked session can't be refreshed
+	if err = logout(apiurl, next.Access); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = refresh(apiurl, next.Refresh); err == nil {
+		t.Fatal("revoked session has been refreshed")
 	}
 }
 
-func TestJunoArbitraryAccess(t *testing.T) {
-	userid := rand()
-	_, err := confirm(userid)
-	if err == nil {
-		t.Fatal("Arbitrary confirm should return error")
-	}
+// ############################ Help Functions ####################################
 
-	_, err = getProfile(userid)
-	if err == nil {
-		t.Fatal("Arbitrary profile access should return error")
+// testServer is juno booted in-process with isolated in-memory storage
+type testServer struct {
+	*httptest.Server
+	// url is versioned api url
+	url  string
+	stg  storage.Storage
+	mail *mailer.Fake
+}
+
+// startServer boots juno in-process, Close shuts down server and storage
+func startServer() *testServer {
+	stg := storage.MemNew()
+	mail := &mailer.Fake{}
+	cfg := server.Config{
+		Storage:    stg,
+		TokenKey:   []byte("juno test token key"),
+		BasicAuth:  true,
+		Mailer:     mail,
+		HistoryKey: []byte("juno test history key"),
 	}
+	srv := httptest.NewServer(server.New(cfg))
+
+	return &testServer{srv, srv.URL + "/" + server.VER, stg, mail}
 }
 
-func TestJunoCrossAccess(t *testing.T) {
-	sufix := rand()
-	email1, pass1 := "test1"+sufix+"@mail.com", "pass1"+sufix
-	email2, pass2 := "test2"+sufix+"@mail.com", "pass2"+sufix
+func (srv *testServer) Close() {
+	srv.Server.Close()
+	srv.stg.Close()
+}
 
-	auth1, profile1 := register(t, email1, pass1)
-	auth2, profile2 := register(t, email2, pass2)
+// confirmToken obtains confirmation token from the last letter sent to email
+func (srv *testServer) confirmToken(t *testing.T, email string) string {
+	return srv.letterToken(t, email, confirmLink)
+}
 
-	profile1.FirstName = "hacked"
+var (
+	confirmLink  = regexp.MustCompile(`/user/confirm/([\w-]+)`)
+	resetTokenRe = regexp.MustCompile(`new password:\s+([\w-]+)`)
+	emailLink    = regexp.MustCompile(`/user/email/confirm/([\w-]+)`)
+)
 
-	profile, err := updateProfile(auth2, profile1)
-	if err == nil {
-		t.Fatalf("cross update profile: expected error, but get profile %v", profile)
+// letterToken extracts token from the last letter sent to email
+func (srv *testServer) letterToken(t *testing.T, email string, re *regexp.Regexp) string {
+	msg, ok := srv.mail.Last(email)
+	if !ok {
+		t.Fatalf("no letter has been sent to %s", email)
 	}
 
-	changes, err := getHistory(auth1, profile2.ID)
-	if err == nil {
-		t.Fatalf("cross view history: expected error, but get changes %v", changes)
+	m := re.FindStringSubmatch(msg.Text)
+	if m == nil {
+		t.Fatalf("no token in letter to %s: %s", email, msg.Text)
 	}
+	return m[1]
 }
 
-// ############################ Help Functions ####################################
+var randSeq int64
 
-// rand returns arbitrary string based on time
+// rand returns arbitrary string based on time, it's unique even for parallel calls
 func rand() string {
-	return strconv.FormatInt(time.Now().UnixNano(), 16)
+	seq := atomic.AddInt64(&randSeq, 1)
+	return strconv.FormatInt(time.Now().UnixNano(), 16) + strconv.FormatInt(seq, 16)
 }
 
 // register creates new fake user
-func register(t *testing.T, email, pass string) (*gopencils.BasicAuth, *model.Profile) {
-	auth := &gopencils.BasicAuth{email, pass}
+func register(t *testing.T, srv *testServer, email, pass string) (*gopencils.BasicAuth, *model.Profile) {
+	apiurl := srv.url
+	auth := &gopencils.BasicAuth{Username: email, Password: pass}
 
-	userid, err := createUser(email, pass)
-	if err != nil {
+	if _, err := createUser(apiurl, email, pass); err != nil {
 		t.Fatal(err)
 	}
 
-	profid, err := confirm(userid)
+	profid, err := confirm(apiurl, srv.confirmToken(t, email))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -169,7 +1389,7 @@ func register(t *testing.T, email, pass string) (*gopencils.BasicAuth, *model.Pr
 		FirstName: "user name",
 	}
 
-	profile, err = updateProfile(auth, profile)
+	profile, err = updateProfile(apiurl, auth, profile)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -178,7 +1398,7 @@ func register(t *testing.T, email, pass string) (*gopencils.BasicAuth, *model.Pr
 }
 
 // returns user id
-func createUser(email, pass string) (string, error) {
+func createUser(apiurl, email, pass string) (string, error) {
 	api := gopencils.Api(apiurl)
 	user := &model.User{
 		Email:    email,
@@ -201,11 +1421,11 @@ func createUser(email, pass string) (string, error) {
 }
 
 // returns profile id
-func confirm(userid string) (string, error) {
+func confirm(apiurl, confirmToken string) (string, error) {
 	api := gopencils.Api(apiurl)
 
 	outmap := map[string]interface{}{}
-	res, err := api.Res("user").Id(userid).Res("confirm", &outmap).Get()
+	res, err := api.Res("user").Res("confirm").Id(confirmToken, &outmap).Get()
 
 	if err = checkErr(res, err); err != nil {
 		return "", err
@@ -219,7 +1439,7 @@ func confirm(userid string) (string, error) {
 	return id, nil
 }
 
-func allProfiles() ([]*model.Profile, error) {
+func allProfiles(apiurl string) ([]*model.Profile, error) {
 	api := gopencils.Api(apiurl)
 
 	profiles := []*model.Profile{}
@@ -232,7 +1452,7 @@ func allProfiles() ([]*model.Profile, error) {
 	return profiles, nil
 }
 
-func getProfile(profid string) (*model.Profile, error) {
+func getProfile(apiurl, profid string) (*model.Profile, error) {
 	api := gopencils.Api(apiurl)
 
 	profile := &model.Profile{}
@@ -245,7 +1465,7 @@ func getProfile(profid string) (*model.Profile, error) {
 	return profile, nil
 }
 
-func updateProfile(auth *gopencils.BasicAuth, profile *model.Profile) (*model.Profile, error) {
+func updateProfile(apiurl string, auth *gopencils.BasicAuth, profile *model.Profile) (*model.Profile, error) {
 	api := gopencils.Api(apiurl, auth)
 
 	updatedProfile := &model.Profile{}
@@ -258,7 +1478,7 @@ func updateProfile(auth *gopencils.BasicAuth, profile *model.Profile) (*model.Pr
 	return profile, nil
 }
 
-func getHistory(auth *gopencils.BasicAuth, profid string) ([]*model.Change, error) {
+func getHistory(apiurl string, auth *gopencils.BasicAuth, profid string) ([]*model.Change, error) {
 	api := gopencils.Api(apiurl, auth)
 
 	changes := []*model.Change{}
@@ -271,6 +1491,38 @@ func getHistory(auth *gopencils.BasicAuth, profid string) ([]*model.Change, erro
 	return changes, nil
 }
 
+// profileAsOf requests profile as it was at asOf time, auth might be nil
+func profileAsOf(apiurl string, auth *gopencils.BasicAuth, profid, asOf string) (*model.Profile, error) {
+	api := gopencils.Api(apiurl)
+	if auth != nil {
+		api = gopencils.Api(apiurl, auth)
+	}
+
+	profile := &model.Profile{}
+	res, err := api.Res("profile", profile).Id(profid).Get(map[string]string{"asOf": asOf})
+	if err = checkErr(res, err); err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+// historyPage requests page of profile history, it returns changes and link to the next page
+func historyPage(apiurl string, auth *gopencils.BasicAuth, profid string, query map[string]string) ([]*model.Change, string, error) {
+	api := gopencils.Api(apiurl, auth)
+
+	changes := []*model.Change{}
+	res, err := api.Res("profile").Id(profid).Res("history", &changes).Get(query)
+	if err = checkErr(res, err); err != nil {
+		return nil, "", err
+	}
+
+	next := ""
+	if m := linkRe.FindStringSubmatch(res.Raw.Header.Get("Link")); m != nil {
+		next = m[1]
+	}
+	return changes, next, nil
+}
+
 func checkErr(res *gopencils.Resource, err error) error {
 	if err != nil {
 		log.Printf("err in checkErr %v", err)
@@ -284,3 +1536,292 @@ func checkErr(res *gopencils.Resource, err error) error {
 
 	return nil
 }
+
+// tokens is response of session endpoints
+type tokens struct {
+	Access    string `json:"access_token"`
+	Refresh   string `json:"refresh_token"`
+	ExpiresIn int    `json:"expires_in"`
+}
+
+// login returns issued tokens
+func login(apiurl, email, pass string) (*tokens, error) {
+	api := gopencils.Api(apiurl)
+	creds := &model.User{Email: email, Password: pass}
+
+	out := &tokens{}
+	res, err := api.Res("session", out).Post(creds)
+	if err = checkErr(res, err); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func refresh(apiurl, refreshToken string) (*tokens, error) {
+	api := gopencils.Api(apiurl)
+
+	out := &tokens{}
+	res, err := api.Res("session").Res("refresh", out).Post(map[string]string{"refresh_token": refreshToken})
+	if err = checkErr(res, err); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func logout(apiurl, access string) error {
+	api := gopencils.Api(apiurl)
+
+	outmap := map[string]interface{}{}
+	res := api.Res("session", &outmap)
+	res.SetHeader("Authorization", "Bearer "+access)
+	res, err := res.Delete()
+	return checkErr(res, err)
+}
+
+func updateProfileBearer(apiurl, access string, profile *model.Profile) (*model.Profile, error) {
+	api := gopencils.Api(apiurl)
+
+	updatedProfile := &model.Profile{}
+	res := api.Res("profile", updatedProfile)
+	res.SetHeader("Authorization", "Bearer "+access)
+	res, err := res.Put(profile)
+
+	if err = checkErr(res, err); err != nil {
+		return nil, err
+	}
+
+	return updatedProfile, nil
+}
+
+// postJSON sends body and checks response status
+func postJSON(apiurl, path string, body interface{}) error {
+	api := gopencils.Api(apiurl)
+
+	outmap := map[string]interface{}{}
+	res, err := api.Res(path, &outmap).Post(body)
+	return checkErr(res, err)
+}
+
+// putJSON sends body on behalf of user and checks response status
+func putJSON(apiurl string, auth *gopencils.BasicAuth, path string, body interface{}) error {
+	api := gopencils.Api(apiurl, auth)
+
+	outmap := map[string]interface{}{}
+	res, err := api.Res(path, &outmap).Put(body)
+	return checkErr(res, err)
+}
+
+// postJSONAuth sends body on behalf of user and checks response status
+func postJSONAuth(apiurl string, auth *gopencils.BasicAuth, path string, body interface{}) error {
+	api := gopencils.Api(apiurl, auth)
+
+	outmap := map[string]interface{}{}
+	res, err := api.Res(path, &outmap).Post(body)
+	return checkErr(res, err)
+}
+
+// getJSON fetches path on behalf of user (might be nil) into out (might be nil)
+func getJSON(apiurl string, auth *gopencils.BasicAuth, path string, out interface{}) error {
+	api := gopencils.Api(apiurl, auth)
+
+	if out == nil {
+		out = &map[string]interface{}{}
+	}
+	res, err := api.Res(path, out).Get()
+	return checkErr(res, err)
+}
+
+// userPage is the response of admin user listing
+type userPage struct {
+	Users []struct {
+		ID      string
+		Email   string
+		Confirm bool
+	} `json:"users"`
+	Next string `json:"next"`
+}
+
+// listUsers requests admin user listing filtered by query (might be nil)
+func listUsers(apiurl string, auth *gopencils.BasicAuth, query map[string]string) (*userPage, error) {
+	api := gopencils.Api(apiurl, auth)
+
+	page := &userPage{}
+	res, err := api.Res("admin/user", page).Get(query)
+	if err = checkErr(res, err); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// deleteJSON deletes path on behalf of user and checks response status
+func deleteJSON(apiurl string, auth *gopencils.BasicAuth, path string) error {
+	api := gopencils.Api(apiurl, auth)
+
+	outmap := map[string]interface{}{}
+	res, err := api.Res(path, &outmap).Delete()
+	return checkErr(res, err)
+}
+
+// profileETag returns ETag of profile
+func profileETag(apiurl, profid string) (string, error) {
+	api := gopencils.Api(apiurl)
+
+	profile := &model.Profile{}
+	res, err := api.Res("profile", profile).Id(profid).Get()
+	if err = checkErr(res, err); err != nil {
+		return "", err
+	}
+	return res.Raw.Header.Get("ETag"), nil
+}
+
+// updateProfileIfMatch updates profile of expected revision and returns ETag of the new one
+func updateProfileIfMatch(apiurl string, auth *gopencils.BasicAuth, profile *model.Profile, tag string) (string, error) {
+	api := gopencils.Api(apiurl, auth)
+
+	updatedProfile := &model.Profile{}
+	res := api.Res("profile", updatedProfile)
+	res.SetHeader("If-Match", tag)
+	res, err := res.Put(profile)
+	if err = checkErr(res, err); err != nil {
+		return "", err
+	}
+	return res.Raw.Header.Get("ETag"), nil
+}
+
+// patchProfile sends patch of given content type to own profile, If-Match header is sent if tag isn't empty
+func patchProfile(apiurl string, auth *gopencils.BasicAuth, ct, body, tag string) (*model.Profile, error) {
+	req, err := http.NewRequest("PATCH", apiurl+"/profile", strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(auth.Username, auth.Password)
+	req.Header.Set("Content-Type", ct)
+	if tag != "" {
+		req.Header.Set("If-Match", tag)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("err %d: %s", resp.StatusCode, resp.Header.Get(io.JUNO_ERR_HEADER))
+	}
+	profile := &model.Profile{}
+	err = json.NewDecoder(resp.Body).Decode(profile)
+	return profile, err
+}
+
+// profileDiff requests difference between revisions of profile
+func profileDiff(apiurl string, auth *gopencils.BasicAuth, profid string, query map[string]string) (*revDiff, error) {
+	api := gopencils.Api(apiurl, auth)
+
+	res := &revDiff{}
+	resp, err := api.Res("profile").Id(profid).Res("diff", res).Get(query)
+	if err = checkErr(resp, err); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// revDiff is the response of profile diff
+type revDiff struct {
+	From, To int64
+	Fields   map[string]model.ChangedField
+}
+
+// putProfileWith sends profile update with extra headers, it returns request ID sent back by server
+func putProfileWith(apiurl string, auth *gopencils.BasicAuth, path string, body interface{}, headers map[string]string) (string, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("PUT", apiurl+"/"+path, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth(auth.Username, auth.Password)
+	req.Header.Set("Content-Type", "application/json")
+	for name, val := range headers {
+		req.Header.Set(name, val)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return "", fmt.Errorf("err %d: %s", resp.StatusCode, resp.Header.Get(io.JUNO_ERR_HEADER))
+	}
+	return resp.Header.Get("X-Request-ID"), nil
+}
+
+// revertProfile requests revert of profile, tag is sent as If-Match header if it isn't empty
+func revertProfile(apiurl string, auth *gopencils.BasicAuth, profid string, body interface{}, tag string) (*model.Profile, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", apiurl+"/profile/"+profid+"/revert", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(auth.Username, auth.Password)
+	req.Header.Set("Content-Type", "application/json")
+	if tag != "" {
+		req.Header.Set("If-Match", tag)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("err %d: %s", resp.StatusCode, resp.Header.Get(io.JUNO_ERR_HEADER))
+	}
+	profile := &model.Profile{}
+	err = json.NewDecoder(resp.Body).Decode(profile)
+	return profile, err
+}
+
+// searchProfiles requests profile search by query parameters, it returns the page and link to the next one
+func searchProfiles(apiurl string, query map[string]string) ([]*model.Profile, string, error) {
+	api := gopencils.Api(apiurl)
+
+	profiles := []*model.Profile{}
+	res, err := api.Res("profile/all", &profiles).Get(query)
+	if err = checkErr(res, err); err != nil {
+		return nil, "", err
+	}
+
+	next := ""
+	if m := linkRe.FindStringSubmatch(res.Raw.Header.Get("Link")); m != nil {
+		next = m[1]
+	}
+	return profiles, next, nil
+}
+
+var linkRe = regexp.MustCompile(`^<(.+)>; rel="next"$`)
+
+// textSearch requests text search by query parameters, it returns hits and link to the next page
+func textSearch(apiurl string, query map[string]string) ([]*model.TextHit, string, error) {
+	api := gopencils.Api(apiurl)
+
+	hits := []*model.TextHit{}
+	res, err := api.Res("profile/search", &hits).Get(query)
+	if err = checkErr(res, err); err != nil {
+		return nil, "", err
+	}
+
+	next := ""
+	if m := linkRe.FindStringSubmatch(res.Raw.Header.Get("Link")); m != nil {
+		next = m[1]
+	}
+	return hits, next, nil
+}
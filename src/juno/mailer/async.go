@@ -0,0 +1,114 @@
+package mailer
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// ErrQueueFull is returned by Async.Send when letters are produced faster than they are sent
+var ErrQueueFull = errors.New("mail queue is full")
+
+// ErrClosed is returned by Async.Send after Close
+var ErrClosed = errors.New("mailer is closed")
+
+// Async sends letters in background with retry, so slow mail server never blocks caller
+type Async struct {
+	base    Mailer
+	retries int
+	delay   time.Duration
+
+	queue chan attempt
+	// letters counts accepted letters that are neither sent nor given up yet
+	letters sync.WaitGroup
+	worker  sync.WaitGroup
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// attempt is queued letter, failed one is queued again after delay
+type attempt struct {
+	msg   Message
+	tries int
+	delay time.Duration
+}
+
+// NewAsync wraps base mailer. Failed letter is resent up to retries times,
+// delay between attempts doubles starting from delay. Waiting letter doesn't hold others
+func NewAsync(base Mailer, size, retries int, delay time.Duration) *Async {
+	m := &Async{
+		base:    base,
+		retries: retries,
+		delay:   delay,
+		queue:   make(chan attempt, size),
+	}
+
+	m.worker.Add(1)
+	go m.loop()
+
+	return m
+}
+
+// Send puts letter to the queue. It never blocks
+func (m *Async) Send(msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return ErrClosed
+	}
+
+	m.letters.Add(1)
+	select {
+	case m.queue <- attempt{msg: msg, delay: m.delay}:
+		return nil
+	default:
+		m.letters.Done()
+		return ErrQueueFull
+	}
+}
+
+// Close stops accepting letters and waits until queued ones are sent or given up
+func (m *Async) Close() {
+	m.mu.Lock()
+	closed := m.closed
+	m.closed = true
+	m.mu.Unlock()
+	if closed {
+		return
+	}
+
+	// retries are queued again, so the queue is closed only when no letter is left
+	m.letters.Wait()
+	close(m.queue)
+	m.worker.Wait()
+}
+
+func (m *Async) loop() {
+	defer m.worker.Done()
+	for a := range m.queue {
+		m.send(a)
+	}
+}
+
+// send tries to deliver letter, failed one is queued again after delay.
+// The error is logged when all attempts fail
+func (m *Async) send(a attempt) {
+	err := m.base.Send(a.msg)
+	if err == nil {
+		m.letters.Done()
+		return
+	}
+	if a.tries == m.retries {
+		log.Printf("can't send letter %q to %s: %v", a.msg.Subject, a.msg.To, err)
+		m.letters.Done()
+		return
+	}
+
+	next := attempt{msg: a.msg, tries: a.tries + 1, delay: a.delay * 2}
+	time.AfterFunc(a.delay, func() {
+		m.queue <- next
+	})
+}
@@ -0,0 +1,27 @@
+package mailer
+
+import (
+	"io"
+	"log"
+)
+
+// dumpMailer writes letters to log instead of sending them.
+// It's intended for local development
+type dumpMailer struct {
+	log  *log.Logger
+	from string
+}
+
+// NewDump creates mailer that writes whole MIME letters to w (e.g. os.Stderr or opened file)
+func NewDump(w io.Writer, from string) Mailer {
+	return dumpMailer{log.New(w, "", log.LstdFlags), from}
+}
+
+func (m dumpMailer) Send(msg Message) error {
+	body, err := encode(m.from, msg)
+	if err != nil {
+		return err
+	}
+	m.log.Printf("MAIL TO %s:\n%s\n", msg.To, body)
+	return nil
+}
@@ -0,0 +1,40 @@
+package mailer
+
+import (
+	"sync"
+)
+
+// Fake captures letters instead of sending them, it's intended for tests
+type Fake struct {
+	mu   sync.Mutex
+	sent []Message
+}
+
+func (m *Fake) Send(msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+// Sent returns all captured letters
+func (m *Fake) Sent() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]Message{}, m.sent...)
+}
+
+// Last returns the last letter sent to the recipient, ok is false if there is no one
+func (m *Fake) Last(to string) (msg Message, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := len(m.sent) - 1; i >= 0; i-- {
+		if m.sent[i].To == to {
+			return m.sent[i], true
+		}
+	}
+	return msg, false
+}
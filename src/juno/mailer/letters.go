@@ -0,0 +1,135 @@
+package mailer
+
+import (
+	"bytes"
+	htmltemplate "html/template"
+	texttemplate "text/template"
+)
+
+// Letter data, all fields are optional for templates
+type Letter struct {
+	// Email is the recipient
+	Email string
+	// Link leads user to the action (e.g. confirmation)
+	Link string
+	// Token is the secret that also can be entered manually
+	Token string
+	// What describes the change user is notified about
+	What string
+}
+
+// letter keeps parsed templates of one kind of letter
+type letter struct {
+	subject string
+	text    *texttemplate.Template
+	html    *htmltemplate.Template
+}
+
+func newLetter(subject, text, html string) letter {
+	return letter{
+		subject: subject,
+		text:    texttemplate.Must(texttemplate.New(subject).Parse(text)),
+		html:    htmltemplate.Must(htmltemplate.New(subject).Parse(html)),
+	}
+}
+
+// message executes templates with data
+func (l letter) message(data Letter) (Message, error) {
+	msg := Message{To: data.Email, Subject: l.subject}
+
+	buf := &bytes.Buffer{}
+	if err := l.text.Execute(buf, data); err != nil {
+		return msg, err
+	}
+	msg.Text = buf.String()
+
+	buf.Reset()
+	if err := l.html.Execute(buf, data); err != nil {
+		return msg, err
+	}
+	msg.HTML = buf.String()
+
+	return msg, nil
+}
+
+var (
+	confirmation = newLetter("Confirm your Juno account",
+		`Hello,
+
+please confirm your Juno account by following the link:
+{{.Link}}
+
+The link expires in 48 hours. If you haven't registered, just ignore this letter.
+`,
+		`<p>Hello,</p>
+<p>please confirm your Juno account by following the link:<br>
+<a href="{{.Link}}">{{.Link}}</a></p>
+<p>The link expires in 48 hours. If you haven't registered, just ignore this letter.</p>
+`)
+
+	emailConfirmation = newLetter("Confirm your new Juno email",
+		`Hello,
+
+please confirm that this address should be used as your Juno login by following the link:
+{{.Link}}
+
+The link expires in 48 hours. Until then the previous email stays active.
+If you haven't requested the change, just ignore this letter.
+`,
+		`<p>Hello,</p>
+<p>please confirm that this address should be used as your Juno login by following the link:<br>
+<a href="{{.Link}}">{{.Link}}</a></p>
+<p>The link expires in 48 hours. Until then the previous email stays active.
+If you haven't requested the change, just ignore this letter.</p>
+`)
+
+	passwordReset = newLetter("Reset your Juno password",
+		`Hello,
+
+somebody (hopefully you) has requested password reset. Use the token to set new password:
+{{.Token}}
+{{if .Link}}
+or follow the link:
+{{.Link}}
+{{end}}
+The token expires in 1 hour. If you haven't requested reset, just ignore this letter.
+`,
+		`<p>Hello,</p>
+<p>somebody (hopefully you) has requested password reset. Use the token to set new password:<br>
+<code>{{.Token}}</code></p>
+{{if .Link}}<p>or follow the link: <a href="{{.Link}}">{{.Link}}</a></p>{{end}}
+<p>The token expires in 1 hour. If you haven't requested reset, just ignore this letter.</p>
+`)
+
+	change = newLetter("Your Juno account has been changed",
+		`Hello,
+
+{{.What}}
+
+If it wasn't you, please reset your password.
+`,
+		`<p>Hello,</p>
+<p>{{.What}}</p>
+<p>If it wasn't you, please reset your password.</p>
+`)
+)
+
+// Confirmation builds letter with account confirmation link
+func Confirmation(data Letter) (Message, error) {
+	return confirmation.message(data)
+}
+
+// EmailConfirmation builds letter with link that confirms new email
+func EmailConfirmation(data Letter) (Message, error) {
+	return emailConfirmation.message(data)
+}
+
+// PasswordReset builds letter with password reset token
+func PasswordReset(data Letter) (Message, error) {
+	return passwordReset.message(data)
+}
+
+// Change builds notification about account change
+func Change(data Letter) (Message, error) {
+	return change.message(data)
+}
@@ -0,0 +1,17 @@
+// Package mailer delivers letters to users.
+// Letters are built from templates, Mailer implementations differ in delivery only:
+// SMTP for production, Dump for development, Fake for tests. Async wraps any of them to send in background.
+package mailer
+
+// Message is a letter ready to be sent
+type Message struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Mailer sends letters
+type Mailer interface {
+	Send(msg Message) error
+}
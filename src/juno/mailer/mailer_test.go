@@ -0,0 +1,108 @@
+package mailer
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLetters(t *testing.T) {
+	msg, err := Confirmation(Letter{Email: "a@mail.com", Link: "http://juno/confirm/<tok>"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.To != "a@mail.com" || msg.Subject == "" {
+		t.Fatalf("unexpected message %#v", msg)
+	}
+	if !strings.Contains(msg.Text, "http://juno/confirm/<tok>") {
+		t.Fatalf("text part doesn't contain link: %s", msg.Text)
+	}
+	if strings.Contains(msg.HTML, "<tok>") {
+		t.Fatalf("html part isn't escaped: %s", msg.HTML)
+	}
+}
+
+// flaky fails first n attempts
+type flaky struct {
+	mu    sync.Mutex
+	fails int
+	Fake
+}
+
+func (m *flaky) Send(msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.fails > 0 {
+		m.fails--
+		return errors.New("smtp is down")
+	}
+	return m.Fake.Send(msg)
+}
+
+func TestAsyncRetry(t *testing.T) {
+	base := &flaky{fails: 2}
+	m := NewAsync(base, 10, 3, time.Millisecond)
+
+	if err := m.Send(Message{To: "a@mail.com"}); err != nil {
+		t.Fatal(err)
+	}
+	m.Close()
+
+	if _, ok := base.Last("a@mail.com"); !ok {
+		t.Fatal("letter hasn't been resent")
+	}
+}
+
+func TestAsyncGiveUp(t *testing.T) {
+	base := &flaky{fails: 10}
+	m := NewAsync(base, 10, 1, time.Millisecond)
+
+	m.Send(Message{To: "a@mail.com"})
+	m.Close()
+
+	if len(base.Sent()) != 0 || base.fails != 8 {
+		t.Fatalf("expected 2 attempts, %d left", base.fails)
+	}
+}
+
+// picky fails letters to bad recipient and records order of attempts
+type picky struct {
+	mu       sync.Mutex
+	attempts []string
+}
+
+func (m *picky) Send(msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.attempts = append(m.attempts, msg.To)
+	if msg.To == "bad@mail.com" {
+		return errors.New("mailbox is unavailable")
+	}
+	return nil
+}
+
+func TestAsyncNotBlocked(t *testing.T) {
+	base := &picky{}
+	m := NewAsync(base, 10, 1, 50*time.Millisecond)
+
+	m.Send(Message{To: "bad@mail.com"})
+	m.Send(Message{To: "good@mail.com"})
+	m.Close()
+
+	expected := "bad@mail.com,good@mail.com,bad@mail.com"
+	if got := strings.Join(base.attempts, ","); got != expected {
+		t.Fatalf("expected attempts %s, got %s", expected, got)
+	}
+}
+
+func TestAsyncClosed(t *testing.T) {
+	m := NewAsync(&Fake{}, 10, 1, time.Millisecond)
+	m.Close()
+	m.Close()
+
+	if err := m.Send(Message{To: "a@mail.com"}); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"time"
+)
+
+// smtpMailer sends letters through SMTP server
+type smtpMailer struct {
+	addr string
+	auth smtp.Auth
+	from string
+}
+
+// NewSMTP creates mailer that sends letters through SMTP server at addr (host:port).
+// PLAIN authentication is used if user isn't empty
+func NewSMTP(addr, user, pass, from string) (Mailer, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var auth smtp.Auth
+	if user != "" {
+		auth = smtp.PlainAuth("", user, pass, host)
+	}
+
+	return smtpMailer{addr, auth, from}, nil
+}
+
+func (m smtpMailer) Send(msg Message) error {
+	body, err := encode(m.from, msg)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{msg.To}, body)
+}
+
+// encode builds multipart/alternative MIME message with text and html parts
+func encode(from string, msg Message) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	mw := multipart.NewWriter(buf)
+
+	fmt.Fprintf(buf, "From: %s\r\n", from)
+	fmt.Fprintf(buf, "To: %s\r\n", msg.To)
+	fmt.Fprintf(buf, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(buf, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", mw.Boundary())
+
+	parts := []struct {
+		ct   string
+		body string
+	}{
+		{"text/plain; charset=utf-8", msg.Text},
+		{"text/html; charset=utf-8", msg.HTML},
+	}
+	for _, p := range parts {
+		w, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {p.ct}})
+		if err != nil {
+			return nil, err
+		}
+		if _, err = w.Write([]byte(p.body)); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
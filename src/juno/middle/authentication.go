@@ -3,54 +3,103 @@ package middle
 import (
 	"bytes"
 	"encoding/base64"
+	"errors"
 	"golang.org/x/net/context"
 	"juno/common/check"
 	"juno/common/io"
+	"juno/common/passwd"
+	"juno/common/token"
 	"juno/model"
 	"juno/model/storage"
+	"log"
 	"net/http"
 	"strings"
+	"time"
 )
 
+// ErrCredentials is returned by Credentials if there is no user with such email and password
+var ErrCredentials = errors.New("wrong email or password")
+
+// ErrDisabled is returned by Credentials if credentials are correct, but account is disabled by admin
+var ErrDisabled = errors.New("account is disabled")
+
 // authMW is the Authentication aware router type
 type authMW struct {
-	base ContextRouter
-	stg  storage.Storage
+	base   ContextRouter
+	stg    storage.Storage
+	tokens token.Signer
+	// basic enables Basic authentication as fallback for bearer tokens
+	basic bool
+	// need selects requests that are authenticated, nil selects all of them
+	need func(*http.Request) bool
 }
 
-// Authentication returns router that perform Authentication check before handle requests
-func Authentication(base ContextRouter, stg storage.Storage) ContextRouter {
-	return authMW{base, stg}
+// Authentication returns router that perform Authentication check before handle requests.
+// It accepts bearer access tokens signed by tokens, and Basic credentials if basic is true
+func Authentication(base ContextRouter, stg storage.Storage, tokens token.Signer, basic bool) ContextRouter {
+	return authMW{base, stg, tokens, basic, nil}
+}
+
+// AuthenticationIf returns router that performs Authentication check for requests selected by need,
+// other requests are handled anonymously
+func AuthenticationIf(base ContextRouter, stg storage.Storage, tokens token.Signer, basic bool, need func(*http.Request) bool) ContextRouter {
+	return authMW{base, stg, tokens, basic, need}
 }
 
 // Handle add authorization check middleware before handler call.
 // It stores auth info in context
 func (mw authMW) Handle(method, path string, handler JunoHandler) {
 	authHandler := func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-		const basicPrefix string = "Basic "
+		const (
+			basicPrefix  string = "Basic "
+			bearerPrefix string = "Bearer "
+		)
+
+		if mw.need != nil && !mw.need(r) {
+			handler(ctx, w, r)
+			return
+		}
 
-		// Get the Basic Authentication credentials
 		auth := r.Header.Get("Authorization")
-		if strings.HasPrefix(auth, basicPrefix) {
+
+		// Access token is verified without db round-trip
+		if strings.HasPrefix(auth, bearerPrefix) {
+			claims, err := mw.tokens.Verify(auth[len(bearerPrefix):], time.Now())
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", "Bearer error=\"invalid_token\"")
+				io.Err(w, io.ERR_UNAUTHORIZED, http.StatusUnauthorized)
+				return
+			}
+
+			ctx = model.SetCtxUser(ctx, &model.User{ID: claims.UserID, Roles: model.Roles(claims.Roles)})
+			ctx = model.SetCtxAuth(ctx, model.Auth{Method: model.AUTH_BEARER, SessionID: claims.SessionID})
+			handler(ctx, w, r)
+			return
+		}
+
+		// Get the Basic Authentication credentials
+		if mw.basic && strings.HasPrefix(auth, basicPrefix) {
 			// Check credentials
 			payload, err := base64.StdEncoding.DecodeString(auth[len(basicPrefix):])
 			if err == nil {
 				pair := bytes.SplitN(payload, []byte(":"), 2)
 				if len(pair) == 2 {
-					// look for user in storage.
-					filter := model.Fields{"email": string(pair[0]), "password": string(pair[1])}
-					user, err := mw.stg.UserSearch(ctx, filter)
-
-					if mw.stg.IsErrNotFound(err) {
+					user, err := Credentials(ctx, mw.stg, string(pair[0]), string(pair[1]))
+					if err == ErrCredentials {
 						io.Err(w, io.ERR_FORBIDDEN, http.StatusForbidden)
 						return
 					}
+					if err == ErrDisabled {
+						io.Err(w, io.ERR_DISABLED, http.StatusForbidden)
+						return
+					}
 					if check.DBErr(w, err) {
 						return
 					}
 
 					// put user to context
 					ctx = model.SetCtxUser(ctx, user)
+					ctx = model.SetCtxAuth(ctx, model.Auth{Method: model.AUTH_BASIC})
 
 					// Delegate request to the given handle
 					handler(ctx, w, r)
@@ -59,11 +108,65 @@ func (mw authMW) Handle(method, path string, handler JunoHandler) {
 			}
 		}
 
-		// Request Basic Authentication otherwise
-		w.Header().Set("WWW-Authenticate", "Basic realm=\"Private Area\"")
+		// Request Authentication otherwise
+		w.Header().Add("WWW-Authenticate", "Bearer realm=\"Private Area\"")
+		if mw.basic {
+			w.Header().Add("WWW-Authenticate", "Basic realm=\"Private Area\"")
+		}
 		io.Err(w, io.ERR_UNAUTHORIZED, http.StatusUnauthorized)
 	}
 
 	// configure base router with auth handler
 	mw.base.Handle(method, path, JunoHandler(authHandler))
 }
+
+// Credentials looks for user by email and verifies password.
+// It returns ErrCredentials if user isn't found or password is wrong, ErrDisabled if account is disabled,
+// other errors are storage ones.
+// Legacy or outdated password hash is replaced on success
+func Credentials(ctx context.Context, stg storage.Storage, email, pass string) (*model.User, error) {
+	// requester isn't known yet, so user is looked up on behalf of system
+	ctx = model.SetCtxUser(ctx, model.System())
+
+	// look for user in storage by email only, password hash is verified here.
+	filter := storage.Eq("email", email)
+	user, err := stg.UserSearch(ctx, filter)
+
+	if stg.IsErrNotFound(err) {
+		// spend the same time as for existing user
+		passwd.VerifyDummy(pass)
+		return nil, ErrCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ok, rehash := user.CheckPassword(pass)
+	if !ok {
+		return nil, ErrCredentials
+	}
+	if rehash {
+		rehashPassword(ctx, stg, user, pass)
+	}
+
+	// disabled state is revealed to the owner only
+	if user.Disabled {
+		return nil, ErrDisabled
+	}
+
+	return user, nil
+}
+
+// rehashPassword replaces legacy or outdated password hash.
+// Failure isn't critical for current request, so it's just logged
+func rehashPassword(ctx context.Context, stg storage.Storage, user *model.User, pass string) {
+	if err := user.SetPassword(pass); err != nil {
+		log.Println(err)
+		return
+	}
+
+	fields := model.Fields{"password": user.Password}
+	if _, err := stg.UserSet(ctx, user.ID, fields, nil); err != nil {
+		log.Println(err)
+	}
+}
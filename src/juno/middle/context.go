@@ -47,6 +47,9 @@ func (mw contextMW) Handle(method, path string, handler JunoHandler) {
 		// add Params to context
 		ctx = setCtxParam(ctx, p)
 
+		// origin of the request is recorded in history of changes
+		ctx = model.SetCtxOrigin(ctx, origin(w, r))
+
 		// add anonym user. It might be overrided in authentication mw
 		ctx = model.SetCtxUser(ctx, model.Anonym())
 
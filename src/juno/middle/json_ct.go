@@ -11,7 +11,7 @@ type jsonChecker struct {
 }
 
 // JSONContentType wraps http.handler
-// the Wrapper checks that request Content-Type is equal to "application/json"
+// the Wrapper checks that request Content-Type is "application/json" or JSON based one (e.g. "application/merge-patch+json")
 func JSONContentType(h http.Handler) http.Handler {
 	return jsonChecker{h}
 }
@@ -21,7 +21,7 @@ func (ch jsonChecker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ct := r.Header.Get("Content-Type")
 	switch r.Method {
 	case "POST", "PUT", "PATCH":
-		if strings.Index(ct, "application/json") == -1 {
+		if strings.Index(ct, "application/json") == -1 && strings.Index(ct, "+json") == -1 {
 			// send error as plain text
 			http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
 			return
@@ -0,0 +1,47 @@
+package middle
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"juno/model"
+	"net"
+	"net/http"
+)
+
+// REQUEST_ID_HEADER carries request ID. Client may supply it, otherwise it's generated
+const REQUEST_ID_HEADER = "X-Request-ID"
+
+// limits of client supplied values, longer request ID is replaced, longer user agent is cut
+const (
+	REQUEST_ID_MAX = 64
+	USER_AGENT_MAX = 256
+)
+
+// origin describes client of the request.
+// Request ID is sent back in response header, so client can refer to the request
+func origin(w http.ResponseWriter, r *http.Request) model.Origin {
+	id := r.Header.Get(REQUEST_ID_HEADER)
+	if id == "" || len(id) > REQUEST_ID_MAX {
+		id = requestID()
+	}
+	w.Header().Set(REQUEST_ID_HEADER, id)
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	agent := r.UserAgent()
+	if len(agent) > USER_AGENT_MAX {
+		agent = agent[:USER_AGENT_MAX]
+	}
+
+	return model.Origin{IP: ip, UserAgent: agent, RequestID: id}
+}
+
+// requestID generates random request ID
+func requestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
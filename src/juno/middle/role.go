@@ -0,0 +1,34 @@
+package middle
+
+import (
+	"golang.org/x/net/context"
+	"juno/common/io"
+	"juno/model"
+	"net/http"
+)
+
+// roleMW is the role aware router type
+type roleMW struct {
+	base  ContextRouter
+	roles model.Roles
+}
+
+// Role returns router that permits requests of context user having any of roles.
+// It's intended to be put after Authentication, anonym requests are rejected anyway
+func Role(base ContextRouter, roles model.Roles) ContextRouter {
+	return roleMW{base, roles}
+}
+
+// Handle adds role check before handler call
+func (mw roleMW) Handle(method, path string, handler JunoHandler) {
+	roleHandler := func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		if !model.CtxUser(ctx).AllRoles().Has(mw.roles) {
+			io.Err(w, io.ERR_FORBIDDEN, http.StatusForbidden)
+			return
+		}
+
+		handler(ctx, w, r)
+	}
+
+	mw.base.Handle(method, path, JunoHandler(roleHandler))
+}
@@ -0,0 +1,129 @@
+package model
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+// Checkpoint fixes head of profile history: revision of profile and hash of the last change.
+// Signed checkpoint is kept apart from history, so removed tail of history is detected too
+type Checkpoint struct {
+	Rev  int64
+	Hash string
+	Time time.Time
+	// Sig is HMAC of the checkpoint by server key, it's empty for unsigned head
+	Sig string `json:",omitempty"`
+}
+
+// ChainReport is result of history chain verification
+type ChainReport struct {
+	Valid bool
+	// Length is number of verified changes, Head is the last of them
+	Length int
+	Head   int64
+	// Broken is revision of the first broken link, Problem explains it
+	Broken  int64  `json:",omitempty"`
+	Problem string `json:",omitempty"`
+	// Checkpoint is revision of verified signed checkpoint
+	Checkpoint int64 `json:",omitempty"`
+	// Unsigned is set when key is configured but changed profile has no checkpoint
+	// (history written before the key was set). Such chain is verified by hashes only, removed tail isn't detected
+	Unsigned bool `json:",omitempty"`
+}
+
+// Digest calculates hash of the change of profile chained to hash of the previous one (empty for the first change).
+// Profile ID is hashed too, so chain of one profile doesn't verify for another.
+// Content is encoded as JSON, time is taken with millisecond precision as storage keeps it
+func (c *Change) Digest(profid, prev string) string {
+	data, _ := json.Marshal(struct {
+		ProfID string
+		Prev   string
+		Rev    int64
+		Time   int64
+		Admin  string
+		Actor  string
+		Auth   string
+		Origin Origin
+		Fields map[string]ChangedField
+	}{profid, prev, c.Rev, c.Time.UnixNano() / int64(time.Millisecond), c.Admin, c.Actor, c.Auth, c.Origin, c.Fields})
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Sign sets signature of checkpoint of profile history by key
+func (cp *Checkpoint) Sign(profid string, key []byte) {
+	cp.Sig = hex.EncodeToString(cp.mac(profid, key))
+}
+
+// Verify checks signature of checkpoint of profile history by key
+func (cp *Checkpoint) Verify(profid string, key []byte) bool {
+	sig, err := hex.DecodeString(cp.Sig)
+	return err == nil && hmac.Equal(sig, cp.mac(profid, key))
+}
+
+func (cp *Checkpoint) mac(profid string, key []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(profid + "." + strconv.FormatInt(cp.Rev, 10) + "." + cp.Hash + "." + strconv.FormatInt(cp.Time.Unix(), 10)))
+	return h.Sum(nil)
+}
+
+// VerifyChain walks changes of profile (ordered by revision) and reports the first broken link:
+// missing revision, missing hash or one that doesn't match content, head of profile that isn't reached.
+// Signed checkpoint is verified if key is given, history has to contain the checkpoint revision.
+// Changed profile without checkpoint is reported as valid but unsigned
+func VerifyChain(profid string, changes []*Change, head, checkpoint *Checkpoint, key []byte) *ChainReport {
+	report := &ChainReport{}
+	broken := func(rev int64, problem string) *ChainReport {
+		report.Broken, report.Problem = rev, problem
+		return report
+	}
+
+	prev, rev := "", int64(0)
+	for _, c := range changes {
+		if rev != 0 && c.Rev != rev+1 {
+			return broken(rev+1, "revision "+strconv.FormatInt(rev+1, 10)+" is missing")
+		}
+		if c.Hash == "" {
+			return broken(c.Rev, "change isn't hashed")
+		}
+		if c.Hash != c.Digest(profid, prev) {
+			return broken(c.Rev, "hash doesn't match content or previous change")
+		}
+		prev, rev = c.Hash, c.Rev
+		report.Length++
+		report.Head = rev
+	}
+
+	if head.Hash != prev || (len(changes) > 0 && head.Rev != rev) {
+		return broken(rev+1, "history doesn't reach profile revision "+strconv.FormatInt(head.Rev, 10))
+	}
+
+	if key != nil && checkpoint == nil && head.Rev > 1 {
+		report.Unsigned = true
+	}
+	if checkpoint != nil && key != nil {
+		if !checkpoint.Verify(profid, key) {
+			return broken(checkpoint.Rev, "checkpoint signature is invalid")
+		}
+		// checkpoint of profile without history is satisfied by any history
+		found := checkpoint.Hash == ""
+		for _, c := range changes {
+			if c.Rev == checkpoint.Rev {
+				found = c.Hash == checkpoint.Hash
+				break
+			}
+		}
+		if !found {
+			return broken(checkpoint.Rev, "history doesn't match signed checkpoint")
+		}
+		report.Checkpoint = checkpoint.Rev
+	}
+
+	report.Valid = true
+	return report
+}
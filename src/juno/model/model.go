@@ -1,16 +1,45 @@
 package model
 
 import (
+	"errors"
+	"fmt"
 	"golang.org/x/net/context"
+	"juno/common/diff"
+	"juno/common/passwd"
+	"juno/common/token"
+	"juno/common/valid"
 	"log"
+	"regexp"
+	"strings"
 	"time"
+	"unicode"
 )
 
-const ANONYM_ID = "anonym_id"
+const (
+	ANONYM_ID = "anonym_id"
+	SYSTEM_ID = "system_id"
+)
+
+// Roles is the set of roles encoded as bit string, so finite role array is stored as one integer
+type Roles int64
+
+const (
+	ROLE_ANONYM Roles = 1 << iota
+	ROLE_USER
+	ROLE_ADMIN
+	// ROLE_SYSTEM is granted to BL itself for internal operations (e.g. look up user by credentials)
+	ROLE_SYSTEM
+)
+
+// Has checks if any of roles is in the set
+func (r Roles) Has(roles Roles) bool {
+	return r&roles != 0
+}
 
 // the anonym has prefilled privileges
 var anonym = User{
-	ID: ANONYM_ID,
+	ID:    ANONYM_ID,
+	Roles: ROLE_ANONYM,
 }
 
 // Anonym returns a copy of special anonym user
@@ -19,33 +48,184 @@ func Anonym() *User {
 	return &copyUser
 }
 
+// system user is put in context when BL acts on behalf of itself, not on behalf of requester
+var system = User{
+	ID:    SYSTEM_ID,
+	Roles: ROLE_SYSTEM,
+}
+
+// System returns a copy of special system user
+func System() *User {
+	copyUser := system
+	return &copyUser
+}
+
+// ACL lists roles that are permitted to access stored object.
+// Owner always has access regardless of ACL
+type ACL struct {
+	// Reads are roles that can read public part of object (e.g. profile)
+	Reads Roles
+	// Writes are roles that can modify object and read its private part (e.g. credentials, history)
+	Writes Roles
+}
+
+// DefaultACL makes profile public and permits admins to manage the account
+func DefaultACL() ACL {
+	return ACL{
+		Reads:  ROLE_ANONYM | ROLE_USER | ROLE_ADMIN | ROLE_SYSTEM,
+		Writes: ROLE_ADMIN | ROLE_SYSTEM,
+	}
+}
+
 // Fields represents an arbitrary set of object fields,
-// used mainly in storage calls
+// used as modification in storage calls, filters are built by storage.Query
 type Fields map[string]interface{}
 
 // User represents user object.
-// it contains authentication and identification data (like login, password),
-// it also might contain in future auth tokens, permissions (roles)
+// it contains authentication and identification data (like login, password) and permissions (roles)
 type User struct {
 	// string represent of ID that uses by http requests
 	ID string `bson:"-"`
-	// email is used for confirmation letter (not implemented) and as login
+	// Created is registration time, storage derives it from ID
+	Created time.Time `bson:"-"`
+	// Roles granted to user, ROLE_USER is implied for any registered one
+	Roles Roles
+	// Disabled account can't authenticate, it's disabled by admin
+	Disabled bool
+	// email is used for confirmation letter and as login
 	Email string
-	// Password currently is stored as plain text, even without md5.
-	// in general it should be preserved using some strong crypto algo (e.g. HMAC)
+	// Password keeps salted hash (see passwd package).
+	// Records created before hashing was introduced keep plain text, they are rehashed on login
 	Password string
 
 	Confirm bool
+	// ConfirmToken keeps digest of single-use confirmation token, it's sent to user by email.
+	// digest is kept after confirmation, so used token is distinguishable from unknown one
+	ConfirmToken  string
+	ConfirmExpire time.Time
+	// ResetToken keeps digest of single-use password reset token, it's cleared once password is reset
+	ResetToken  string
+	ResetExpire time.Time
+	// NewEmail is requested login, it replaces Email once confirmed by EmailToken
+	NewEmail    string
+	EmailToken  string
+	EmailExpire time.Time
+}
+
+// lifetime of tokens sent by email
+const (
+	CONFIRM_TTL = 48 * time.Hour
+	RESET_TTL   = time.Hour
+	EMAIL_TTL   = 48 * time.Hour
+)
+
+// AllRoles returns granted roles together with implied ones
+func (u *User) AllRoles() Roles {
+	if u.ID == ANONYM_ID || u.ID == SYSTEM_ID {
+		return u.Roles
+	}
+	return u.Roles | ROLE_USER
+}
+
+// userFields declares validation rules of User input fields
+var userFields = []valid.Field{
+	valid.Declare("Email", valid.Required, valid.Length(3, 254), valid.Email),
+	valid.Declare("Password", valid.Required, valid.Length(8, 128)),
+}
+
+// Validate checks user fields (only listed ones if any) and returns valid.Errors if some of them are invalid
+func (u *User) Validate(only ...string) error {
+	return valid.Struct(u, userFields, only...)
+}
+
+// UserQuery selects users for administration, zero fields aren't applied.
+// Users are ordered by registration time
+type UserQuery struct {
+	Confirm     *bool
+	Disabled    *bool
+	CreatedFrom time.Time
+	CreatedTo   time.Time
+	// Email is case insensitive substring of email
+	Email  string
+	Offset int
+	Limit  int
+}
+
+// Match checks user against query. It's used by storages that can't translate query to own language
+func (q *UserQuery) Match(u *User) bool {
+	if q.Confirm != nil && *q.Confirm != u.Confirm {
+		return false
+	}
+	if q.Disabled != nil && *q.Disabled != u.Disabled {
+		return false
+	}
+	if !q.CreatedFrom.IsZero() && u.Created.Before(q.CreatedFrom) {
+		return false
+	}
+	if !q.CreatedTo.IsZero() && !u.Created.Before(q.CreatedTo) {
+		return false
+	}
+	return strings.Contains(strings.ToLower(u.Email), strings.ToLower(q.Email))
+}
+
+// NewConfirmToken generates confirmation token, keeps its digest and returns token itself
+func (u *User) NewConfirmToken() (string, error) {
+	confirmToken, err := token.Random()
+	if err != nil {
+		return "", err
+	}
+
+	u.ConfirmToken = token.Digest(confirmToken)
+	u.ConfirmExpire = time.Now().Add(CONFIRM_TTL)
+	return confirmToken, nil
+}
+
+// NewResetToken generates password reset token, keeps its digest and returns token itself
+func (u *User) NewResetToken() (string, error) {
+	resetToken, err := token.Random()
+	if err != nil {
+		return "", err
+	}
+
+	u.ResetToken = token.Digest(resetToken)
+	u.ResetExpire = time.Now().Add(RESET_TTL)
+	return resetToken, nil
+}
+
+// NewEmailToken generates token that confirms NewEmail, keeps its digest and returns token itself
+func (u *User) NewEmailToken() (string, error) {
+	emailToken, err := token.Random()
+	if err != nil {
+		return "", err
+	}
+
+	u.EmailToken = token.Digest(emailToken)
+	u.EmailExpire = time.Now().Add(EMAIL_TTL)
+	return emailToken, nil
+}
+
+// SetPassword replaces password by its hash
+func (u *User) SetPassword(plain string) error {
+	hash, err := passwd.Hash(plain)
+	if err != nil {
+		return err
+	}
+	u.Password = hash
+	return nil
 }
 
-func (u *User) Validate() string {
-	// todo:
-	return ""
+// CheckPassword verifies password in constant time.
+// rehash is true when stored password is legacy or outdated and has to be replaced by SetPassword
+func (u *User) CheckPassword(plain string) (ok, rehash bool) {
+	return passwd.Verify(u.Password, plain)
 }
 
 // Profile represnts editable user profile data
 type Profile struct {
-	ID        string `bson:"-"`
+	ID string `bson:"-" diff:"-"`
+	// Rev is revision of profile, it's incremented by each update starting from 1.
+	// It's sent as ETag header, so it isn't part of body
+	Rev       int64 `bson:"-" json:"-" diff:"-"`
 	FirstName string
 	LastName  string
 	Address   string
@@ -53,33 +233,228 @@ type Profile struct {
 	Age       int
 }
 
-func (p *Profile) Validate() string {
-	// todo:
-	return ""
+const (
+	nameChars    = `\p{L}\p{M} .'\-`
+	addressChars = `\p{L}\p{M}\p{N} .,'#/\-`
+)
+
+var phoneRe = regexp.MustCompile(`^\+?[0-9][0-9 ()\-]{3,19}$`)
+
+// profileFields declares validation rules of Profile fields.
+// All fields are optional, HTML special characters are rejected
+var profileFields = []valid.Field{
+	valid.Declare("FirstName", valid.Length(1, 50), valid.Chars(nameChars, "letters, spaces, dots, apostrophes and hyphens")),
+	valid.Declare("LastName", valid.Length(1, 50), valid.Chars(nameChars, "letters, spaces, dots, apostrophes and hyphens")),
+	valid.Declare("Address", valid.Length(1, 200), valid.Chars(addressChars, "letters, digits, spaces and .,'#/-")),
+	valid.Declare("Phone", valid.Match(phoneRe, "phone number like +1-212-674-4300")),
+	valid.Declare("Age", valid.Range(0, 150)),
 }
 
-// Substract calculates difference between current and next profile version
-// And returns change object
-func (p *Profile) Substract(next *Profile) Change {
-	change := Change{Time: time.Now()}
+// Validate checks profile fields (only listed ones if any) and returns valid.Errors if some of them are invalid
+func (p *Profile) Validate(only ...string) error {
+	return valid.Struct(p, profileFields, only...)
+}
+
+// Field returns value of profile field by its path (see diff package), it's nil for unknown or missing one
+func (p *Profile) Field(path string) interface{} {
+	val, _, _ := diff.Get(p, path)
+	return val
+}
+
+// ProfileFields returns names of profile fields kept in history, paths of changed fields start with them
+func ProfileFields() []string {
+	return diff.Names(&Profile{})
+}
+
+// SortKey orders profiles by field, fields available for sorting are FirstName, LastName and Age
+type SortKey struct {
+	Field string
+	Desc  bool
+}
+
+// ProfileQuery selects profiles, zero fields aren't applied.
+// Profiles are ordered by Sort keys and then by ID, so the order is total and pages don't overlap
+type ProfileQuery struct {
+	// FirstName and LastName are case insensitive prefixes
+	FirstName string
+	LastName  string
+	// AgeFrom and AgeTo are inclusive bounds
+	AgeFrom *int
+	AgeTo   *int
+	// Phone and Address are case insensitive substrings
+	Phone   string
+	Address string
+	Sort    []SortKey
+	// After is position of the last profile of previous page, only following profiles are selected
+	After *ProfileCursor
+	Limit int
+}
+
+// ProfileCursor is position of profile in query order: values of sort fields and ID
+type ProfileCursor struct {
+	Values []interface{}
+	ID     string
+}
 
-	// calulate each field manualy
-	// todo: for large object use reflection
-	fields := make(map[string]ChangedField, 5)
-	if p.FirstName != next.FirstName {
-		fields["FirstName"] = ChangedField{p.FirstName, next.FirstName}
+// Cursor returns position of profile in query order
+func (q *ProfileQuery) Cursor(p *Profile) *ProfileCursor {
+	cursor := &ProfileCursor{ID: p.ID}
+	for _, key := range q.Sort {
+		cursor.Values = append(cursor.Values, p.Field(key.Field))
 	}
-	if p.LastName != next.LastName {
-		fields["LastName"] = ChangedField{p.LastName, next.LastName}
+	return cursor
+}
+
+// Match checks profile against query. It's used by storages that can't translate query to own language
+func (q *ProfileQuery) Match(p *Profile) bool {
+	if !hasPrefixFold(p.FirstName, q.FirstName) || !hasPrefixFold(p.LastName, q.LastName) {
+		return false
 	}
-	if p.Address != next.Address {
-		fields["Address"] = ChangedField{p.Address, next.Address}
+	if q.AgeFrom != nil && p.Age < *q.AgeFrom {
+		return false
 	}
-	if p.Phone != next.Phone {
-		fields["Phone"] = ChangedField{p.Phone, next.Phone}
+	if q.AgeTo != nil && p.Age > *q.AgeTo {
+		return false
 	}
-	if p.Age != next.Age {
-		fields["Age"] = ChangedField{p.Age, next.Age}
+	if !containsFold(p.Phone, q.Phone) || !containsFold(p.Address, q.Address) {
+		return false
+	}
+	return q.After == nil || q.compare(p, q.After) > 0
+}
+
+// Less reports whether profile a precedes b in query order
+func (q *ProfileQuery) Less(a, b *Profile) bool {
+	return q.compare(a, q.Cursor(b)) < 0
+}
+
+// compare returns negative number if profile precedes cursor, positive if follows and 0 if it's at cursor
+func (q *ProfileQuery) compare(p *Profile, cursor *ProfileCursor) int {
+	for i, key := range q.Sort {
+		cmp := 0
+		switch v := p.Field(key.Field).(type) {
+		case string:
+			cmp = strings.Compare(v, cursor.Values[i].(string))
+		case int:
+			cmp = v - cursor.Values[i].(int)
+		}
+		if key.Desc {
+			cmp = -cmp
+		}
+		if cmp != 0 {
+			return cmp
+		}
+	}
+	return strings.Compare(p.ID, cursor.ID)
+}
+
+// TextWeights are profile fields searched by text with their significance.
+// Contacts (phone) and age are kept out of text search, so they can't be probed by it
+var TextWeights = map[string]int{
+	"FirstName": 2,
+	"LastName":  2,
+	"Address":   1,
+}
+
+// TextQuery selects profiles containing any of terms in text fields, profiles are ordered by relevance
+type TextQuery struct {
+	// Terms are tokens of search text (see Tokenize)
+	Terms  []string
+	Offset int
+	Limit  int
+}
+
+// TextHit is profile found by text with relevance score and matched fields.
+// Highlights keep matched fields with terms wrapped by <em></em> (field values never contain HTML special characters),
+// they are filled by BL, storage finds and scores profiles only
+type TextHit struct {
+	Profile    *Profile
+	Score      float64
+	Highlights map[string]string
+}
+
+// Tokenize splits text to lower case words, so text is indexed and searched the same way by any storage
+func Tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), notWordRune)
+}
+
+func notWordRune(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+}
+
+// TextScore calculates relevance of profile: weighted number of field words that are equal to any of terms
+func (p *Profile) TextScore(terms []string) float64 {
+	score := 0.0
+	for field, weight := range TextWeights {
+		for _, token := range Tokenize(p.Field(field).(string)) {
+			if hasTerm(terms, token) {
+				score += float64(weight)
+			}
+		}
+	}
+	return score
+}
+
+// Highlight returns text fields containing any of terms, terms are wrapped by <em></em>
+func (p *Profile) Highlight(terms []string) map[string]string {
+	highlights := map[string]string{}
+	for field := range TextWeights {
+		text := p.Field(field).(string)
+		out, matched := []rune{}, false
+
+		runes := []rune(text)
+		for i := 0; i < len(runes); {
+			if notWordRune(runes[i]) {
+				out = append(out, runes[i])
+				i++
+				continue
+			}
+			j := i
+			for j < len(runes) && !notWordRune(runes[j]) {
+				j++
+			}
+			word := runes[i:j]
+			if hasTerm(terms, strings.ToLower(string(word))) {
+				out = append(append(append(out, []rune("<em>")...), word...), []rune("</em>")...)
+				matched = true
+			} else {
+				out = append(out, word...)
+			}
+			i = j
+		}
+
+		if matched {
+			highlights[field] = string(out)
+		}
+	}
+	return highlights
+}
+
+func hasTerm(terms []string, token string) bool {
+	for _, term := range terms {
+		if term == token {
+			return true
+		}
+	}
+	return false
+}
+
+func hasPrefixFold(s, prefix string) bool {
+	return strings.HasPrefix(strings.ToLower(s), strings.ToLower(prefix))
+}
+
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+// Substract calculates difference between current and next profile version
+// And returns change object. Fields are compared by diff package, so nested values are addressed by path
+func (p *Profile) Substract(next *Profile) Change {
+	change := Change{Time: time.Now()}
+
+	changes := diff.Compare(p, next)
+	fields := make(map[string]ChangedField, len(changes))
+	for path, c := range changes {
+		fields[path] = ChangedField{Previous: c.Previous, Current: c.Current}
 	}
 
 	change.Fields = fields
@@ -89,8 +464,19 @@ func (p *Profile) Substract(next *Profile) Change {
 // Change represents one history change of profile.
 // It contains previous and current value for each changed prfofile field.
 type Change struct {
-	Time   time.Time
-	Fields map[string]ChangedField
+	// Rev is profile revision produced by the change, it's used as history cursor
+	Rev  int64 `bson:"-"`
+	Time time.Time
+	// Admin is ID of admin who changed foreign profile, it's empty for changes made by owner
+	Admin string `json:",omitempty"`
+	// Actor is ID of user who made the change, Auth is method the actor has been authenticated by
+	Actor  string
+	Auth   string `json:",omitempty"`
+	Origin `bson:",inline"`
+	// Fields are keyed by path of changed field (see diff package), storage keeps them as it can
+	Fields map[string]ChangedField `bson:"-"`
+	// Hash is digest of the change and hash of the previous one, so history is chained (see Digest)
+	Hash string `bson:",omitempty" json:",omitempty"`
 }
 
 // ChangedField represents changed field preserved in history.
@@ -100,10 +486,212 @@ type ChangedField struct {
 	Current  interface{}
 }
 
+// Paths returns paths of changed fields in order, so fields of the same item follow each other
+// and items are ordered by index ("Addresses[2]" goes before "Addresses[10]")
+func (c *Change) Paths() []string {
+	paths := make([]string, 0, len(c.Fields))
+	for path := range c.Fields {
+		paths = append(paths, path)
+	}
+	diff.SortPaths(paths)
+	return paths
+}
+
+// HistoryQuery selects page of profile history.
+// Zero Since and Until aren't applied, empty Fields select changes of any field
+type HistoryQuery struct {
+	// Since (inclusive) and Until (exclusive) bound change time
+	Since, Until time.Time
+	// Fields selects changes of any of listed profile fields
+	Fields []string
+	// Desc orders changes newest first
+	Desc bool
+	// Actor selects changes made by the user, Auth made with the authentication method,
+	// IP and RequestID made by the client request
+	Actor     string
+	Auth      string
+	IP        string
+	RequestID string
+	// After is revision the page starts after (in query order), zero starts from the beginning
+	After int64
+	Limit int
+}
+
+// Match checks if change is selected by query
+func (q *HistoryQuery) Match(c *Change) bool {
+	if !q.Since.IsZero() && c.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !c.Time.Before(q.Until) {
+		return false
+	}
+	if q.After != 0 && (q.Desc && c.Rev >= q.After || !q.Desc && c.Rev <= q.After) {
+		return false
+	}
+	if q.Actor != "" && c.Actor != q.Actor || q.Auth != "" && c.Auth != q.Auth {
+		return false
+	}
+	if q.IP != "" && c.IP != q.IP || q.RequestID != "" && c.RequestID != q.RequestID {
+		return false
+	}
+	if len(q.Fields) == 0 {
+		return true
+	}
+	for _, field := range q.Fields {
+		for path := range c.Fields {
+			if diff.Root(path) == field {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ErrReplay is returned if change can't be applied to profile: unknown field path or value of wrong type
+var ErrReplay = errors.New("change can't be replayed")
+
+// SetField sets value of profile field addressed by path as Substract records it, nil removes item of the field.
+// Stored history may keep numbers as any numeric type, so they are converted
+func (p *Profile) SetField(path string, val interface{}) error {
+	if err := diff.Set(p, path, val); err != nil {
+		return ErrReplay
+	}
+	return nil
+}
+
+// Apply sets changed fields to their current values and moves profile to revision of the change.
+// Paths are applied in order, so replay is deterministic
+func (p *Profile) Apply(c *Change) error {
+	for _, path := range c.Paths() {
+		if err := p.SetField(path, c.Fields[path].Current); err != nil {
+			return err
+		}
+	}
+	p.Rev = c.Rev
+	return nil
+}
+
+// Replay rebuilds profile by applying changes (ordered by revision) to the empty first revision
+func Replay(profid string, changes []*Change) (*Profile, error) {
+	profile := &Profile{ID: profid, Rev: 1}
+	for _, c := range changes {
+		if err := profile.Apply(c); err != nil {
+			return nil, err
+		}
+	}
+	return profile, nil
+}
+
+// HistoryReport is result of history consistency check
+type HistoryReport struct {
+	Consistent bool
+	// Rev is stored revision of profile, Replayed is revision reproduced by history
+	Rev      int64
+	Replayed int64
+	Problems []string `json:",omitempty"`
+}
+
+// CheckHistory verifies that replaying changes (ordered by revision) reproduces stored profile:
+// revisions follow each other, previous values match replayed ones and the result is equal to profile
+func CheckHistory(profile *Profile, changes []*Change) *HistoryReport {
+	report := &HistoryReport{Rev: profile.Rev}
+	replayed := &Profile{ID: profile.ID, Rev: 1}
+
+	for _, c := range changes {
+		if c.Rev != replayed.Rev+1 {
+			report.Problems = append(report.Problems, fmt.Sprintf("revision %d follows %d", c.Rev, replayed.Rev))
+		}
+		for _, path := range c.Paths() {
+			prev := c.Fields[path].Previous
+			if equal, err := diff.Equal(replayed, path, prev); err == nil && !equal {
+				msg := fmt.Sprintf("revision %d: previous %s %#v, replayed %#v", c.Rev, path, prev, replayed.Field(path))
+				report.Problems = append(report.Problems, msg)
+			}
+		}
+		if err := replayed.Apply(c); err != nil {
+			report.Problems = append(report.Problems, fmt.Sprintf("revision %d: %v", c.Rev, err))
+			replayed.Rev = c.Rev
+		}
+	}
+
+	report.Replayed = replayed.Rev
+	if replayed.Rev != profile.Rev {
+		report.Problems = append(report.Problems, fmt.Sprintf("stored revision %d, replayed %d", profile.Rev, replayed.Rev))
+	}
+	differs := replayed.Substract(profile)
+	for _, path := range differs.Paths() {
+		report.Problems = append(report.Problems, fmt.Sprintf("stored %s %#v, replayed %#v", path, profile.Field(path), replayed.Field(path)))
+	}
+
+	report.Consistent = len(report.Problems) == 0
+	return report
+}
+
+// audit actions
+const (
+	AUDIT_EMAIL_REQUEST = "email_change_requested"
+	AUDIT_EMAIL_CHANGE  = "email_changed"
+	AUDIT_ADMIN_CONFIRM = "confirmed_by_admin"
+	AUDIT_ADMIN_DISABLE = "disabled_by_admin"
+	AUDIT_ADMIN_ENABLE  = "enabled_by_admin"
+	AUDIT_ADMIN_DELETE  = "deleted_by_admin"
+)
+
+// AuditRecord represents security sensitive change of user account (e.g. login change).
+// Records are never modified or removed
+type AuditRecord struct {
+	ID     string `bson:"-"`
+	UserID string
+	Time   time.Time
+	Action string
+	// Admin is ID of admin who made the change on behalf of user
+	Admin string `json:",omitempty"`
+	// Previous and Current values of changed attribute
+	Previous interface{}
+	Current  interface{}
+}
+
+// Session represents issued refresh token.
+// Access tokens are stateless and aren't stored, they are bound to session by ID
+type Session struct {
+	ID     string `bson:"-"`
+	UserID string
+	// Refresh keeps digest of refresh token, token itself is known only by client
+	Refresh string
+	Expire  time.Time
+}
+
+// authentication methods
+const (
+	AUTH_NONE   = "none"
+	AUTH_BASIC  = "basic"
+	AUTH_BEARER = "bearer"
+)
+
+// Auth describes how context user has been authenticated
+type Auth struct {
+	Method string
+	// SessionID is set for bearer authentication only
+	SessionID string
+}
+
+// Origin describes request that makes changes, it's recorded in history
+type Origin struct {
+	IP        string `json:",omitempty"`
+	UserAgent string `json:",omitempty"`
+	RequestID string `json:",omitempty"`
+	// Reason is free text explanation of the change supplied by client
+	Reason string `json:",omitempty"`
+}
+
 // To avoid key collisions in context we defines an unexported type key
 type ctxKey int
 
-var userKey ctxKey = 0
+var (
+	userKey   ctxKey = 0
+	authKey   ctxKey = 1
+	originKey ctxKey = 2
+)
 
 // setCtxUser adds user object to conext
 func SetCtxUser(ctx context.Context, user *User) context.Context {
@@ -119,3 +707,28 @@ func CtxUser(ctx context.Context) *User {
 	}
 	return user
 }
+
+// SetCtxAuth adds authentication info to context
+func SetCtxAuth(ctx context.Context, auth Auth) context.Context {
+	return context.WithValue(ctx, authKey, auth)
+}
+
+// CtxAuth returns authentication info from context, anonymous requests have AUTH_NONE method
+func CtxAuth(ctx context.Context) Auth {
+	auth, ok := ctx.Value(authKey).(Auth)
+	if !ok {
+		auth = Auth{Method: AUTH_NONE}
+	}
+	return auth
+}
+
+// SetCtxOrigin adds request origin to context
+func SetCtxOrigin(ctx context.Context, origin Origin) context.Context {
+	return context.WithValue(ctx, originKey, origin)
+}
+
+// CtxOrigin returns request origin from context, it's empty for internal operations
+func CtxOrigin(ctx context.Context) Origin {
+	origin, _ := ctx.Value(originKey).(Origin)
+	return origin
+}
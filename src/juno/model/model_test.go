@@ -0,0 +1,182 @@
+package model
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSubstract(t *testing.T) {
+	prev := &Profile{ID: "id", Rev: 1, FirstName: "John", Age: 30}
+	next := &Profile{ID: "other", Rev: 2, FirstName: "John", LastName: "Smith", Age: 31}
+
+	fields := prev.Substract(next).Fields
+	expected := map[string]ChangedField{"LastName": {"", "Smith"}, "Age": {30, 31}}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Fatalf("expected %v, got %v", expected, fields)
+	}
+}
+
+func TestApply(t *testing.T) {
+	profile := &Profile{ID: "id", Rev: 1}
+	change := &Change{Rev: 2, Fields: map[string]ChangedField{"FirstName": {"", "John"}, "Age": {0, float64(30)}}}
+	if err := profile.Apply(change); err != nil || profile.FirstName != "John" || profile.Age != 30 || profile.Rev != 2 {
+		t.Fatalf("unexpected profile %#v: %v", profile, err)
+	}
+
+	// paths are resolved by the same rules as Substract records them, unknown ones aren't replayed
+	for _, path := range []string{"Addresses[1].City", "FirstName.First", "ID", "Rev", "Age[0]"} {
+		change := &Change{Rev: 3, Fields: map[string]ChangedField{path: {nil, "x"}}}
+		if err := profile.Apply(change); err != ErrReplay {
+			t.Fatalf("%s: expected ErrReplay, got %v", path, err)
+		}
+	}
+
+	query := &HistoryQuery{Fields: []string{"Address"}}
+	if !query.Match(&Change{Fields: map[string]ChangedField{"Address": {}}}) || query.Match(&Change{Fields: map[string]ChangedField{"AddressLine": {}}}) {
+		t.Fatal("field filter doesn't match path by its root")
+	}
+}
+
+func TestReplay(t *testing.T) {
+	changes := []*Change{
+		{Rev: 2, Fields: map[string]ChangedField{"FirstName": {"", "John"}, "Age": {0, int64(30)}}},
+		{Rev: 3, Fields: map[string]ChangedField{"FirstName": {"John", "Will"}, "Age": {30, float64(31)}}},
+	}
+
+	profile, err := Replay("id", changes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.FirstName != "Will" || profile.Age != 31 || profile.Rev != 3 {
+		t.Fatalf("unexpected profile %#v", profile)
+	}
+
+	report := CheckHistory(&Profile{ID: "id", Rev: 3, FirstName: "Will", Age: 31}, changes)
+	if !report.Consistent || report.Replayed != 3 {
+		t.Fatalf("unexpected report %#v", report)
+	}
+
+	bad := []*Change{{Rev: 2, Fields: map[string]ChangedField{"Age": {0, "old"}}}}
+	if _, err := Replay("id", bad); err != ErrReplay {
+		t.Fatalf("expected ErrReplay, got %v", err)
+	}
+}
+
+func TestCheckHistory(t *testing.T) {
+	changes := []*Change{
+		{Rev: 2, Fields: map[string]ChangedField{"FirstName": {"", "John"}}},
+		{Rev: 4, Fields: map[string]ChangedField{"FirstName": {"Bob", "Will"}}},
+	}
+
+	report := CheckHistory(&Profile{ID: "id", Rev: 5, FirstName: "Will", Phone: "+1"}, changes)
+	if report.Consistent || report.Rev != 5 || report.Replayed != 4 {
+		t.Fatalf("unexpected report %#v", report)
+	}
+
+	expected := []string{"revision 4 follows 2", "previous FirstName", "stored revision 5", "stored Phone"}
+	if len(report.Problems) != len(expected) {
+		t.Fatalf("expected %d problems, got %v", len(expected), report.Problems)
+	}
+	for i, problem := range report.Problems {
+		if !strings.Contains(problem, expected[i]) {
+			t.Fatalf("expected problem %q, got %q", expected[i], problem)
+		}
+	}
+}
+
+func TestVerifyChain(t *testing.T) {
+	key := []byte("key")
+	chain := func() ([]*Change, *Checkpoint) {
+		changes := []*Change{}
+		prev := ""
+		for i, name := range []string{"John", "Will", "Bob"} {
+			c := &Change{Rev: int64(i + 2), Time: time.Unix(int64(i), 0), Actor: "id", Fields: map[string]ChangedField{"FirstName": {Previous: "", Current: name}}}
+			c.Hash = c.Digest("id", prev)
+			prev = c.Hash
+			changes = append(changes, c)
+		}
+		return changes, &Checkpoint{Rev: 4, Hash: prev}
+	}
+
+	changes, head := chain()
+	checkpoint := *head
+	checkpoint.Sign("id", key)
+
+	report := VerifyChain("id", changes, head, &checkpoint, key)
+	if !report.Valid || report.Length != 3 || report.Head != 4 || report.Checkpoint != 4 {
+		t.Fatalf("unexpected report %#v", report)
+	}
+
+	// chain and checkpoint of one profile don't verify for another
+	if report := VerifyChain("other", changes, head, &checkpoint, key); report.Valid || report.Broken != 2 {
+		t.Fatalf("chain of copied history: unexpected report %#v", report)
+	}
+	if checkpoint.Verify("other", key) {
+		t.Fatal("checkpoint of copied history is valid")
+	}
+
+	// profile without changes needs no checkpoint
+	if report := VerifyChain("id", nil, &Checkpoint{Rev: 1}, nil, key); !report.Valid {
+		t.Fatalf("new profile: unexpected report %#v", report)
+	}
+
+	// history written before the key was set is verified by hashes, but it's reported as unsigned
+	if report := VerifyChain("id", changes, head, nil, key); !report.Valid || !report.Unsigned || report.Checkpoint != 0 {
+		t.Fatalf("unsigned history: unexpected report %#v", report)
+	}
+	if report := VerifyChain("id", changes[1:], head, nil, key); report.Valid || report.Broken != 3 {
+		t.Fatalf("unsigned history without first change: unexpected report %#v", report)
+	}
+	if report.Unsigned {
+		t.Fatalf("signed history is reported as unsigned %#v", report)
+	}
+
+	cases := []struct {
+		name   string
+		tamper func([]*Change, *Checkpoint, *Checkpoint) []*Change
+		broken int64
+	}{
+		{"edited field", func(c []*Change, h, cp *Checkpoint) []*Change {
+			c[1].Fields["FirstName"] = ChangedField{Previous: "", Current: "Eve"}
+			return c
+		}, 3},
+		{"edited actor", func(c []*Change, h, cp *Checkpoint) []*Change {
+			c[0].Actor = "admin"
+			return c
+		}, 2},
+		{"removed change", func(c []*Change, h, cp *Checkpoint) []*Change {
+			return append(c[:1], c[2:]...)
+		}, 3},
+		{"removed first change", func(c []*Change, h, cp *Checkpoint) []*Change {
+			return c[1:]
+		}, 3},
+		{"removed tail", func(c []*Change, h, cp *Checkpoint) []*Change {
+			return c[:2]
+		}, 4},
+		{"removed tail and head", func(c []*Change, h, cp *Checkpoint) []*Change {
+			h.Rev, h.Hash = 3, c[1].Hash
+			return c[:2]
+		}, 4},
+		{"forged checkpoint", func(c []*Change, h, cp *Checkpoint) []*Change {
+			cp.Rev, cp.Hash = 3, c[1].Hash
+			return c
+		}, 3},
+		{"removed hash", func(c []*Change, h, cp *Checkpoint) []*Change {
+			c[1].Hash = ""
+			return c
+		}, 3},
+	}
+	for _, c := range cases {
+		changes, head := chain()
+		checkpoint := *head
+		checkpoint.Sign("id", key)
+
+		changes = c.tamper(changes, head, &checkpoint)
+		report := VerifyChain("id", changes, head, &checkpoint, key)
+		if report.Valid || report.Broken != c.broken {
+			t.Fatalf("%s: expected broken revision %d, got %#v", c.name, c.broken, report)
+		}
+	}
+}
@@ -0,0 +1,978 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/net/context"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"juno/model"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrMemDup is returned by in-memory storage when unique constraint (e.g. email) is violated
+var ErrMemDup = errors.New("duplicate key")
+
+type memStg struct {
+	// single lock protects whole storage, it's enough for tests and local development
+	mu sync.RWMutex
+	// users, profiles and changes keep the same documents as mongo collections do
+	users    map[bson.ObjectId]*UserDB
+	profiles map[bson.ObjectId]*ProfileDB
+	// changes are only appended
+	changes []*ChangeDB
+	// order preserves insertion order of users and their profiles, so search results are stable
+	order []bson.ObjectId
+	// sessions keeps the same documents as mongo "sessions" collection does
+	sessions map[bson.ObjectId]*SessionDB
+	// audit keeps records in insertion order
+	audit []*AuditDB
+	// text is inverted index of profile words, it emulates mongo text index
+	text map[string]map[bson.ObjectId]bool
+}
+
+// MemNew creates in-memory storage.
+// It requires no infrastructure, data are lost when process exits.
+func MemNew() Storage {
+	return &memStg{
+		users:    map[bson.ObjectId]*UserDB{},
+		profiles: map[bson.ObjectId]*ProfileDB{},
+		sessions: map[bson.ObjectId]*SessionDB{},
+		text:     map[string]map[bson.ObjectId]bool{},
+	}
+}
+
+// Close does nothing, there is no connection to shutdown
+func (s *memStg) Close() {}
+
+// IsErrNotFound uses the same error as mongo storage, so permission helpers are shared by both backends
+func (s *memStg) IsErrNotFound(err error) bool {
+	return err == mgo.ErrNotFound
+}
+func (s *memStg) IsErrDup(err error) bool {
+	return err == ErrMemDup
+}
+func (s *memStg) IsErrConflict(err error) bool {
+	return err == ErrConflict
+}
+
+// Reserve has nothing to reserve, it returns context as is
+func (s *memStg) Reserve(ctx context.Context) (context.Context, ReleaseFunc) {
+	return ctx, func() {}
+}
+
+// ###################### User CRUD Section #########################
+
+func (s *memStg) UserSearch(ctx context.Context, filter *Query) (*model.User, error) {
+	cond, err := filter.filter()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	user, err := s.findUser(permit(ctx, cond, WRITES))
+	if err != nil {
+		return (&UserDB{}).Model(), err
+	}
+	return user.Model(), nil
+}
+
+// UserInsert creates new user with default ACL and empty profile. it overrides ID if any
+func (s *memStg) UserInsert(ctx context.Context, userm *model.User) (*model.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user := &UserDB{
+		ID:   bson.NewObjectId(),
+		User: *userm,
+		ACL:  model.DefaultACL(),
+	}
+	if !privileged(ctx) {
+		user.Roles &= model.ROLE_USER
+	}
+
+	// emulate unique index on email
+	if _, err := s.findUser(bson.M{"email": user.Email}); err == nil {
+		return user.Model(), ErrMemDup
+	}
+
+	s.users[user.ID] = user
+	s.profiles[user.ID] = &ProfileDB{ID: user.ID, Rev: 1, Confirm: user.Confirm, ACL: user.ACL}
+	s.order = append(s.order, user.ID)
+
+	copyUser := *user
+	return copyUser.Model(), nil
+}
+
+func (s *memStg) UserGet(ctx context.Context, userid string) (*model.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	user, err := s.getUser(userid, permit(ctx, nil, WRITES))
+	if err != nil {
+		return (&UserDB{}).Model(), err
+	}
+	return user.Model(), nil
+}
+
+// UserSet gets user applying optional filter and modifies the object
+func (s *memStg) UserSet(ctx context.Context, userid string, fields model.Fields, filter *Query) (*model.User, error) {
+	if err := protect(ctx, fields); err != nil {
+		return nil, err
+	}
+	cond, err := filter.filter()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	oid, err := toObjectId(userid)
+	if err != nil {
+		return nil, err
+	}
+	user, ok := s.users[oid]
+	if !ok {
+		return nil, mgo.ErrNotFound
+	}
+
+	next := &UserDB{}
+	if err := setFields(user, permit(ctx, cond, WRITES), bson.M(fields), next); err != nil {
+		return nil, err
+	}
+
+	// email has to stay unique after modification
+	if next.Email != user.Email {
+		if _, err := s.findUser(bson.M{"email": next.Email}); err == nil {
+			return nil, ErrMemDup
+		}
+	}
+
+	// profile follows confirmation and permissions of the user
+	if copied := profileCopy(fields); len(copied) > 0 {
+		nextProf := &ProfileDB{}
+		if err := setFields(s.profiles[oid], nil, copied, nextProf); err != nil {
+			return nil, err
+		}
+		s.profiles[oid] = nextProf
+	}
+
+	s.users[oid] = next
+	copyUser := *next
+	return copyUser.Model(), nil
+}
+
+// UserList selects users by query on behalf of context user. It limits result (to 1k) as mongo storage does.
+func (s *memStg) UserList(ctx context.Context, query *model.UserQuery) ([]*model.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	udbs, err := s.findUsers(permit(ctx, nil, WRITES), -1)
+	if err != nil {
+		return nil, err
+	}
+
+	users := []*model.User{}
+	skip := query.Offset
+	for _, udb := range udbs {
+		user := udb.Model()
+		if !query.Match(user) {
+			continue
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
+		users = append(users, user)
+		if len(users) == limit(query.Limit) {
+			break
+		}
+	}
+	return users, nil
+}
+
+// UserDelete removes user together with profile and history
+func (s *memStg) UserDelete(ctx context.Context, userid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, err := s.getUser(userid, permit(ctx, nil, WRITES))
+	if err != nil {
+		return err
+	}
+
+	s.indexText(s.profiles[user.ID], false)
+	delete(s.users, user.ID)
+	delete(s.profiles, user.ID)
+	for i, id := range s.order {
+		if id == user.ID {
+			s.order = append(s.order[:i:i], s.order[i+1:]...)
+			break
+		}
+	}
+
+	changes := []*ChangeDB{}
+	for _, c := range s.changes {
+		if c.ProfID != user.ID {
+			changes = append(changes, c)
+		}
+	}
+	s.changes = changes
+	return nil
+}
+
+// ########################## Profile CRUD Section ##############################
+
+// ProfileSearch obtains profiles of confirmed users selected by query. It limits result (to 1k) as mongo storage does.
+func (s *memStg) ProfileSearch(ctx context.Context, query *model.ProfileQuery) ([]*model.Profile, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	pdbs, err := s.findProfiles(permit(ctx, confirm(nil), READS), -1)
+	if err != nil {
+		return nil, err
+	}
+
+	profiles := []*model.Profile{}
+	for _, pdb := range pdbs {
+		profile := pdb.Model()
+		if query.Match(profile) {
+			profiles = append(profiles, profile)
+		}
+	}
+
+	sort.Slice(profiles, func(i, j int) bool {
+		return query.Less(profiles[i], profiles[j])
+	})
+	if len(profiles) > limit(query.Limit) {
+		profiles = profiles[:limit(query.Limit)]
+	}
+	return profiles, nil
+}
+
+func (s *memStg) ProfileGet(ctx context.Context, profid string) (*model.Profile, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	pdb, err := s.getProfile(profid, permit(ctx, confirm(nil), READS))
+	if err != nil {
+		return (&ProfileDB{}).Model(), err
+	}
+	return pdb.Model(), nil
+}
+
+// ProfileAdminGet gets profile like ProfileGet does, but privileged context user gets unconfirmed one too
+func (s *memStg) ProfileAdminGet(ctx context.Context, profid string) (*model.Profile, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	pdb, err := s.getProfile(profid, permit(ctx, confirmed(ctx, nil), READS))
+	if err != nil {
+		return (&ProfileDB{}).Model(), err
+	}
+	return pdb.Model(), nil
+}
+
+// ProfileUpdate updates profile and appends the change to history.
+// If profile.Rev isn't zero it's expected revision, ErrConflict is returned on mismatch
+func (s *memStg) ProfileUpdate(ctx context.Context, profile *model.Profile) (*model.Profile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pdb, err := s.getProfile(profile.ID, permit(ctx, confirmed(ctx, nil), WRITES))
+	if err != nil {
+		return nil, err
+	}
+
+	prev := pdb.Model()
+	if profile.Rev != 0 && profile.Rev != prev.Rev {
+		return nil, ErrConflict
+	}
+
+	change := prev.Substract(profile)
+	stamp(ctx, &change, profile.ID)
+	change.Rev = prev.Rev + 1
+	change.Hash = change.Digest(profile.ID, pdb.Head)
+
+	next := *s.profiles[pdb.ID]
+	next.Rev++
+	next.Head = change.Hash
+	next.Profile = *profile
+	next.Profile.Rev = 0
+	s.indexText(s.profiles[pdb.ID], false)
+	s.profiles[pdb.ID] = &next
+	s.indexText(&next, true)
+
+	cdb := newChangeDB(pdb.ID, &change)
+	cdb.ID = bson.NewObjectId()
+	s.changes = append(s.changes, cdb)
+
+	copyProf := next
+	return copyProf.Model(), nil
+}
+
+// ProfileText finds profiles of confirmed users by text index ordered by relevance. It limits result (to 1k) as mongo storage does.
+func (s *memStg) ProfileText(ctx context.Context, query *model.TextQuery) ([]*model.TextHit, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	found := map[bson.ObjectId]bool{}
+	for _, term := range query.Terms {
+		for id := range s.text[term] {
+			found[id] = true
+		}
+	}
+
+	filter := permit(ctx, confirm(nil), READS)
+	hits := []*model.TextHit{}
+	for _, id := range s.order {
+		if !found[id] {
+			continue
+		}
+		match, err := matchDoc(s.profiles[id], filter)
+		if err != nil {
+			return nil, err
+		}
+		if match {
+			copyProf := *s.profiles[id]
+			profile := copyProf.Model()
+			hits = append(hits, &model.TextHit{Profile: profile, Score: profile.TextScore(query.Terms)})
+		}
+	}
+
+	sort.SliceStable(hits, func(i, j int) bool {
+		return hits[i].Score > hits[j].Score
+	})
+	if query.Offset >= len(hits) {
+		return []*model.TextHit{}, nil
+	}
+	hits = hits[query.Offset:]
+	if len(hits) > limit(query.Limit) {
+		hits = hits[:limit(query.Limit)]
+	}
+	return hits, nil
+}
+
+// ################ History CRUD section ####################
+
+// HistoryGet requests page of changes selected by query on behalf of context user.
+// Changes have no ACL, so permission is checked by the profile
+func (s *memStg) HistoryGet(ctx context.Context, profid string, query *model.HistoryQuery) ([]*model.Change, error) {
+	if err := historyCheck(query); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	pdb, err := s.getProfile(profid, permit(ctx, confirmed(ctx, nil), WRITES))
+	if err != nil {
+		return nil, err
+	}
+
+	// changes are appended in revision order, so descending order walks them backward
+	changes := []*model.Change{}
+	for i := range s.changes {
+		c := s.changes[i]
+		if query.Desc {
+			c = s.changes[len(s.changes)-1-i]
+		}
+		if c.ProfID != pdb.ID {
+			continue
+		}
+
+		copyChange := *c
+		if change := copyChange.Model(); query.Match(change) {
+			changes = append(changes, change)
+		}
+		if len(changes) == limit(query.Limit) {
+			break
+		}
+	}
+	return changes, nil
+}
+
+// HistoryHead returns head of profile history and the last signed checkpoint (nil if there is no one).
+// History is permitted like changes are
+func (s *memStg) HistoryHead(ctx context.Context, profid string) (head, checkpoint *model.Checkpoint, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	pdb, err := s.getProfile(profid, permit(ctx, confirmed(ctx, nil), WRITES))
+	if err != nil {
+		return nil, nil, err
+	}
+	if pdb.Checkpoint != nil {
+		copyCheckpoint := *pdb.Checkpoint
+		checkpoint = &copyCheckpoint
+	}
+	return &model.Checkpoint{Rev: pdb.Rev, Hash: pdb.Head}, checkpoint, nil
+}
+
+// HistoryCheckpoint stores signed checkpoint of profile history unless newer one is stored already
+func (s *memStg) HistoryCheckpoint(ctx context.Context, profid string, checkpoint *model.Checkpoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pdb, err := s.getProfile(profid, permit(ctx, confirm(nil), WRITES))
+	if err != nil {
+		return err
+	}
+	if pdb.Checkpoint != nil && pdb.Checkpoint.Rev >= checkpoint.Rev {
+		return nil
+	}
+
+	copyCheckpoint := *checkpoint
+	pdb.Checkpoint = &copyCheckpoint
+	s.profiles[pdb.ID] = pdb
+	return nil
+}
+
+// ################ Session CRUD section ####################
+
+// SessionInsert creates new session of context user. it overrides ID if any
+func (s *memStg) SessionInsert(ctx context.Context, sessm *model.Session) (*model.Session, error) {
+	if !isOwner(ctx, sessm.UserID) {
+		return nil, mgo.ErrNotFound
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess := &SessionDB{
+		ID:      bson.NewObjectId(),
+		Session: *sessm,
+	}
+
+	// emulate unique index on refresh
+	for _, other := range s.sessions {
+		if other.Refresh == sess.Refresh {
+			return nil, ErrMemDup
+		}
+	}
+
+	s.sessions[sess.ID] = sess
+	copySess := *sess
+	return copySess.Model(), nil
+}
+
+// SessionByRefresh looks for not expired session by refresh token digest
+func (s *memStg) SessionByRefresh(ctx context.Context, refresh string) (*model.Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	filter := owned(ctx, bson.M{"refresh": refresh}, "userid")
+	now := time.Now()
+	for _, sess := range s.sessions {
+		if !sess.Expire.After(now) {
+			continue
+		}
+		match, err := matchDoc(sess, filter)
+		if err != nil {
+			return nil, err
+		}
+		if match {
+			copySess := *sess
+			return copySess.Model(), nil
+		}
+	}
+	return nil, mgo.ErrNotFound
+}
+
+// SessionSet gets session applying optional filter and modifies the object
+func (s *memStg) SessionSet(ctx context.Context, sessid string, fields model.Fields, filter *Query) (*model.Session, error) {
+	cond, err := filter.filter()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	oid, err := toObjectId(sessid)
+	if err != nil {
+		return nil, err
+	}
+
+	sess, ok := s.sessions[oid]
+	if !ok {
+		return nil, mgo.ErrNotFound
+	}
+	next := &SessionDB{}
+	if err := setFields(sess, owned(ctx, cond, "userid"), bson.M(fields), next); err != nil {
+		return nil, err
+	}
+
+	s.sessions[oid] = next
+	copySess := *next
+	return copySess.Model(), nil
+}
+
+// SessionDelete revokes session of context user
+func (s *memStg) SessionDelete(ctx context.Context, sessid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	oid, err := toObjectId(sessid)
+	if err != nil {
+		return err
+	}
+
+	sess, ok := s.sessions[oid]
+	if !ok {
+		return mgo.ErrNotFound
+	}
+	match, err := matchDoc(sess, owned(ctx, nil, "userid"))
+	if err != nil {
+		return err
+	}
+	if !match {
+		return mgo.ErrNotFound
+	}
+
+	delete(s.sessions, oid)
+	return nil
+}
+
+// SessionDeleteByUser revokes all sessions of the user (e.g. when password is changed)
+func (s *memStg) SessionDeleteByUser(ctx context.Context, userid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	filter := owned(ctx, bson.M{"userid": userid}, "userid")
+	for id, sess := range s.sessions {
+		match, err := matchDoc(sess, filter)
+		if err != nil {
+			return err
+		}
+		if match {
+			delete(s.sessions, id)
+		}
+	}
+	return nil
+}
+
+// ################ Audit CRUD section ####################
+
+// AuditInsert appends record to audit trail of context user. it overrides ID if any
+func (s *memStg) AuditInsert(ctx context.Context, recm *model.AuditRecord) (*model.AuditRecord, error) {
+	if !isOwner(ctx, recm.UserID) {
+		return nil, mgo.ErrNotFound
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec := &AuditDB{
+		ID:          bson.NewObjectId(),
+		AuditRecord: *recm,
+	}
+	s.audit = append(s.audit, rec)
+
+	copyRec := *rec
+	return copyRec.Model(), nil
+}
+
+// AuditGet requests audit trail of the user on behalf of context user
+func (s *memStg) AuditGet(ctx context.Context, userid string) ([]*model.AuditRecord, error) {
+	if !isOwner(ctx, userid) {
+		return nil, mgo.ErrNotFound
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	recs := []*model.AuditRecord{}
+	for _, rec := range s.audit {
+		if rec.UserID == userid {
+			copyRec := *rec
+			recs = append(recs, copyRec.Model())
+		}
+	}
+	return recs, nil
+}
+
+// ############### helper functions #################
+
+// getUser and getProfile fetch copy of document by string id and check that it matches the filter.
+// caller must hold the lock
+func (s *memStg) getUser(id string, filter bson.M) (*UserDB, error) {
+	oid, err := toObjectId(id)
+	if err != nil {
+		return nil, err
+	}
+
+	user, ok := s.users[oid]
+	if !ok {
+		return nil, mgo.ErrNotFound
+	}
+	if err := mustMatch(user, filter); err != nil {
+		return nil, err
+	}
+
+	copyUser := *user
+	return &copyUser, nil
+}
+
+func (s *memStg) getProfile(id string, filter bson.M) (*ProfileDB, error) {
+	oid, err := toObjectId(id)
+	if err != nil {
+		return nil, err
+	}
+
+	profile, ok := s.profiles[oid]
+	if !ok {
+		return nil, mgo.ErrNotFound
+	}
+	if err := mustMatch(profile, filter); err != nil {
+		return nil, err
+	}
+
+	copyProf := *profile
+	return &copyProf, nil
+}
+
+// findUser returns copy of the first user matched the filter. caller must hold the lock
+func (s *memStg) findUser(filter bson.M) (*UserDB, error) {
+	users, err := s.findUsers(filter, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, mgo.ErrNotFound
+	}
+	return users[0], nil
+}
+
+// findUsers and findProfiles return copies of up to limit (all if negative) documents matched the filter.
+// caller must hold the lock
+func (s *memStg) findUsers(filter bson.M, limit int) ([]*UserDB, error) {
+	users := []*UserDB{}
+	for _, id := range s.order {
+		match, err := matchDoc(s.users[id], filter)
+		if err != nil {
+			return nil, err
+		}
+		if match {
+			copyUser := *s.users[id]
+			users = append(users, &copyUser)
+		}
+		if len(users) == limit {
+			break
+		}
+	}
+	return users, nil
+}
+
+func (s *memStg) findProfiles(filter bson.M, limit int) ([]*ProfileDB, error) {
+	profiles := []*ProfileDB{}
+	for _, id := range s.order {
+		match, err := matchDoc(s.profiles[id], filter)
+		if err != nil {
+			return nil, err
+		}
+		if match {
+			copyProf := *s.profiles[id]
+			profiles = append(profiles, &copyProf)
+		}
+		if len(profiles) == limit {
+			break
+		}
+	}
+	return profiles, nil
+}
+
+// mustMatch returns ErrNotFound if document doesn't match the filter
+func mustMatch(doc interface{}, filter bson.M) error {
+	match, err := matchDoc(doc, filter)
+	if err != nil {
+		return err
+	}
+	if !match {
+		return mgo.ErrNotFound
+	}
+	return nil
+}
+
+// indexText adds words of profile to text index or removes them
+func (s *memStg) indexText(doc *ProfileDB, add bool) {
+	for field := range model.TextWeights {
+		for _, token := range model.Tokenize(doc.Profile.Field(field).(string)) {
+			if !add {
+				delete(s.text[token], doc.ID)
+				continue
+			}
+			if s.text[token] == nil {
+				s.text[token] = map[bson.ObjectId]bool{}
+			}
+			s.text[token][doc.ID] = true
+		}
+	}
+}
+
+// setFields emulates mongo update {$set: fields} of document matched the filter.
+// Modified copy of document is unmarshaled to next, stored document is kept untouched
+func setFields(doc interface{}, filter, fields bson.M, next interface{}) error {
+	match, err := matchDoc(doc, filter)
+	if err != nil {
+		return err
+	}
+	if !match {
+		return mgo.ErrNotFound
+	}
+
+	// apply $set through bson document, so field names are the same as in mongo
+	raw, err := toBsonM(doc)
+	if err != nil {
+		return err
+	}
+	for k, v := range fields {
+		if err := setPath(raw, k, v); err != nil {
+			return err
+		}
+	}
+
+	return fromBsonM(raw, next)
+}
+
+// matchDoc checks filter against document the same way mongo does:
+// document is converted to bson and each filter key (dot notation allowed) is compared with the value.
+// Besides equality it supports $and, $or and $bitsAnySet operators used by permission filters
+func matchDoc(doc interface{}, filter bson.M) (bool, error) {
+	if len(filter) == 0 {
+		return true, nil
+	}
+
+	raw, err := toBsonM(doc)
+	if err != nil {
+		return false, err
+	}
+
+	return matchRaw(raw, filter)
+}
+
+// matchRaw checks filter against bson document
+func matchRaw(raw, filter bson.M) (bool, error) {
+	for key, want := range filter {
+		var match bool
+		var err error
+
+		switch key {
+		case "$and", "$or":
+			match, err = matchClauses(raw, want, key == "$or")
+		default:
+			match, err = matchValue(raw, key, want)
+		}
+		if err != nil || !match {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// matchClauses checks list of filters, any of them (for $or) or all of them (for $and) has to match
+func matchClauses(raw bson.M, clauses interface{}, any bool) (bool, error) {
+	list, ok := clauses.([]bson.M)
+	if !ok {
+		return false, fmt.Errorf("unsupported clause list %T", clauses)
+	}
+
+	for _, clause := range list {
+		match, err := matchRaw(raw, clause)
+		if err != nil {
+			return false, err
+		}
+		if match == any {
+			return any, nil
+		}
+	}
+	return !any, nil
+}
+
+// matchValue compares document field with filter value or checks it by operator
+func matchValue(raw bson.M, key string, want interface{}) (bool, error) {
+	got, _ := getPath(raw, key)
+
+	switch want := want.(type) {
+	case bson.M:
+		for op, arg := range want {
+			match, err := matchOp(got, op, arg)
+			if err != nil || !match {
+				return false, err
+			}
+		}
+		return true, nil
+	case bson.RegEx:
+		str, ok := got.(string)
+		if !ok {
+			return false, nil
+		}
+		pattern := want.Pattern
+		if strings.Contains(want.Options, "i") {
+			pattern = "(?i)" + pattern
+		}
+		return regexp.MatchString(pattern, str)
+	}
+
+	norm, err := normalize(want)
+	if err != nil {
+		return false, err
+	}
+	return reflect.DeepEqual(got, norm), nil
+}
+
+// matchOp checks document value by filter operator
+func matchOp(got interface{}, op string, arg interface{}) (bool, error) {
+	if op == "$bitsAnySet" {
+		return toInt64(got)&toInt64(arg) != 0, nil
+	}
+
+	norm, err := normalize(arg)
+	if err != nil {
+		return false, err
+	}
+
+	switch op {
+	case "$eq":
+		return reflect.DeepEqual(got, norm), nil
+	case "$in":
+		list, _ := norm.([]interface{})
+		for _, v := range list {
+			if reflect.DeepEqual(got, v) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "$gt", "$gte", "$lt", "$lte":
+		cmp, ok := compareValues(got, norm)
+		if !ok {
+			return false, nil
+		}
+		switch op {
+		case "$gt":
+			return cmp > 0, nil
+		case "$gte":
+			return cmp >= 0, nil
+		case "$lt":
+			return cmp < 0, nil
+		}
+		return cmp <= 0, nil
+	}
+	return false, fmt.Errorf("unsupported operator %s", op)
+}
+
+// normalize converts filter value, so types are equal to decoded document ones
+func normalize(val interface{}) (interface{}, error) {
+	norm, err := toBsonM(bson.M{"v": val})
+	if err != nil {
+		return nil, err
+	}
+	return norm["v"], nil
+}
+
+// compareValues orders numbers, strings and times, ok is false if values aren't comparable
+func compareValues(a, b interface{}) (cmp int, ok bool) {
+	switch a := a.(type) {
+	case string:
+		b, ok := b.(string)
+		return strings.Compare(a, b), ok
+	case time.Time:
+		b, ok := b.(time.Time)
+		switch {
+		case a.Before(b):
+			return -1, ok
+		case a.After(b):
+			return 1, ok
+		}
+		return 0, ok
+	case int, int32, int64:
+		switch b.(type) {
+		case int, int32, int64:
+		default:
+			return 0, false
+		}
+		x, y := toInt64(a), toInt64(b)
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// toInt64 converts bson integer of any size, other values are treated as zero
+func toInt64(v interface{}) int64 {
+	switch n := v.(type) {
+	case int:
+		return int64(n)
+	case int32:
+		return int64(n)
+	case int64:
+		return n
+	}
+	return 0
+}
+
+// getPath obtains value from bson document by dot separated path
+func getPath(doc bson.M, path string) (interface{}, bool) {
+	keys := strings.Split(path, ".")
+	var cur interface{} = doc
+	for _, k := range keys {
+		m, ok := cur.(bson.M)
+		if !ok {
+			return nil, false
+		}
+		if cur, ok = m[k]; !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// setPath sets value in bson document by dot separated path, creating missing subdocuments
+func setPath(doc bson.M, path string, value interface{}) error {
+	keys := strings.Split(path, ".")
+	cur := doc
+	for _, k := range keys[:len(keys)-1] {
+		next, ok := cur[k].(bson.M)
+		if !ok {
+			if cur[k] != nil {
+				return errors.New("can't set field " + path + ": not a subdocument")
+			}
+			next = bson.M{}
+			cur[k] = next
+		}
+		cur = next
+	}
+	cur[keys[len(keys)-1]] = value
+	return nil
+}
+
+func toBsonM(obj interface{}) (bson.M, error) {
+	b, err := bson.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	raw := bson.M{}
+	err = bson.Unmarshal(b, raw)
+	return raw, err
+}
+
+func fromBsonM(raw bson.M, obj interface{}) error {
+	b, err := bson.Marshal(raw)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(b, obj)
+}
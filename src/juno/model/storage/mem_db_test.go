@@ -0,0 +1,22 @@
+package storage_test
+
+import (
+	"golang.org/x/crypto/bcrypt"
+	"juno/common/passwd"
+	"juno/model/storage"
+	"juno/model/storage/storagetest"
+	"os"
+	"testing"
+)
+
+// TestMain makes password hashing cheap for both mem and mgo suites
+func TestMain(m *testing.M) {
+	passwd.Cost = bcrypt.MinCost
+	os.Exit(m.Run())
+}
+
+func TestMemConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		return storage.MemNew()
+	})
+}
@@ -7,9 +7,26 @@ import (
 	"gopkg.in/mgo.v2/bson"
 	"juno/model"
 	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
 )
 
-const MGO_COLLECTION = "people"
+const (
+	MGO_USERS    = "users"
+	MGO_PROFILES = "profiles"
+	MGO_CHANGES  = "changes"
+	MGO_SESSIONS = "sessions"
+	MGO_AUDIT    = "audit"
+
+	// MGO_UPDATE_RETRIES is how many times unconditional update is retried on concurrent modification
+	MGO_UPDATE_RETRIES = 5
+
+	// MGO_ORPHAN_AGE is how long change may wait for its profile update,
+	// older change of revision that profile hasn't reached is left by failed update and is removed
+	MGO_ORPHAN_AGE = time.Minute
+)
 
 type mongoStg struct {
 	// we will copy the main session each time we need concurrent mgo call
@@ -26,12 +43,18 @@ func MgoMustConnect(url string) Storage {
 		panic(err)
 	}
 
+	return MgoMustInit(sess)
+}
+
+// MgoMustInit creates storage on top of already established session (e.g. by test server), storage takes ownership of it.
+// It panics if indexes can't be created
+func MgoMustInit(sess *mgo.Session) Storage {
 	// Optional. Switch the session to a monotonic behavior.
 	sess.SetMode(mgo.Monotonic, true)
-	c := sess.DB("").C(MGO_COLLECTION)
+	db := sess.DB("")
 
 	// create indexes if don't exist
-	indexes := []mgo.Index{
+	userIndexes := []mgo.Index{
 		// to control email duplicates,
 		mgo.Index{
 			Key:        []string{"email"},
@@ -40,27 +63,97 @@ func MgoMustConnect(url string) Storage {
 			Background: true,
 			Sparse:     true,
 		},
-		// for fast auth access
+		// to find user by confirmation token
 		mgo.Index{
-			Key:        []string{"email", "password"},
-			DropDups:   false,
+			Key:        []string{"confirmtoken"},
+			Background: true,
+			Sparse:     true,
+		},
+		// to find user by password reset token
+		mgo.Index{
+			Key:        []string{"resettoken"},
 			Background: true,
 			Sparse:     true,
 		},
-		// to get confirmed user
+		// to find user by email change token
+		mgo.Index{
+			Key:        []string{"emailtoken"},
+			Background: true,
+			Sparse:     true,
+		},
+	}
+	mustEnsureIndexes(db.C(MGO_USERS), userIndexes)
+
+	// to search profiles by text, stemming is off, so words are matched as model.Tokenize splits them
+	text := mgo.Index{
+		Weights:         map[string]int{},
+		DefaultLanguage: "none",
+		Background:      true,
+	}
+	for field, weight := range model.TextWeights {
+		text.Key = append(text.Key, "$text:"+profilePath(field))
+		text.Weights[profilePath(field)] = weight
+	}
+	sort.Strings(text.Key)
+	profIndexes := []mgo.Index{
+		// to get confirmed profile
 		mgo.Index{
 			Key:        []string{"_id", "confirm"},
 			Unique:     true,
 			Background: true,
-			Sparse:     true,
 		},
+		text,
 	}
+	mustEnsureIndexes(db.C(MGO_PROFILES), profIndexes)
 
-	for _, index := range indexes {
-		if err := c.EnsureIndex(index); err != nil {
-			panic(err)
-		}
+	// history of profile is read in revision order, revision has only one change
+	changeIndexes := []mgo.Index{
+		mgo.Index{
+			Key:        []string{"profid", "rev"},
+			Unique:     true,
+			Background: true,
+		},
+		// to filter history by actor
+		mgo.Index{
+			Key:        []string{"profid", "actor", "rev"},
+			Background: true,
+		},
+	}
+	mustEnsureIndexes(db.C(MGO_CHANGES), changeIndexes)
+
+	// unique indexes are ready, so legacy documents can be moved
+	mgoMustMigrate(db)
+	mgoMustListFields(db)
+	mgoMustSeal(db)
+
+	sessIndexes := []mgo.Index{
+		// to find session by refresh token
+		mgo.Index{
+			Key:        []string{"refresh"},
+			Unique:     true,
+			Background: true,
+		},
+		// to revoke all user sessions
+		mgo.Index{
+			Key:        []string{"userid"},
+			Background: true,
+		},
+		// mongo removes expired sessions itself
+		mgo.Index{
+			Key:         []string{"expire"},
+			Background:  true,
+			ExpireAfter: time.Second,
+		},
+	}
+
+	mustEnsureIndexes(db.C(MGO_SESSIONS), sessIndexes)
+
+	// audit trail of user is read in time order
+	auditIndex := mgo.Index{
+		Key:        []string{"userid", "time"},
+		Background: true,
 	}
+	mustEnsureIndexes(db.C(MGO_AUDIT), []mgo.Index{auditIndex})
 
 	return &mongoStg{sess}
 }
@@ -77,21 +170,23 @@ func (s mongoStg) IsErrNotFound(err error) bool {
 func (s mongoStg) IsErrDup(err error) bool {
 	return mgo.IsDup(err)
 }
+func (s mongoStg) IsErrConflict(err error) bool {
+	return err == ErrConflict
+}
 
 // ################### functions for context #################
 type ctxKey int
 
-var colKey ctxKey = 0
+var dbKey ctxKey = 0
 
 // Reserve spawns db session copy
-// and puts in context collection that could be queried concurrently.
+// and puts in context database that could be queried concurrently.
 // It returns modified context and release function that puts db session back to the pool
 func (s mongoStg) Reserve(ctx context.Context) (context.Context, ReleaseFunc) {
 	sess := s.main.Copy()
-	c := sess.DB("").C(MGO_COLLECTION)
 
-	// in complex application we would preserve session, not collection
-	ctx = context.WithValue(ctx, colKey, c)
+	// there are several collections, so preserve database
+	ctx = context.WithValue(ctx, dbKey, sess.DB(""))
 	release := func() {
 		sess.Close()
 	}
@@ -99,82 +194,251 @@ func (s mongoStg) Reserve(ctx context.Context) (context.Context, ReleaseFunc) {
 	return ctx, release
 }
 
-// col return collection preserved in context
-func (s mongoStg) col(ctx context.Context) *mgo.Collection {
-	c, ok := ctx.Value(colKey).(*mgo.Collection)
+// db return database preserved in context
+func (s mongoStg) db(ctx context.Context) *mgo.Database {
+	db, ok := ctx.Value(dbKey).(*mgo.Database)
 	if !ok {
-		log.Println("no collection in context") // todo: write call stack
-		c = s.main.DB("").C(MGO_COLLECTION)
+		log.Println("no database in context") // todo: write call stack
+		db = s.main.DB("")
 	}
-	return c
+	return db
+}
+
+// userCol return users collection
+func (s mongoStg) userCol(ctx context.Context) *mgo.Collection {
+	return s.db(ctx).C(MGO_USERS)
+}
+
+// profCol return profiles collection
+func (s mongoStg) profCol(ctx context.Context) *mgo.Collection {
+	return s.db(ctx).C(MGO_PROFILES)
+}
+
+// changeCol return changes collection
+func (s mongoStg) changeCol(ctx context.Context) *mgo.Collection {
+	return s.db(ctx).C(MGO_CHANGES)
+}
+
+// sessCol return sessions collection
+func (s mongoStg) sessCol(ctx context.Context) *mgo.Collection {
+	return s.db(ctx).C(MGO_SESSIONS)
+}
+
+// auditCol return audit collection
+func (s mongoStg) auditCol(ctx context.Context) *mgo.Collection {
+	return s.db(ctx).C(MGO_AUDIT)
 }
 
 // ###################### User CRUD Section #########################
 
-// todo: implement permission check to all methods:
-//  get current user from context (may be anonym).
-//  get user roles array and find objects matched with roles.
-//  each object has two role arrays "writes" and "reads", depending on method we need to go through one of them
-//  finite role array can be encoded as bit string.
-//  additionally we need check ownership by $or clause
+// Every query is filtered by permissions of context user (see permit and owned helpers),
+// so BL acting on behalf of itself has to put model.System() user to context.
+
+// UserSearch looks for user record on behalf of context user
+func (s mongoStg) UserSearch(ctx context.Context, filter *Query) (*model.User, error) {
+	cond, err := filter.filter()
+	if err != nil {
+		return nil, err
+	}
 
-// UserByCreds Looks for user by email and password
-func (s mongoStg) UserSearch(ctx context.Context, filter model.Fields) (*model.User, error) {
 	udb := &UserDB{}
-	err := s.col(ctx).Find(bson.M(filter)).One(udb)
+	err = s.userCol(ctx).Find(permit(ctx, cond, WRITES)).One(udb)
 	return udb.Model(), err
 }
 
-// UserInsert creates new user. it overrides ID if any
+// UserInsert creates new user with default ACL and empty profile. it overrides ID if any.
+// Only privileged context user grants roles other than ROLE_USER
 func (s mongoStg) UserInsert(ctx context.Context, userm *model.User) (*model.User, error) {
 	user := &UserDB{
 		User: *userm,
 		ID:   bson.NewObjectId(),
+		ACL:  model.DefaultACL(),
+	}
+	if !privileged(ctx) {
+		user.Roles &= model.ROLE_USER
 	}
 
-	err := s.col(ctx).Insert(user)
-	return user.Model(), err
+	if err := s.userCol(ctx).Insert(user); err != nil {
+		return user.Model(), err
+	}
+
+	profile := &ProfileDB{ID: user.ID, Rev: 1, Confirm: user.Confirm, ACL: user.ACL}
+	if err := s.profCol(ctx).Insert(profile); err != nil {
+		// user without profile is broken, so it's rolled back
+		if rerr := s.userCol(ctx).RemoveId(user.ID); rerr != nil {
+			log.Printf("can't roll back user %s: %v", user.ID.Hex(), rerr)
+		}
+		return nil, err
+	}
+	return user.Model(), nil
 }
 
 func (s mongoStg) UserGet(ctx context.Context, userid string) (*model.User, error) {
 	user := &UserDB{}
-	err := s.getByID(ctx, userid, user, nil)
+	err := getByID(s.userCol(ctx), userid, user, permit(ctx, nil, WRITES))
 
 	return user.Model(), err
 }
 
 // UserSet gets user applying optional filter and modifies the object
 // it will rise ErrNotFound if user is already confirmed
-func (s mongoStg) UserSet(ctx context.Context, userid string, fields, filter model.Fields) (*model.User, error) {
+func (s mongoStg) UserSet(ctx context.Context, userid string, fields model.Fields, filter *Query) (*model.User, error) {
 	id, err := toObjectId(userid)
 	if err != nil {
 		return nil, err
 	}
-
-	if filter == nil {
-		filter = model.Fields{}
+	if err := protect(ctx, fields); err != nil {
+		return nil, err
+	}
+	cond, err := filter.filter()
+	if err != nil {
+		return nil, err
 	}
-	filter["_id"] = id
 
-	c := s.col(ctx)
-	err = c.Update(bson.M(filter), bson.M{"$set": bson.M(fields)})
+	query := permit(ctx, cond, WRITES)
+	query["_id"] = id
+
+	c := s.userCol(ctx)
+	err = c.Update(query, bson.M{"$set": bson.M(fields)})
 	if err != nil {
 		return nil, err
 	}
 
+	// profile follows confirmation and permissions of the user
+	if copied := profileCopy(fields); len(copied) > 0 {
+		if err = s.profCol(ctx).UpdateId(id, bson.M{"$set": copied}); err != nil {
+			return nil, err
+		}
+	}
+
 	user := &UserDB{}
 	err = c.FindId(id).One(user)
 	return user.Model(), err
 }
 
+// UserList selects users by query on behalf of context user. It limits result (to 1k) for security reasons.
+func (s mongoStg) UserList(ctx context.Context, query *model.UserQuery) ([]*model.User, error) {
+	filter := bson.M{}
+	if query.Confirm != nil {
+		filter["confirm"] = *query.Confirm
+	}
+	if query.Disabled != nil {
+		// accounts created before disabling was introduced have no such field
+		filter["disabled"] = true
+		if !*query.Disabled {
+			filter["disabled"] = bson.M{"$ne": true}
+		}
+	}
+
+	// ObjectId starts with creation time, so range of ids is range of registration time
+	created := bson.M{}
+	if !query.CreatedFrom.IsZero() {
+		created["$gte"] = bson.NewObjectIdWithTime(query.CreatedFrom)
+	}
+	if !query.CreatedTo.IsZero() {
+		created["$lt"] = bson.NewObjectIdWithTime(query.CreatedTo)
+	}
+	if len(created) > 0 {
+		filter["_id"] = created
+	}
+
+	if query.Email != "" {
+		filter["email"] = bson.RegEx{Pattern: regexp.QuoteMeta(query.Email), Options: "i"}
+	}
+
+	udbs := []*UserDB{}
+	q := s.userCol(ctx).Find(permit(ctx, filter, WRITES)).Sort("_id").Skip(query.Offset).Limit(limit(query.Limit))
+	if err := q.All(&udbs); err != nil {
+		return nil, err
+	}
+
+	users := make([]*model.User, 0, len(udbs))
+	for _, u := range udbs {
+		users = append(users, u.Model())
+	}
+	return users, nil
+}
+
+// UserDelete removes user together with profile and history
+func (s mongoStg) UserDelete(ctx context.Context, userid string) error {
+	id, err := toObjectId(userid)
+	if err != nil {
+		return err
+	}
+
+	filter := permit(ctx, nil, WRITES)
+	filter["_id"] = id
+	if err := s.userCol(ctx).Remove(filter); err != nil {
+		return err
+	}
+
+	if err := s.profCol(ctx).RemoveId(id); err != nil && err != mgo.ErrNotFound {
+		return err
+	}
+	_, err = s.changeCol(ctx).RemoveAll(bson.M{"profid": id})
+	return err
+}
+
 // ########################## Profile CRUD Section ##############################
 
-// ProfileSearch obtains profiles of confirmed users. It limits result (to 1k) for security reasons.
-func (s mongoStg) ProfileSearch(ctx context.Context, filter model.Fields) ([]*model.Profile, error) {
+// ProfileSearch obtains profiles of confirmed users selected by query. It limits result (to 1k) for security reasons.
+func (s mongoStg) ProfileSearch(ctx context.Context, query *model.ProfileQuery) ([]*model.Profile, error) {
+	filter := bson.M{}
+	prefixes := []struct {
+		field, val string
+	}{
+		{"FirstName", query.FirstName},
+		{"LastName", query.LastName},
+	}
+	for _, p := range prefixes {
+		if p.val != "" {
+			filter[profilePath(p.field)] = bson.RegEx{Pattern: "^" + regexp.QuoteMeta(p.val), Options: "i"}
+		}
+	}
+	substrs := []struct {
+		field, val string
+	}{
+		{"Phone", query.Phone},
+		{"Address", query.Address},
+	}
+	for _, p := range substrs {
+		if p.val != "" {
+			filter[profilePath(p.field)] = bson.RegEx{Pattern: regexp.QuoteMeta(p.val), Options: "i"}
+		}
+	}
+
+	age := bson.M{}
+	if query.AgeFrom != nil {
+		age["$gte"] = *query.AgeFrom
+	}
+	if query.AgeTo != nil {
+		age["$lte"] = *query.AgeTo
+	}
+	if len(age) > 0 {
+		filter[profilePath("Age")] = age
+	}
+
+	if query.After != nil {
+		// no profile follows unknown position
+		if !bson.IsObjectIdHex(query.After.ID) {
+			return []*model.Profile{}, nil
+		}
+		filter["$or"] = profileAfter(query)
+	}
+
+	order := make([]string, 0, len(query.Sort)+1)
+	for _, key := range query.Sort {
+		if key.Desc {
+			order = append(order, "-"+profilePath(key.Field))
+		} else {
+			order = append(order, profilePath(key.Field))
+		}
+	}
+	order = append(order, "_id")
 
 	pdbs := []*ProfileDB{}
-	query := s.col(ctx).Find(confirm(filter)).Limit(1000)
-	if err := query.All(&pdbs); err != nil {
+	q := s.profCol(ctx).Find(permit(ctx, confirm(filter), READS)).Sort(order...).Limit(limit(query.Limit))
+	if err := q.All(&pdbs); err != nil {
 		return nil, err
 	}
 
@@ -187,66 +451,326 @@ func (s mongoStg) ProfileSearch(ctx context.Context, filter model.Fields) ([]*mo
 	return profiles, nil
 }
 
+// ProfileText finds profiles of confirmed users by text index ordered by relevance. It limits result (to 1k) for security reasons.
+func (s mongoStg) ProfileText(ctx context.Context, query *model.TextQuery) ([]*model.TextHit, error) {
+	if len(query.Terms) == 0 {
+		return []*model.TextHit{}, nil
+	}
+
+	// terms are words, so they have no special meaning (negation, phrase) in $search
+	filter := bson.M{"$text": bson.M{"$search": strings.Join(query.Terms, " ")}}
+	score := bson.M{"$meta": "textScore"}
+
+	sdbs := []*struct {
+		ProfileDB `bson:",inline"`
+		Score     float64 `bson:"score"`
+	}{}
+	q := s.profCol(ctx).Find(permit(ctx, confirm(filter), READS)).
+		Select(bson.M{"rev": 1, "profile": 1, "score": score}).
+		Sort("$textScore:score", "_id").Skip(query.Offset).Limit(limit(query.Limit))
+	if err := q.All(&sdbs); err != nil {
+		return nil, err
+	}
+
+	hits := make([]*model.TextHit, 0, len(sdbs))
+	for _, sdb := range sdbs {
+		hits = append(hits, &model.TextHit{Profile: sdb.Model(), Score: sdb.Score})
+	}
+	return hits, nil
+}
+
 func (s mongoStg) ProfileGet(ctx context.Context, profid string) (*model.Profile, error) {
 	item := &ProfileDB{}
-	err := s.getByID(ctx, profid, item, confirm(nil))
+	err := getByID(s.profCol(ctx), profid, item, permit(ctx, confirm(nil), READS))
 
 	return item.Model(), err
 }
 
-// ProfileUpdate updates profile and saves history changes
+// ProfileAdminGet gets profile like ProfileGet does, but privileged context user gets unconfirmed one too
+func (s mongoStg) ProfileAdminGet(ctx context.Context, profid string) (*model.Profile, error) {
+	item := &ProfileDB{}
+	err := getByID(s.profCol(ctx), profid, item, permit(ctx, confirmed(ctx, nil), READS))
+
+	return item.Model(), err
+}
+
+// ProfileUpdate updates profile and appends the change to history.
+// Update is atomic against revision, so the change is calculated from the version which is actually overwritten.
+// The change is inserted before profile is updated: unique {profid, rev} reserves the revision,
+// so profile never reaches revision that has no change. The change is removed if profile update fails.
+// If profile.Rev isn't zero it's expected revision, ErrConflict is returned on mismatch
 func (s mongoStg) ProfileUpdate(ctx context.Context, profile *model.Profile) (*model.Profile, error) {
+	oid, err := toObjectId(profile.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	// concurrent update makes us calculate the change again
+	for i := 0; i < MGO_UPDATE_RETRIES; i++ {
+		prevdb := &ProfileDB{}
+		if err := getByID(s.profCol(ctx), profile.ID, prevdb, permit(ctx, confirmed(ctx, nil), WRITES)); err != nil {
+			return nil, err
+		}
+		prev := prevdb.Model()
+		if profile.Rev != 0 && profile.Rev != prev.Rev {
+			return nil, ErrConflict
+		}
+
+		// Substract profile changes, the change is chained to the last one
+		change := prev.Substract(profile)
+		stamp(ctx, &change, profile.ID)
+		change.Rev = prev.Rev + 1
+		change.Hash = change.Digest(profile.ID, prevdb.Head)
+
+		update := bson.M{
+			"$set": bson.M{
+				"profile": profile,
+				"head":    change.Hash,
+			},
+			"$inc": bson.M{
+				"rev": 1,
+			},
+		}
+
+		// the change is stored as revision it has produced, duplicate means concurrent update
+		cdb := newChangeDB(oid, &change)
+		cdb.ID = bson.NewObjectId()
+		err := s.changeCol(ctx).Insert(cdb)
+		if mgo.IsDup(err) {
+			if err := s.dropOrphan(ctx, oid, change.Rev); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		filter := permit(ctx, confirmed(ctx, nil), WRITES)
+		filter["_id"] = oid
+		filter["rev"] = prev.Rev
+
+		err = s.profCol(ctx).Update(filter, update)
+		if err != nil {
+			if rerr := s.changeCol(ctx).RemoveId(cdb.ID); rerr != nil {
+				log.Printf("can't roll back change %d of profile %s: %v", cdb.Rev, profile.ID, rerr)
+			}
+		}
+		if err == mgo.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		next := *profile
+		next.Rev = prev.Rev + 1
+		return &next, nil
+	}
+
+	return nil, ErrConflict
+}
 
-	// check permissions.
-	// todo: remove this crutch if common permission workflow is implemented
-	if err := requestAccess(ctx, profile.ID); err != nil {
+// dropOrphan removes change of revision that profile hasn't reached for MGO_ORPHAN_AGE.
+// Such change is left when both profile update and its rollback have failed, it would block the revision forever
+func (s mongoStg) dropOrphan(ctx context.Context, profid bson.ObjectId, rev int64) error {
+	cdb := &ChangeDB{}
+	err := s.changeCol(ctx).Find(bson.M{"profid": profid, "rev": rev}).One(cdb)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	if err != nil || time.Since(cdb.ID.Time()) < MGO_ORPHAN_AGE {
+		// young change is being applied by concurrent update
+		return err
+	}
+
+	reached, err := s.profCol(ctx).Find(bson.M{"_id": profid, "rev": bson.M{"$gte": rev}}).Count()
+	if err != nil || reached > 0 {
+		return err
+	}
+
+	log.Printf("removing orphan change %d of profile %s", rev, profid.Hex())
+	err = s.changeCol(ctx).RemoveId(cdb.ID)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// ################ History CRUD section ####################
+
+// HistoryGet requests page of changes selected by query on behalf of context user.
+// Changes have no ACL, so permission is checked by the profile
+func (s mongoStg) HistoryGet(ctx context.Context, profid string, query *model.HistoryQuery) ([]*model.Change, error) {
+	if err := historyCheck(query); err != nil {
+		return nil, err
+	}
+	pdb := &ProfileDB{}
+	if err := getByID(s.profCol(ctx), profid, pdb, permit(ctx, confirmed(ctx, nil), WRITES)); err != nil {
 		return nil, err
 	}
 
-	prev, err := s.ProfileGet(ctx, profile.ID)
-	if err != nil {
+	order := "rev"
+	if query.Desc {
+		order = "-rev"
+	}
+
+	cdbs := []*ChangeDB{}
+	filter := historyFilter(bson.ObjectIdHex(profid), pdb.Rev, query)
+	if err := s.changeCol(ctx).Find(filter).Sort(order).Limit(limit(query.Limit)).All(&cdbs); err != nil {
 		return nil, err
 	}
 
-	// Substract profile changes
-	change := prev.Substract(profile)
+	changes := make([]*model.Change, 0, len(cdbs))
+	for _, c := range cdbs {
+		changes = append(changes, c.Model())
+	}
+	return changes, nil
+}
+
+// HistoryHead returns head of profile history and the last signed checkpoint (nil if there is no one).
+// History is permitted like changes are
+func (s mongoStg) HistoryHead(ctx context.Context, profid string) (head, checkpoint *model.Checkpoint, err error) {
+	pdb := &ProfileDB{}
+	if err := getByID(s.profCol(ctx), profid, pdb, permit(ctx, confirmed(ctx, nil), WRITES)); err != nil {
+		return nil, nil, err
+	}
+	return &model.Checkpoint{Rev: pdb.Rev, Hash: pdb.Head}, pdb.Checkpoint, nil
+}
 
-	update := bson.M{
-		"$set": bson.M{
-			"profile": profile,
-		},
-		"$push": bson.M{
-			"changes": change,
+// HistoryCheckpoint stores signed checkpoint of profile history unless newer one is stored already
+func (s mongoStg) HistoryCheckpoint(ctx context.Context, profid string, checkpoint *model.Checkpoint) error {
+	if err := getByID(s.profCol(ctx), profid, &ProfileDB{}, permit(ctx, confirm(nil), WRITES)); err != nil {
+		return err
+	}
+
+	filter := bson.M{
+		"_id": bson.ObjectIdHex(profid),
+		"$or": []bson.M{
+			{"checkpoint": nil},
+			{"checkpoint.rev": bson.M{"$lt": checkpoint.Rev}},
 		},
 	}
+	err := s.profCol(ctx).Update(filter, bson.M{"$set": bson.M{"checkpoint": checkpoint}})
+	if err == mgo.ErrNotFound {
+		// concurrent update has stored newer checkpoint
+		return nil
+	}
+	return err
+}
 
-	oid, _ := toObjectId(profile.ID) // err already checked above
-	filter := confirm(nil)
-	filter["_id"] = oid
+// ################ Session CRUD section ####################
 
-	err = s.col(ctx).Update(filter, update)
+// SessionInsert creates new session of context user. it overrides ID if any
+func (s mongoStg) SessionInsert(ctx context.Context, sessm *model.Session) (*model.Session, error) {
+	if !isOwner(ctx, sessm.UserID) {
+		return nil, mgo.ErrNotFound
+	}
+
+	sess := &SessionDB{
+		Session: *sessm,
+		ID:      bson.NewObjectId(),
+	}
 
-	return profile, err
+	err := s.sessCol(ctx).Insert(sess)
+	return sess.Model(), err
 }
 
-// ################ History CRUD section ####################
+// SessionByRefresh looks for not expired session by refresh token digest
+func (s mongoStg) SessionByRefresh(ctx context.Context, refresh string) (*model.Session, error) {
+	sess := &SessionDB{}
+	filter := bson.M{
+		"refresh": refresh,
+		"expire":  bson.M{"$gt": time.Now()},
+	}
+	err := s.sessCol(ctx).Find(owned(ctx, filter, "userid")).One(sess)
+	return sess.Model(), err
+}
+
+// SessionSet gets session applying optional filter and modifies the object
+func (s mongoStg) SessionSet(ctx context.Context, sessid string, fields model.Fields, filter *Query) (*model.Session, error) {
+	id, err := toObjectId(sessid)
+	if err != nil {
+		return nil, err
+	}
+	cond, err := filter.filter()
+	if err != nil {
+		return nil, err
+	}
+
+	query := owned(ctx, cond, "userid")
+	query["_id"] = id
+
+	c := s.sessCol(ctx)
+	err = c.Update(query, bson.M{"$set": bson.M(fields)})
+	if err != nil {
+		return nil, err
+	}
+
+	sess := &SessionDB{}
+	err = c.FindId(id).One(sess)
+	return sess.Model(), err
+}
+
+// SessionDelete revokes session of context user
+func (s mongoStg) SessionDelete(ctx context.Context, sessid string) error {
+	id, err := toObjectId(sessid)
+	if err != nil {
+		return err
+	}
+
+	filter := owned(ctx, nil, "userid")
+	filter["_id"] = id
+	return s.sessCol(ctx).Remove(filter)
+}
+
+// SessionDeleteByUser revokes all sessions of the user (e.g. when password is changed)
+func (s mongoStg) SessionDeleteByUser(ctx context.Context, userid string) error {
+	filter := owned(ctx, bson.M{"userid": userid}, "userid")
+	_, err := s.sessCol(ctx).RemoveAll(filter)
+	return err
+}
+
+// ################ Audit CRUD section ####################
 
-// HistoryGet requests changes on behalf of context user.
-func (s mongoStg) HistoryGet(ctx context.Context, profid string) ([]*model.Change, error) {
-	// check permissions
-	if err := requestAccess(ctx, profid); err != nil {
+// AuditInsert appends record to audit trail of context user. it overrides ID if any
+func (s mongoStg) AuditInsert(ctx context.Context, recm *model.AuditRecord) (*model.AuditRecord, error) {
+	if !isOwner(ctx, recm.UserID) {
+		return nil, mgo.ErrNotFound
+	}
+
+	rec := &AuditDB{
+		AuditRecord: *recm,
+		ID:          bson.NewObjectId(),
+	}
+
+	err := s.auditCol(ctx).Insert(rec)
+	return rec.Model(), err
+}
+
+// AuditGet requests audit trail of the user on behalf of context user
+func (s mongoStg) AuditGet(ctx context.Context, userid string) ([]*model.AuditRecord, error) {
+	if !isOwner(ctx, userid) {
+		return nil, mgo.ErrNotFound
+	}
+
+	adbs := []*AuditDB{}
+	query := s.auditCol(ctx).Find(bson.M{"userid": userid}).Sort("time").Limit(1000)
+	if err := query.All(&adbs); err != nil {
 		return nil, err
 	}
 
-	changes := &ChangesDB{}
-	err := s.getByID(ctx, profid, changes, confirm(nil))
-	return changes.Model(), err
+	recs := make([]*model.AuditRecord, 0, len(adbs))
+	for _, a := range adbs {
+		recs = append(recs, a.Model())
+	}
+	return recs, nil
 }
 
 // ############### helper functions #################
 
-// fetch mongo object by string id
-func (s mongoStg) getByID(ctx context.Context, id string, obj interface{}, filter bson.M) error {
+// fetch mongo object of collection by string id
+func getByID(c *mgo.Collection, id string, obj interface{}, filter bson.M) error {
 	oid, err := toObjectId(id)
 	if err != nil {
 		return err
@@ -257,16 +781,134 @@ func (s mongoStg) getByID(ctx context.Context, id string, obj interface{}, filte
 	}
 	filter["_id"] = oid
 
-	return s.col(ctx).Find(filter).One(obj)
+	return c.Find(filter).One(obj)
+}
+
+// mustEnsureIndexes creates indexes of collection if they don't exist, it panics on error
+func mustEnsureIndexes(c *mgo.Collection, indexes []mgo.Index) {
+	for _, index := range indexes {
+		if err := c.EnsureIndex(index); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// profileCopy selects modified user fields that are copied to profile document (confirmation and ACL)
+func profileCopy(fields model.Fields) bson.M {
+	copied := bson.M{}
+	for key, val := range fields {
+		if key == "confirm" || key == "acl" || strings.HasPrefix(key, "acl.") {
+			copied[key] = val
+		}
+	}
+	return copied
 }
 
 // confirm adds to filter confirm clause
-func confirm(filter model.Fields) bson.M {
+func confirm(filter bson.M) bson.M {
 	if filter == nil {
-		filter = model.Fields{}
+		filter = bson.M{}
 	}
 	filter["confirm"] = true
-	return bson.M(filter)
+	return filter
+}
+
+// confirmed is confirm filter that isn't applied to privileged context user,
+// so admin inspects accounts that aren't confirmed yet
+func confirmed(ctx context.Context, filter bson.M) bson.M {
+	if !privileged(ctx) {
+		return confirm(filter)
+	}
+	if filter == nil {
+		filter = bson.M{}
+	}
+	return filter
+}
+
+// profilePath returns document path of profile field, mgo stores fields in lower case
+func profilePath(field string) string {
+	return "profile." + strings.ToLower(field)
+}
+
+// profileAfter builds clauses that select profiles following query cursor:
+// the first sort value is beyond cursor one, or it's equal and the second is beyond, and so on up to id
+func profileAfter(query *model.ProfileQuery) []bson.M {
+	clauses := make([]bson.M, 0, len(query.Sort)+1)
+	equal := bson.M{}
+	for i, key := range query.Sort {
+		op := "$gt"
+		if key.Desc {
+			op = "$lt"
+		}
+
+		clause := bson.M{profilePath(key.Field): bson.M{op: query.After.Values[i]}}
+		for path, val := range equal {
+			clause[path] = val
+		}
+		clauses = append(clauses, clause)
+		equal[profilePath(key.Field)] = query.After.Values[i]
+	}
+
+	equal["_id"] = bson.M{"$gt": bson.ObjectIdHex(query.After.ID)}
+	return append(clauses, equal)
+}
+
+// historyCheck rejects query with unknown field names, only profile fields start paths of changed fields
+func historyCheck(query *model.HistoryQuery) error {
+	known := map[string]bool{}
+	for _, field := range model.ProfileFields() {
+		known[field] = true
+	}
+	for _, field := range query.Fields {
+		if !known[field] {
+			return ErrQuery
+		}
+	}
+	return nil
+}
+
+// historyFilter selects changes of profile by query, {profid, rev} index serves it.
+// Changes after revision rev of the profile aren't applied yet, so they are skipped
+func historyFilter(profid bson.ObjectId, rev int64, query *model.HistoryQuery) bson.M {
+	filter := bson.M{"profid": profid}
+
+	period := bson.M{}
+	if !query.Since.IsZero() {
+		period["$gte"] = query.Since
+	}
+	if !query.Until.IsZero() {
+		period["$lt"] = query.Until
+	}
+	if len(period) > 0 {
+		filter["time"] = period
+	}
+
+	origin := map[string]string{"actor": query.Actor, "auth": query.Auth, "ip": query.IP, "requestid": query.RequestID}
+	for key, val := range origin {
+		if val != "" {
+			filter[key] = val
+		}
+	}
+
+	revs := bson.M{"$lte": rev}
+	if query.After != 0 {
+		op := "$gt"
+		if query.Desc {
+			op = "$lt"
+		}
+		revs[op] = query.After
+	}
+	filter["rev"] = revs
+
+	if len(query.Fields) > 0 {
+		// path of changed field starts with profile field, nested field or item may follow
+		roots := make([]interface{}, 0, len(query.Fields))
+		for _, field := range query.Fields {
+			roots = append(roots, bson.RegEx{Pattern: "^" + regexp.QuoteMeta(field) + `($|[.\[])`})
+		}
+		filter["fields"] = bson.M{"$elemMatch": bson.M{"path": bson.M{"$in": roots}}}
+	}
+	return filter
 }
 
 // toObjectId checks string first because ObjectIdHex(id) panics on incorrect input
@@ -278,11 +920,99 @@ func toObjectId(id string) (bson.ObjectId, error) {
 	return bson.ObjectIdHex(id), nil
 }
 
-// requestAccess checks if context user is entitled to access the object
-func requestAccess(ctx context.Context, id string) error {
+// ACL lists used by permit
+const (
+	READS  = "reads"
+	WRITES = "writes"
+)
+
+// roles that access any session or audit record
+const privilegedRoles = model.ROLE_ADMIN | model.ROLE_SYSTEM
+
+// permit restricts filter to objects that context user is entitled to access by ACL list (READS or WRITES) or owns.
+// Not permitted objects are just not matched, so they are indistinguishable from not existing ones
+func permit(ctx context.Context, filter bson.M, list string) bson.M {
 	user := model.CtxUser(ctx)
-	if user.ID != id {
-		return mgo.ErrNotFound
+	access := []bson.M{
+		{"acl." + list: bson.M{"$bitsAnySet": int64(user.AllRoles())}},
+	}
+	if bson.IsObjectIdHex(user.ID) {
+		access = append(access, bson.M{"_id": bson.ObjectIdHex(user.ID)})
+	}
+
+	return and(filter, bson.M{"$or": access})
+}
+
+// owned restricts filter to objects of context user, field keeps owner id.
+// privileged users access any object
+func owned(ctx context.Context, filter bson.M, field string) bson.M {
+	if privileged(ctx) {
+		return and(filter, nil)
+	}
+	return and(filter, bson.M{field: model.CtxUser(ctx).ID})
+}
+
+// isOwner checks if context user is entitled to access objects of the user (e.g. create session or read audit)
+func isOwner(ctx context.Context, userid string) bool {
+	return privileged(ctx) || model.CtxUser(ctx).ID == userid
+}
+
+// admin returns ID of context user if the object of the user is modified on behalf of somebody else
+func admin(ctx context.Context, userid string) string {
+	if user := model.CtxUser(ctx); user.ID != userid {
+		return user.ID
+	}
+	return ""
+}
+
+// stamp records in the change who has made it and the request origin
+func stamp(ctx context.Context, change *model.Change, profid string) {
+	change.Admin = admin(ctx, profid)
+	change.Actor = model.CtxUser(ctx).ID
+	change.Auth = model.CtxAuth(ctx).Method
+	change.Origin = model.CtxOrigin(ctx)
+}
+
+// limit restricts result size, zero limit means maximum one
+func limit(n int) int {
+	const max = 1000
+	if n <= 0 || n > max {
+		return max
+	}
+	return n
+}
+
+// privileged checks if context user has admin or system role
+func privileged(ctx context.Context) bool {
+	return model.CtxUser(ctx).AllRoles().Has(privilegedRoles)
+}
+
+// protect denies modification of permission fields to not privileged context user,
+// otherwise owner would be able to grant roles to own account
+func protect(ctx context.Context, fields model.Fields) error {
+	if privileged(ctx) {
+		return nil
+	}
+	for key := range fields {
+		if key == "roles" || key == "acl" || strings.HasPrefix(key, "acl.") {
+			return mgo.ErrNotFound
+		}
 	}
 	return nil
 }
+
+// and combines filter with clause, it never modifies the filter.
+// Result is new object, so caller is free to add more conditions
+func and(filter, clause bson.M) bson.M {
+	clauses := []bson.M{}
+	if len(filter) > 0 {
+		clauses = append(clauses, filter)
+	}
+	if len(clause) > 0 {
+		clauses = append(clauses, clause)
+	}
+	if len(clauses) == 0 {
+		return bson.M{}
+	}
+	return bson.M{"$and": clauses}
+}
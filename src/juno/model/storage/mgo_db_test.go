@@ -0,0 +1,217 @@
+package storage_test
+
+import (
+	"golang.org/x/net/context"
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/mgo.v2/dbtest"
+	"io/ioutil"
+	"juno/model"
+	"juno/model/storage"
+	"juno/model/storage/storagetest"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// mgoServer starts local mongod by dbtest harness, the test is skipped if mongod binary isn't available
+func mgoServer(t *testing.T) (*dbtest.DBServer, func()) {
+	if _, err := exec.LookPath("mongod"); err != nil {
+		t.Skip("mongod isn't found in PATH")
+	}
+
+	dir, err := ioutil.TempDir("", "juno-mgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbs := &dbtest.DBServer{}
+	dbs.SetPath(dir)
+	return dbs, func() {
+		dbs.Stop()
+		os.RemoveAll(dir)
+	}
+}
+
+// TestMgoConformance runs the suite against local mongod started by dbtest harness.
+// It's skipped if mongod binary isn't available
+func TestMgoConformance(t *testing.T) {
+	dbs, stop := mgoServer(t)
+	defer stop()
+
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		// previous test case has closed its storage, so all sessions are released
+		dbs.Wipe()
+		return storage.MgoMustInit(dbs.Session())
+	})
+}
+
+// TestMgoMigration checks that legacy people documents are split to users, profiles and changes
+func TestMgoMigration(t *testing.T) {
+	dbs, stop := mgoServer(t)
+	defer stop()
+
+	sess := dbs.Session()
+	defer sess.Close()
+
+	id := bson.NewObjectId()
+	legacy := bson.M{
+		"_id":      id,
+		"email":    "legacy@example.com",
+		"password": "hash",
+		"confirm":  true,
+		"profile":  bson.M{"firstname": "Will", "lastname": "Smith"},
+		"changes": []bson.M{
+			{"fields": bson.M{"FirstName": bson.M{"previous": "", "current": "Will"}}},
+			{"fields": bson.M{"LastName": bson.M{"previous": "", "current": "Smith"}}},
+		},
+	}
+	if err := sess.DB("").C(storage.MGO_PEOPLE).Insert(legacy); err != nil {
+		t.Fatal(err)
+	}
+
+	stg := storage.MgoMustInit(sess.Copy())
+	defer stg.Close()
+
+	ctx := model.SetCtxUser(context.Background(), model.System())
+	user, err := stg.UserGet(ctx, id.Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Email != "legacy@example.com" || !user.Confirm {
+		t.Fatalf("unexpected user %+v", user)
+	}
+
+	profile, err := stg.ProfileGet(ctx, id.Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.FirstName != "Will" || profile.LastName != "Smith" || profile.Rev != 3 {
+		t.Fatalf("unexpected profile %+v", profile)
+	}
+
+	changes, err := stg.HistoryGet(ctx, id.Hex(), &model.HistoryQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 || changes[0].Rev != 2 || changes[1].Rev != 3 || changes[0].Fields["FirstName"].Current != "Will" || changes[1].Fields["LastName"].Current != "Smith" {
+		t.Fatalf("unexpected changes %+v", changes)
+	}
+
+	// legacy history is chained on start
+	head, _, err := stg.HistoryHead(ctx, id.Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report := model.VerifyChain(id.Hex(), changes, head, nil, nil); !report.Valid || report.Length != 2 {
+		t.Fatalf("unexpected chain report %#v", report)
+	}
+
+	// history is sealed once, hash removed afterwards isn't restored on next start
+	err = sess.DB("").C(storage.MGO_CHANGES).Update(bson.M{"profid": id, "rev": 3}, bson.M{"$unset": bson.M{"hash": ""}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted := storage.MgoMustInit(sess.Copy())
+	defer restarted.Close()
+	if changes, err = restarted.HistoryGet(ctx, id.Hex(), &model.HistoryQuery{}); err != nil {
+		t.Fatal(err)
+	}
+	if report := model.VerifyChain(id.Hex(), changes, head, nil, nil); report.Valid || report.Broken != 3 {
+		t.Fatalf("unhashed change isn't reported %#v", report)
+	}
+
+	names, err := sess.DB("").CollectionNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		if name == storage.MGO_PEOPLE {
+			t.Fatal("legacy collection isn't dropped")
+		}
+	}
+}
+
+// TestMgoOrphanChange checks that change left by failed profile update neither shows in history
+// nor blocks the revision
+func TestMgoOrphanChange(t *testing.T) {
+	dbs, stop := mgoServer(t)
+	defer stop()
+
+	sess := dbs.Session()
+	defer sess.Close()
+
+	stg := storage.MgoMustInit(sess.Copy())
+	defer stg.Close()
+
+	ctx := model.SetCtxUser(context.Background(), model.System())
+	user, err := stg.UserInsert(ctx, &model.User{Email: "orphan@example.com", Password: "hash", Confirm: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orphan := bson.M{
+		"_id":    bson.NewObjectIdWithTime(time.Now().Add(-2 * storage.MGO_ORPHAN_AGE)),
+		"profid": bson.ObjectIdHex(user.ID),
+		"rev":    2,
+		"fields": []bson.M{{"path": "FirstName", "previous": "", "current": "Ghost"}},
+	}
+	if err := sess.DB("").C(storage.MGO_CHANGES).Insert(orphan); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := stg.HistoryGet(ctx, user.ID, &model.HistoryQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 0 {
+		t.Fatalf("orphan change is shown %+v", changes)
+	}
+
+	profile, err := stg.ProfileUpdate(ctx, &model.Profile{ID: user.ID, FirstName: "Will"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.Rev != 2 {
+		t.Fatalf("unexpected revision %d", profile.Rev)
+	}
+
+	changes, err = stg.HistoryGet(ctx, user.ID, &model.HistoryQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Fields["FirstName"].Current != "Will" {
+		t.Fatalf("unexpected changes %+v", changes)
+	}
+}
+
+// TestMgoFieldsList checks that changed fields stored as document are converted to list
+func TestMgoFieldsList(t *testing.T) {
+	dbs, stop := mgoServer(t)
+	defer stop()
+
+	sess := dbs.Session()
+	defer sess.Close()
+
+	id := bson.NewObjectId()
+	profile := &storage.ProfileDB{ID: id, Rev: 2, Confirm: true, ACL: model.DefaultACL()}
+	if err := sess.DB("").C(storage.MGO_PROFILES).Insert(profile); err != nil {
+		t.Fatal(err)
+	}
+	change := bson.M{"profid": id, "rev": 2, "fields": bson.M{"FirstName": bson.M{"previous": "", "current": "Will"}}}
+	if err := sess.DB("").C(storage.MGO_CHANGES).Insert(change); err != nil {
+		t.Fatal(err)
+	}
+
+	stg := storage.MgoMustInit(sess.Copy())
+	defer stg.Close()
+
+	ctx := model.SetCtxUser(context.Background(), model.System())
+	changes, err := stg.HistoryGet(ctx, id.Hex(), &model.HistoryQuery{Fields: []string{"FirstName"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Fields["FirstName"].Current != "Will" {
+		t.Fatalf("unexpected changes %+v", changes)
+	}
+}
@@ -0,0 +1,197 @@
+package storage
+
+import (
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"juno/model"
+	"time"
+)
+
+// MGO_PEOPLE is legacy collection that kept user, profile and history in one document
+const MGO_PEOPLE = "people"
+
+// MGO_MIGRATIONS keeps markers of one-time migrations that are done, marker ID is migration name
+const MGO_MIGRATIONS = "migrations"
+
+// names of one-time migrations: sealMigration chains history stored before it was hashed,
+// listMigration converts changed fields stored as document keyed by field name to list
+const (
+	sealMigration = "history-seal"
+	listMigration = "history-fields-list"
+)
+
+// peopleDB is document of legacy people collection, it's read by migration only
+type peopleDB struct {
+	ID         bson.ObjectId `bson:"_id"`
+	model.User `bson:",inline"`
+	ACL        model.ACL `bson:"acl"`
+	Rev        int64     `bson:"rev"`
+	Profile    model.Profile
+	Changes    []*legacyChange
+}
+
+// legacyChange is change of legacy document, changed fields are keyed by name there
+type legacyChange struct {
+	model.Change `bson:",inline"`
+	Fields       map[string]model.ChangedField `bson:"fields"`
+}
+
+// mgoMustMigrate moves documents of legacy people collection to users, profiles and changes collections.
+// Every document is moved by upserts and removed afterwards, so interrupted migration is resumed on next start.
+// It panics on error
+func mgoMustMigrate(db *mgo.Database) {
+	people := db.C(MGO_PEOPLE)
+	for {
+		doc := &peopleDB{}
+		err := people.Find(nil).One(doc)
+		if err == mgo.ErrNotFound {
+			break
+		}
+		if err != nil {
+			panic(err)
+		}
+
+		if err := migratePerson(db, doc); err != nil {
+			panic(err)
+		}
+		if err := people.RemoveId(doc.ID); err != nil {
+			panic(err)
+		}
+	}
+
+	// error means the collection has already been dropped
+	people.DropCollection()
+}
+
+// migratePerson splits legacy document
+func migratePerson(db *mgo.Database, doc *peopleDB) error {
+	// documents created before permissions were introduced get default ACL
+	if doc.ACL == (model.ACL{}) {
+		doc.ACL = model.DefaultACL()
+	}
+	// documents created before revisions were introduced have less revisions than changes,
+	// revision is raised, so each change gets own one
+	if min := int64(len(doc.Changes)) + 1; doc.Rev < min {
+		doc.Rev = min
+	}
+
+	user := &UserDB{ID: doc.ID, User: doc.User, ACL: doc.ACL}
+	if _, err := db.C(MGO_USERS).UpsertId(doc.ID, user); err != nil {
+		return err
+	}
+
+	profile := &ProfileDB{ID: doc.ID, Rev: doc.Rev, Confirm: doc.Confirm, ACL: doc.ACL, Profile: doc.Profile}
+	if _, err := db.C(MGO_PROFILES).UpsertId(doc.ID, profile); err != nil {
+		return err
+	}
+
+	// the last change produced current revision, legacy changes are chained as they are moved
+	first, head := doc.Rev-int64(len(doc.Changes))+1, ""
+	for i, legacy := range doc.Changes {
+		ch := legacy.Change
+		ch.Fields, ch.Rev = legacy.Fields, first+int64(i)
+		// legacy changes were made by the owner unless admin is set
+		if ch.Actor == "" {
+			ch.Actor = ch.Admin
+		}
+		if ch.Actor == "" {
+			ch.Actor = doc.ID.Hex()
+		}
+
+		change := newChangeDB(doc.ID, &ch)
+		change.Hash = ch.Digest(doc.ID.Hex(), head)
+		head = change.Hash
+		if _, err := db.C(MGO_CHANGES).Upsert(bson.M{"profid": doc.ID, "rev": change.Rev}, change); err != nil {
+			return err
+		}
+	}
+	return db.C(MGO_PROFILES).UpdateId(doc.ID, bson.M{"$set": bson.M{"head": head}})
+}
+
+// mgoMustListFields converts changed fields stored as document keyed by field name to list of FieldDB.
+// Hash of change doesn't depend on the form, so chain stays valid. It's run once, it panics on error
+func mgoMustListFields(db *mgo.Database) {
+	migrations := db.C(MGO_MIGRATIONS)
+	done, err := migrations.FindId(listMigration).Count()
+	if err != nil {
+		panic(err)
+	}
+	if done > 0 {
+		return
+	}
+
+	changes := db.C(MGO_CHANGES)
+	doc := struct {
+		ID     bson.ObjectId `bson:"_id"`
+		Fields bson.Raw      `bson:"fields"`
+	}{}
+	iter := changes.Find(nil).Select(bson.M{"fields": 1}).Iter()
+	for iter.Next(&doc) {
+		// interrupted migration has converted some changes already
+		if doc.Fields.Kind != 0x03 {
+			continue
+		}
+		fields := map[string]model.ChangedField{}
+		if err := doc.Fields.Unmarshal(&fields); err != nil {
+			panic(err)
+		}
+
+		cdb := newChangeDB(doc.ID, &model.Change{Fields: fields})
+		if err := changes.UpdateId(doc.ID, bson.M{"$set": bson.M{"fields": cdb.Fields}}); err != nil {
+			panic(err)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		panic(err)
+	}
+
+	if err := migrations.Insert(bson.M{"_id": listMigration, "time": time.Now()}); err != nil && !mgo.IsDup(err) {
+		panic(err)
+	}
+}
+
+// mgoMustSeal chains changes stored before history was hashed and sets heads of their profiles.
+// It's run once, marker is stored afterwards: change without hash found later is tampered and isn't sealed.
+// It's run before server accepts requests, so profiles aren't modified meanwhile. It panics on error
+func mgoMustSeal(db *mgo.Database) {
+	done, err := db.C(MGO_MIGRATIONS).FindId(sealMigration).Count()
+	if err != nil {
+		panic(err)
+	}
+	if done > 0 {
+		return
+	}
+
+	changes := db.C(MGO_CHANGES)
+
+	profids := []bson.ObjectId{}
+	if err := changes.Find(bson.M{"hash": bson.M{"$exists": false}}).Distinct("profid", &profids); err != nil {
+		panic(err)
+	}
+
+	for _, profid := range profids {
+		cdbs := []*ChangeDB{}
+		if err := changes.Find(bson.M{"profid": profid}).Sort("rev").All(&cdbs); err != nil {
+			panic(err)
+		}
+
+		head := ""
+		for _, cdb := range cdbs {
+			if cdb.Hash == "" {
+				cdb.Hash = cdb.Model().Digest(profid.Hex(), head)
+				if err := changes.UpdateId(cdb.ID, bson.M{"$set": bson.M{"hash": cdb.Hash}}); err != nil {
+					panic(err)
+				}
+			}
+			head = cdb.Hash
+		}
+
+		if err := db.C(MGO_PROFILES).UpdateId(profid, bson.M{"$set": bson.M{"head": head}}); err != nil && err != mgo.ErrNotFound {
+			panic(err)
+		}
+	}
+
+	if err := db.C(MGO_MIGRATIONS).Insert(bson.M{"_id": sealMigration, "time": time.Now()}); err != nil && !mgo.IsDup(err) {
+		panic(err)
+	}
+}
@@ -1,51 +1,114 @@
 package storage
 
 import (
+	"errors"
 	"golang.org/x/net/context"
 	"gopkg.in/mgo.v2/bson"
 	"juno/model"
 )
 
-// ModelDB represent structure for all BL objects
-type ModelDB struct {
-	ID         bson.ObjectId `bson:"_id"`
-	model.User `bson:",inline"`
-	Profile    model.Profile
-	Changes    []*model.Change
-}
-
-// User represents mongo specific fields for model User
+// UserDB is document of users collection, it keeps credentials and permissions
 type UserDB struct {
 	ID         bson.ObjectId `bson:"_id"`
 	model.User `bson:",inline"`
+	// ACL lists roles permitted to access the user and the profile besides the owner
+	ACL model.ACL `bson:"acl"`
 }
 
 func (db *UserDB) Model() *model.User {
 	db.User.ID = db.ID.Hex()
+	// ObjectId keeps creation time, Time() panics on empty id
+	if db.ID.Valid() {
+		db.User.Created = db.ID.Time()
+	}
 	return &db.User
 }
 
-// Profile represents mongo specific fields for model Profile
+// ProfileDB is document of profiles collection, its ID is ID of the user.
+// Confirm and ACL are copies of user ones, so profiles are permitted and filtered without reading credentials
 type ProfileDB struct {
-	ID      bson.ObjectId `bson:"_id"`
+	ID bson.ObjectId `bson:"_id"`
+	// Rev is profile revision, updates are atomic against it
+	Rev     int64     `bson:"rev"`
+	Confirm bool      `bson:"confirm"`
+	ACL     model.ACL `bson:"acl"`
 	Profile model.Profile
+	// Head is hash of the last change, it's updated together with revision
+	Head string `bson:"head"`
+	// Checkpoint is the last signed head of history
+	Checkpoint *model.Checkpoint `bson:"checkpoint,omitempty"`
 }
 
 func (db *ProfileDB) Model() *model.Profile {
 	db.Profile.ID = db.ID.Hex()
+	db.Profile.Rev = db.Rev
 	return &db.Profile
 }
 
-// ChangesDB is the mongo specific wrapper for model []Change
-type ChangesDB struct {
-	ID      bson.ObjectId `bson:"_id"`
-	Changes []*model.Change
+// ChangeDB is document of changes collection, one per profile revision.
+// Changes are only inserted, so history never rewrites the profile document
+type ChangeDB struct {
+	// ID is generated by mongo if it's empty (migration upserts changes)
+	ID     bson.ObjectId `bson:"_id,omitempty"`
+	ProfID bson.ObjectId `bson:"profid"`
+	// Rev is profile revision produced by the change
+	Rev          int64 `bson:"rev"`
+	model.Change `bson:",inline"`
+	// Fields are kept as list: mongo reads dots of paths (e.g. "Addresses[1].City") as nesting of keys
+	Fields []FieldDB `bson:"fields"`
+}
+
+// FieldDB is changed field of ChangeDB
+type FieldDB struct {
+	Path     string      `bson:"path"`
+	Previous interface{} `bson:"previous"`
+	Current  interface{} `bson:"current"`
+}
+
+// newChangeDB makes document of profile change, ID is left empty
+func newChangeDB(profid bson.ObjectId, change *model.Change) *ChangeDB {
+	cdb := &ChangeDB{ProfID: profid, Rev: change.Rev, Change: *change}
+	for _, path := range change.Paths() {
+		field := change.Fields[path]
+		cdb.Fields = append(cdb.Fields, FieldDB{Path: path, Previous: field.Previous, Current: field.Current})
+	}
+	return cdb
+}
+
+func (db *ChangeDB) Model() *model.Change {
+	db.Change.Rev = db.Rev
+	db.Change.Fields = make(map[string]model.ChangedField, len(db.Fields))
+	for _, f := range db.Fields {
+		db.Change.Fields[f.Path] = model.ChangedField{Previous: f.Previous, Current: f.Current}
+	}
+	return &db.Change
 }
 
-func (db *ChangesDB) Model() []*model.Change {
-	return db.Changes
+// SessionDB represents mongo specific fields for model Session
+type SessionDB struct {
+	ID            bson.ObjectId `bson:"_id"`
+	model.Session `bson:",inline"`
 }
 
+func (db *SessionDB) Model() *model.Session {
+	db.Session.ID = db.ID.Hex()
+	return &db.Session
+}
+
+// AuditDB represents mongo specific fields for model AuditRecord
+type AuditDB struct {
+	ID                bson.ObjectId `bson:"_id"`
+	model.AuditRecord `bson:",inline"`
+}
+
+func (db *AuditDB) Model() *model.AuditRecord {
+	db.AuditRecord.ID = db.ID.Hex()
+	return &db.AuditRecord
+}
+
+// ErrConflict is returned by both storages if object has been modified since requested revision
+var ErrConflict = errors.New("revision conflict")
+
 // storage represents CRUD-like operation for each object
 // it is aware of model, but model doesn't aware of storage
 // For now only mongoDB is available
@@ -54,20 +117,41 @@ type Storage interface {
 	Close()
 	IsErrNotFound(error) bool
 	IsErrDup(error) bool
+	IsErrConflict(error) bool
 
 	// ############## User Section ########################
-	UserSearch(ctx context.Context, filter model.Fields) (*model.User, error)
+	UserSearch(ctx context.Context, filter *Query) (*model.User, error)
 	UserInsert(ctx context.Context, user *model.User) (*model.User, error)
 	UserGet(ctx context.Context, userid string) (*model.User, error)
-	UserSet(ctx context.Context, userid string, fields, filter model.Fields) (*model.User, error)
+	UserSet(ctx context.Context, userid string, fields model.Fields, filter *Query) (*model.User, error)
+	UserList(ctx context.Context, query *model.UserQuery) ([]*model.User, error)
+	UserDelete(ctx context.Context, userid string) error
 
 	// ############## Profile Section ###################
-	ProfileSearch(ctx context.Context, filter model.Fields) ([]*model.Profile, error)
+	ProfileSearch(ctx context.Context, query *model.ProfileQuery) ([]*model.Profile, error)
+	// ProfileText finds profiles by text, hits are ordered by relevance
+	ProfileText(ctx context.Context, query *model.TextQuery) ([]*model.TextHit, error)
 	ProfileGet(ctx context.Context, profid string) (*model.Profile, error)
+	// ProfileAdminGet gets profile of unconfirmed account too if context user is privileged
+	ProfileAdminGet(ctx context.Context, profid string) (*model.Profile, error)
+	// ProfileUpdate is conditional if profile.Rev isn't zero, it updates unconfirmed account too if context user is privileged
 	ProfileUpdate(ctx context.Context, profile *model.Profile) (*model.Profile, error)
 
 	// ############## History Section ###################
-	HistoryGet(ctx context.Context, histid string) ([]*model.Change, error)
+	HistoryGet(ctx context.Context, profid string, query *model.HistoryQuery) ([]*model.Change, error)
+	HistoryHead(ctx context.Context, profid string) (head, checkpoint *model.Checkpoint, err error)
+	HistoryCheckpoint(ctx context.Context, profid string, checkpoint *model.Checkpoint) error
+
+	// ############## Session Section ###################
+	SessionInsert(ctx context.Context, session *model.Session) (*model.Session, error)
+	SessionByRefresh(ctx context.Context, refresh string) (*model.Session, error)
+	SessionSet(ctx context.Context, sessid string, fields model.Fields, filter *Query) (*model.Session, error)
+	SessionDelete(ctx context.Context, sessid string) error
+	SessionDeleteByUser(ctx context.Context, userid string) error
+
+	// ############## Audit Section ###################
+	AuditInsert(ctx context.Context, rec *model.AuditRecord) (*model.AuditRecord, error)
+	AuditGet(ctx context.Context, userid string) ([]*model.AuditRecord, error)
 }
 
 // type of function that release db resourses
@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"errors"
+	"gopkg.in/mgo.v2/bson"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ErrQuery is returned if query refers to field that isn't allowed for filtering or has non scalar value
+var ErrQuery = errors.New("storage: invalid query")
+
+// queryFields is allow-list of fields that can be filtered by Query (user and session ones)
+var queryFields = map[string]bool{
+	"email":        true,
+	"confirm":      true,
+	"confirmtoken": true,
+	"resettoken":   true,
+	"newemail":     true,
+	"emailtoken":   true,
+	"disabled":     true,
+	"refresh":      true,
+	"userid":       true,
+	"expire":       true,
+}
+
+// Query is typed filter of stored objects, conditions are combined by AND.
+// Values are always compared as data, so they can't inject storage operators.
+// Invalid condition makes the whole query invalid, storage rejects it with ErrQuery.
+//
+//	storage.Eq("email", email).Eq("confirm", false)
+type Query struct {
+	conds []bson.M
+	err   error
+}
+
+// Eq starts query with equality condition
+func Eq(field string, val interface{}) *Query {
+	return (&Query{}).Eq(field, val)
+}
+
+// Range starts query with range condition
+func Range(field string, from, to interface{}) *Query {
+	return (&Query{}).Range(field, from, to)
+}
+
+// Prefix starts query with prefix condition
+func Prefix(field, prefix string) *Query {
+	return (&Query{}).Prefix(field, prefix)
+}
+
+// In starts query with in-list condition
+func In(field string, vals ...interface{}) *Query {
+	return (&Query{}).In(field, vals...)
+}
+
+// Eq adds condition: field is equal to val
+func (q *Query) Eq(field string, val interface{}) *Query {
+	return q.add(field, bson.M{"$eq": val}, val)
+}
+
+// Range adds condition: field is from (inclusive) to (exclusive), nil bound isn't applied
+func (q *Query) Range(field string, from, to interface{}) *Query {
+	cond := bson.M{}
+	if from != nil {
+		cond["$gte"] = from
+	}
+	if to != nil {
+		cond["$lt"] = to
+	}
+	if len(cond) == 0 {
+		q.err = ErrQuery
+		return q
+	}
+	return q.add(field, cond, from, to)
+}
+
+// Prefix adds condition: string field starts with prefix, prefix is matched literally
+func (q *Query) Prefix(field, prefix string) *Query {
+	return q.add(field, bson.RegEx{Pattern: "^" + regexp.QuoteMeta(prefix)}, prefix)
+}
+
+// In adds condition: field is equal to any of vals
+func (q *Query) In(field string, vals ...interface{}) *Query {
+	return q.add(field, bson.M{"$in": vals}, vals...)
+}
+
+// add appends condition if field is allowed and values are scalars
+func (q *Query) add(field string, cond interface{}, vals ...interface{}) *Query {
+	if strings.HasPrefix(field, "$") || strings.Contains(field, ".") || !queryFields[field] {
+		q.err = ErrQuery
+	}
+	for _, val := range vals {
+		if val != nil && !scalar(val) {
+			q.err = ErrQuery
+		}
+	}
+
+	q.conds = append(q.conds, bson.M{field: cond})
+	return q
+}
+
+// filter translates query to mongo filter, nil query selects everything
+func (q *Query) filter() (bson.M, error) {
+	switch {
+	case q == nil:
+		return nil, nil
+	case q.err != nil:
+		return nil, q.err
+	case len(q.conds) == 0:
+		return nil, nil
+	case len(q.conds) == 1:
+		return q.conds[0], nil
+	}
+	return bson.M{"$and": q.conds}, nil
+}
+
+// scalar checks that value is stored as plain bson value, not as document or array
+func scalar(val interface{}) bool {
+	switch val.(type) {
+	case time.Time, bson.ObjectId:
+		return true
+	}
+
+	switch reflect.TypeOf(val).Kind() {
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,1159 @@
+// Package storagetest provides conformance suite for storage.Storage implementations.
+// Every backend should pass it, so BL layer can rely on the same behaviour regardless of the backend.
+package storagetest
+
+import (
+	"golang.org/x/net/context"
+	"gopkg.in/mgo.v2/bson"
+	"juno/model"
+	"juno/model/storage"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Factory returns new empty storage for each test case.
+// The suite closes storage when test case is done.
+type Factory func(t *testing.T) storage.Storage
+
+// Run executes the conformance suite against storages created by factory
+func Run(t *testing.T, factory Factory) {
+	cases := []struct {
+		name string
+		test func(*testing.T, storage.Storage)
+	}{
+		{"UserInsertGet", testUserInsertGet},
+		{"UserUniqueEmail", testUserUniqueEmail},
+		{"UserSearch", testUserSearch},
+		{"UserSet", testUserSet},
+		{"Query", testQuery},
+		{"QueryInjection", testQueryInjection},
+		{"UserListDelete", testUserListDelete},
+		{"ProfileUnconfirmedHidden", testProfileUnconfirmedHidden},
+		{"ProfileUpdateHistory", testProfileUpdateHistory},
+		{"HistoryQuery", testHistoryQuery},
+		{"HistoryOrigin", testHistoryOrigin},
+		{"HistoryChain", testHistoryChain},
+		{"HistoryUnsigned", testHistoryUnsigned},
+		{"ProfileCrossAccess", testProfileCrossAccess},
+		{"ProfileSearch", testProfileSearch},
+		{"ProfileText", testProfileText},
+		{"ProfileRevision", testProfileRevision},
+		{"ProfileConcurrentUpdate", testProfileConcurrentUpdate},
+		{"Permissions", testPermissions},
+		{"ACL", testACL},
+		{"NotFound", testNotFound},
+		{"Session", testSession},
+		{"Audit", testAudit},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			stg := factory(t)
+			defer stg.Close()
+			c.test(t, stg)
+		})
+	}
+}
+
+// ######################## User Section ##########################
+
+func testUserInsertGet(t *testing.T, stg storage.Storage) {
+	ctx, release := reserve(stg, nil)
+	defer release()
+
+	user, err := stg.UserInsert(ctx, &model.User{ID: "ignored", Email: "a@mail.com", Password: "pass"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.ID == "" || user.ID == "ignored" {
+		t.Fatalf("insert has to assign new ID, got %q", user.ID)
+	}
+
+	got, err := stg.UserGet(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != user.ID || got.Email != "a@mail.com" || got.Confirm {
+		t.Fatalf("unexpected user %#v", got)
+	}
+}
+
+func testUserUniqueEmail(t *testing.T, stg storage.Storage) {
+	ctx, release := reserve(stg, nil)
+	defer release()
+
+	mustInsert(t, stg, ctx, "dup@mail.com", "pass1")
+
+	_, err := stg.UserInsert(ctx, &model.User{Email: "dup@mail.com", Password: "pass2"})
+	if err == nil {
+		t.Fatal("second insert with the same email should fail")
+	}
+	if !stg.IsErrDup(err) {
+		t.Fatalf("expected dup error, got %v", err)
+	}
+	if stg.IsErrNotFound(err) {
+		t.Fatalf("dup error mustn't be classified as not found: %v", err)
+	}
+}
+
+func testUserSearch(t *testing.T, stg storage.Storage) {
+	ctx, release := reserve(stg, nil)
+	defer release()
+
+	user := mustInsert(t, stg, ctx, "search@mail.com", "pass")
+
+	got, err := stg.UserSearch(ctx, storage.Eq("email", "search@mail.com").Eq("confirm", false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != user.ID {
+		t.Fatalf("expected user %s, got %s", user.ID, got.ID)
+	}
+
+	_, err = stg.UserSearch(ctx, storage.Eq("email", "search@mail.com").Eq("confirm", true))
+	if !stg.IsErrNotFound(err) {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+}
+
+func testUserSet(t *testing.T, stg storage.Storage) {
+	ctx, release := reserve(stg, nil)
+	defer release()
+
+	user := mustInsert(t, stg, ctx, "set@mail.com", "pass")
+
+	fields := model.Fields{"confirm": true}
+	filter := storage.Eq("confirm", false)
+	got, err := stg.UserSet(ctx, user.ID, fields, filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Confirm || got.ID != user.ID {
+		t.Fatalf("user hasn't been modified: %#v", got)
+	}
+
+	// filter doesn't match anymore
+	_, err = stg.UserSet(ctx, user.ID, fields, storage.Eq("confirm", false))
+	if !stg.IsErrNotFound(err) {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+}
+
+func testQuery(t *testing.T, stg storage.Storage) {
+	ctx, release := reserve(stg, nil)
+	defer release()
+
+	first := mustInsert(t, stg, ctx, "first.query@mail.com", "pass")
+	second := mustConfirm(t, stg, ctx, mustInsert(t, stg, ctx, "second.query@mail.com", "pass"))
+
+	cases := []struct {
+		query *storage.Query
+		id    string
+	}{
+		{storage.Prefix("email", "first."), first.ID},
+		{storage.Prefix("email", "second").Eq("confirm", true), second.ID},
+		{storage.In("email", "none@mail.com", "second.query@mail.com"), second.ID},
+		{storage.Range("email", "s", "t"), second.ID},
+		{storage.Range("email", nil, "g").Prefix("email", "f"), first.ID},
+		{storage.Prefix("email", "first").Eq("confirm", true), ""},
+		{storage.Prefix("email", "f.*"), ""},
+		{storage.Range("email", "t", nil), ""},
+	}
+	for i, c := range cases {
+		user, err := stg.UserSearch(ctx, c.query)
+		if c.id == "" {
+			if !stg.IsErrNotFound(err) {
+				t.Fatalf("case %d: expected not found error, got %v", i, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("case %d: %v", i, err)
+		}
+		if user.ID != c.id {
+			t.Fatalf("case %d: expected user %s, got %s", i, c.id, user.ID)
+		}
+	}
+}
+
+// testQueryInjection checks that malicious keys and values are rejected or compared literally
+func testQueryInjection(t *testing.T, stg storage.Storage) {
+	ctx, release := reserve(stg, nil)
+	defer release()
+
+	user := mustInsert(t, stg, ctx, "victim@mail.com", "pass")
+
+	invalid := []*storage.Query{
+		storage.Eq("$where", "true"),
+		storage.Eq("email.$ne", ""),
+		storage.Eq("acl.reads", 1),
+		storage.Eq("roles", model.ROLE_ADMIN),
+		storage.Eq("email", "victim@mail.com").Eq("password", "pass"),
+		storage.Eq("email", bson.M{"$ne": ""}),
+		storage.Eq("email", map[string]interface{}{"$gt": ""}),
+		storage.Eq("email", []string{"victim@mail.com"}),
+		storage.In("email", bson.M{"$exists": true}),
+		storage.Range("email", bson.M{"$gt": ""}, nil),
+		storage.Range("email", nil, nil),
+		storage.Eq("email", "victim@mail.com").Eq("$or", "x"),
+	}
+	for i, q := range invalid {
+		if _, err := stg.UserSearch(ctx, q); err != storage.ErrQuery {
+			t.Fatalf("case %d: expected ErrQuery, got %v", i, err)
+		}
+		if _, err := stg.UserSet(ctx, user.ID, model.Fields{"confirm": true}, q); err != storage.ErrQuery {
+			t.Fatalf("case %d: set expected ErrQuery, got %v", i, err)
+		}
+	}
+
+	// operator-like strings are data
+	for _, email := range []string{`{"$ne": ""}`, "$ne", `{"$gt":""}`, ".*", "^victim"} {
+		if _, err := stg.UserSearch(ctx, storage.Eq("email", email)); !stg.IsErrNotFound(err) {
+			t.Fatalf("%s: expected not found error, got %v", email, err)
+		}
+		if _, err := stg.UserSearch(ctx, storage.Prefix("email", email)); !stg.IsErrNotFound(err) {
+			t.Fatalf("prefix %s: expected not found error, got %v", email, err)
+		}
+	}
+
+	got, err := stg.UserGet(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Confirm {
+		t.Fatal("user is modified by invalid query")
+	}
+}
+
+func testUserListDelete(t *testing.T, stg storage.Storage) {
+	ctx, release := reserve(stg, nil)
+	defer release()
+
+	first := mustInsert(t, stg, ctx, "First@mail.com", "pass")
+	second := mustConfirm(t, stg, ctx, mustInsert(t, stg, ctx, "second@mail.com", "pass"))
+	mustInsert(t, stg, ctx, "third@post.com", "pass")
+
+	yes, no := true, false
+	cases := []struct {
+		query model.UserQuery
+		ids   []string
+	}{
+		{model.UserQuery{Email: "first"}, []string{first.ID}},
+		{model.UserQuery{Email: "MAIL.COM"}, []string{first.ID, second.ID}},
+		{model.UserQuery{Email: "mail", Confirm: &yes}, []string{second.ID}},
+		{model.UserQuery{Email: "mail", Offset: 1, Limit: 1}, []string{second.ID}},
+		{model.UserQuery{Disabled: &no, Limit: 1}, []string{first.ID}},
+		{model.UserQuery{Disabled: &yes}, []string{}},
+		{model.UserQuery{CreatedFrom: time.Now().Add(time.Hour)}, []string{}},
+		{model.UserQuery{CreatedTo: time.Now().Add(time.Hour), Email: "first"}, []string{first.ID}},
+	}
+	for i, c := range cases {
+		users, err := stg.UserList(ctx, &c.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := []string{}
+		for _, u := range users {
+			ids = append(ids, u.ID)
+		}
+		if !reflect.DeepEqual(ids, c.ids) {
+			t.Fatalf("case %d: expected users %v, got %v", i, c.ids, ids)
+		}
+	}
+
+	// users aren't listed and deleted on behalf of other user
+	uctx := model.SetCtxUser(ctx, second)
+	if users, err := stg.UserList(uctx, &model.UserQuery{}); err != nil || len(users) != 1 || users[0].ID != second.ID {
+		t.Fatalf("user lists foreign users: %v, %v", users, err)
+	}
+	if err := stg.UserDelete(uctx, first.ID); !stg.IsErrNotFound(err) {
+		t.Fatalf("user deletes foreign user: expected not found error, got %v", err)
+	}
+
+	if err := stg.UserDelete(ctx, first.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stg.UserGet(ctx, first.ID); !stg.IsErrNotFound(err) {
+		t.Fatalf("deleted user: expected not found error, got %v", err)
+	}
+	if err := stg.UserDelete(ctx, first.ID); !stg.IsErrNotFound(err) {
+		t.Fatalf("second delete: expected not found error, got %v", err)
+	}
+}
+
+// ######################## Profile Section ##########################
+
+func testProfileUnconfirmedHidden(t *testing.T, stg storage.Storage) {
+	ctx, release := reserve(stg, nil)
+	defer release()
+
+	hidden := mustInsert(t, stg, ctx, "hidden@mail.com", "pass")
+	visible := mustConfirm(t, stg, ctx, mustInsert(t, stg, ctx, "visible@mail.com", "pass"))
+
+	_, err := stg.ProfileGet(ctx, hidden.ID)
+	if !stg.IsErrNotFound(err) {
+		t.Fatalf("unconfirmed profile: expected not found error, got %v", err)
+	}
+
+	profile, err := stg.ProfileGet(ctx, visible.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.ID != visible.ID {
+		t.Fatalf("expected profile %s, got %s", visible.ID, profile.ID)
+	}
+
+	profiles, err := stg.ProfileSearch(ctx, &model.ProfileQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(profiles) != 1 || profiles[0].ID != visible.ID {
+		t.Fatalf("expected only confirmed profile %s, got %v", visible.ID, profiles)
+	}
+
+	// admin lookup finds unconfirmed profile for privileged user only
+	if profile, err = stg.ProfileAdminGet(ctx, hidden.ID); err != nil || profile.ID != hidden.ID {
+		t.Fatalf("expected unconfirmed profile %s, got %v: %v", hidden.ID, profile, err)
+	}
+	if _, err := stg.HistoryGet(ctx, hidden.ID, &model.HistoryQuery{}); err != nil {
+		t.Fatalf("expected history of unconfirmed profile, got %v", err)
+	}
+	// privileged user updates unconfirmed profile, the owner doesn't
+	if profile, err = stg.ProfileUpdate(ctx, &model.Profile{ID: hidden.ID, FirstName: "Moderated"}); err != nil || profile.Rev != 2 {
+		t.Fatalf("expected update of unconfirmed profile, got %v: %v", profile, err)
+	}
+	ownerCtx, release := reserve(stg, hidden)
+	defer release()
+	if _, err = stg.ProfileAdminGet(ownerCtx, hidden.ID); !stg.IsErrNotFound(err) {
+		t.Fatalf("unconfirmed profile for owner: expected not found error, got %v", err)
+	}
+	if _, err = stg.ProfileUpdate(ownerCtx, &model.Profile{ID: hidden.ID, FirstName: "Owner"}); !stg.IsErrNotFound(err) {
+		t.Fatalf("unconfirmed profile update by owner: expected not found error, got %v", err)
+	}
+}
+
+func testProfileUpdateHistory(t *testing.T, stg storage.Storage) {
+	ctx, release := reserve(stg, nil)
+	defer release()
+
+	user := mustConfirm(t, stg, ctx, mustInsert(t, stg, ctx, "owner@mail.com", "pass"))
+	ctx = model.SetCtxUser(ctx, user)
+
+	profile := &model.Profile{ID: user.ID, FirstName: "John", Age: 30}
+	if _, err := stg.ProfileUpdate(ctx, profile); err != nil {
+		t.Fatal(err)
+	}
+
+	profile = &model.Profile{ID: user.ID, FirstName: "Will", Age: 30}
+	if _, err := stg.ProfileUpdate(ctx, profile); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := stg.ProfileGet(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.FirstName != "Will" || got.Age != 30 {
+		t.Fatalf("profile hasn't been updated: %#v", got)
+	}
+
+	changes, err := stg.HistoryGet(ctx, user.ID, &model.HistoryQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 {
+		t.Fatalf("expected 2 changes, got %d", len(changes))
+	}
+
+	last := changes[1].Fields
+	if len(last) != 1 {
+		t.Fatalf("expected only FirstName change, got %v", last)
+	}
+	if f := last["FirstName"]; f.Previous != "John" || f.Current != "Will" {
+		t.Fatalf("unexpected FirstName change %#v", f)
+	}
+}
+
+func testHistoryQuery(t *testing.T, stg storage.Storage) {
+	ctx, release := reserve(stg, nil)
+	defer release()
+
+	user := mustConfirm(t, stg, ctx, mustInsert(t, stg, ctx, "history@mail.com", "pass"))
+
+	// revisions 2..6: names change every time, phone changes on odd revisions
+	for i := 0; i < 5; i++ {
+		profile := &model.Profile{ID: user.ID, FirstName: "Name" + strconv.Itoa(i), Phone: "+1 555 000" + strconv.Itoa(i/2)}
+		if _, err := stg.ProfileUpdate(ctx, profile); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	all, err := stg.HistoryGet(ctx, user.ID, &model.HistoryQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 5 {
+		t.Fatalf("expected 5 changes, got %d", len(all))
+	}
+
+	revs := func(changes []*model.Change) []int64 {
+		revs := []int64{}
+		for _, c := range changes {
+			revs = append(revs, c.Rev)
+		}
+		return revs
+	}
+
+	cases := []struct {
+		name  string
+		query model.HistoryQuery
+		revs  []int64
+	}{
+		{"all", model.HistoryQuery{}, []int64{2, 3, 4, 5, 6}},
+		{"desc", model.HistoryQuery{Desc: true}, []int64{6, 5, 4, 3, 2}},
+		{"limit", model.HistoryQuery{Limit: 2}, []int64{2, 3}},
+		{"after", model.HistoryQuery{After: 3, Limit: 2}, []int64{4, 5}},
+		{"desc after", model.HistoryQuery{Desc: true, After: 4}, []int64{3, 2}},
+		{"field", model.HistoryQuery{Fields: []string{"Phone"}}, []int64{2, 4, 6}},
+		{"fields", model.HistoryQuery{Fields: []string{"Phone", "FirstName"}, Desc: true, Limit: 1}, []int64{6}},
+		{"since", model.HistoryQuery{Since: all[3].Time}, []int64{5, 6}},
+		{"until", model.HistoryQuery{Until: all[1].Time}, []int64{2}},
+		{"period", model.HistoryQuery{Since: all[1].Time, Until: all[3].Time, Desc: true}, []int64{4, 3}},
+		{"empty", model.HistoryQuery{Fields: []string{"Age"}}, []int64{}},
+	}
+	for _, c := range cases {
+		changes, err := stg.HistoryGet(ctx, user.ID, &c.query)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if got := revs(changes); !reflect.DeepEqual(got, c.revs) {
+			t.Fatalf("%s: expected revisions %v, got %v", c.name, c.revs, got)
+		}
+	}
+
+	// field names become filter paths, so unknown ones are rejected
+	for _, field := range []string{"Password", "$where", "Phone.x"} {
+		_, err := stg.HistoryGet(ctx, user.ID, &model.HistoryQuery{Fields: []string{field}})
+		if err != storage.ErrQuery {
+			t.Fatalf("field %q: expected ErrQuery, got %v", field, err)
+		}
+	}
+}
+
+func testHistoryOrigin(t *testing.T, stg storage.Storage) {
+	ctx, release := reserve(stg, nil)
+	defer release()
+
+	owner := mustConfirm(t, stg, ctx, mustInsert(t, stg, ctx, "origin@mail.com", "pass"))
+	admin := &model.User{ID: bson.NewObjectId().Hex(), Roles: model.ROLE_ADMIN}
+	origin := model.Origin{IP: "10.0.0.1", UserAgent: "agent", RequestID: "req", Reason: "typo"}
+
+	octx := model.SetCtxUser(ctx, &model.User{ID: owner.ID, Roles: model.ROLE_USER})
+	octx = model.SetCtxAuth(octx, model.Auth{Method: model.AUTH_BEARER})
+	octx = model.SetCtxOrigin(octx, origin)
+	if _, err := stg.ProfileUpdate(octx, &model.Profile{ID: owner.ID, FirstName: "John"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stg.ProfileUpdate(model.SetCtxUser(ctx, admin), &model.Profile{ID: owner.ID, FirstName: "Will"}); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := stg.HistoryGet(ctx, owner.ID, &model.HistoryQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 {
+		t.Fatalf("expected 2 changes, got %d", len(changes))
+	}
+	if c := changes[0]; c.Actor != owner.ID || c.Admin != "" || c.Auth != model.AUTH_BEARER || c.Origin != origin {
+		t.Fatalf("unexpected owner change %#v", c)
+	}
+	if c := changes[1]; c.Actor != admin.ID || c.Admin != admin.ID || c.Auth != model.AUTH_NONE || c.Origin != (model.Origin{}) {
+		t.Fatalf("unexpected admin change %#v", c)
+	}
+
+	// each filter selects the change it matches only
+	queries := []struct {
+		query model.HistoryQuery
+		rev   int64
+	}{
+		{model.HistoryQuery{Actor: admin.ID}, 3},
+		{model.HistoryQuery{Auth: model.AUTH_BEARER}, 2},
+		{model.HistoryQuery{Auth: model.AUTH_NONE}, 3},
+		{model.HistoryQuery{IP: origin.IP}, 2},
+		{model.HistoryQuery{RequestID: origin.RequestID}, 2},
+		{model.HistoryQuery{Actor: owner.ID, Auth: model.AUTH_BEARER, IP: origin.IP, RequestID: origin.RequestID}, 2},
+		{model.HistoryQuery{Actor: admin.ID, RequestID: origin.RequestID}, 0},
+	}
+	for i, q := range queries {
+		changes, err = stg.HistoryGet(ctx, owner.ID, &q.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if q.rev == 0 && len(changes) != 0 || q.rev != 0 && (len(changes) != 1 || changes[0].Rev != q.rev) {
+			t.Fatalf("case %d: expected change %d only, got %#v", i, q.rev, changes)
+		}
+	}
+}
+
+func testHistoryChain(t *testing.T, stg storage.Storage) {
+	ctx, release := reserve(stg, nil)
+	defer release()
+
+	user := mustConfirm(t, stg, ctx, mustInsert(t, stg, ctx, "chain@mail.com", "pass"))
+
+	head, checkpoint, err := stg.HistoryHead(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.Rev != 1 || head.Hash != "" || checkpoint != nil {
+		t.Fatalf("unexpected head %#v, checkpoint %#v of new profile", head, checkpoint)
+	}
+
+	for _, name := range []string{"John", "Will", "Bob"} {
+		if _, err := stg.ProfileUpdate(ctx, &model.Profile{ID: user.ID, FirstName: name, Age: 30}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	changes, err := stg.HistoryGet(ctx, user.ID, &model.HistoryQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, _, err = stg.HistoryHead(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.Rev != 4 || head.Hash != changes[2].Hash {
+		t.Fatalf("head %#v doesn't point to the last change %#v", head, changes[2])
+	}
+
+	key := []byte("key")
+	signed := &model.Checkpoint{Rev: head.Rev, Hash: head.Hash, Time: time.Now()}
+	signed.Sign(user.ID, key)
+	if err := stg.HistoryCheckpoint(ctx, user.ID, signed); err != nil {
+		t.Fatal(err)
+	}
+	// older checkpoint doesn't replace newer one
+	if err := stg.HistoryCheckpoint(ctx, user.ID, &model.Checkpoint{Rev: 2, Hash: changes[0].Hash}); err != nil {
+		t.Fatal(err)
+	}
+
+	head, checkpoint, err = stg.HistoryHead(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report := model.VerifyChain(user.ID, changes, head, checkpoint, key); !report.Valid || report.Checkpoint != 4 {
+		t.Fatalf("unexpected report %#v", report)
+	}
+
+	other := model.SetCtxUser(ctx, &model.User{ID: bson.NewObjectId().Hex(), Roles: model.ROLE_USER})
+	if _, _, err := stg.HistoryHead(other, user.ID); !stg.IsErrNotFound(err) {
+		t.Fatalf("foreign history head: expected not found error, got %v", err)
+	}
+	if err := stg.HistoryCheckpoint(other, user.ID, signed); !stg.IsErrNotFound(err) {
+		t.Fatalf("foreign checkpoint: expected not found error, got %v", err)
+	}
+}
+
+// history written before the key was configured has no checkpoint, it's valid but unsigned until the next update is signed
+func testHistoryUnsigned(t *testing.T, stg storage.Storage) {
+	ctx, release := reserve(stg, nil)
+	defer release()
+
+	user := mustConfirm(t, stg, ctx, mustInsert(t, stg, ctx, "unsigned@mail.com", "pass"))
+	for _, name := range []string{"John", "Will"} {
+		if _, err := stg.ProfileUpdate(ctx, &model.Profile{ID: user.ID, FirstName: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	key := []byte("key")
+	changes, err := stg.HistoryGet(ctx, user.ID, &model.HistoryQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, checkpoint, err := stg.HistoryHead(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkpoint != nil {
+		t.Fatalf("unexpected checkpoint %#v of history written without key", checkpoint)
+	}
+	report := model.VerifyChain(user.ID, changes, head, checkpoint, key)
+	if !report.Valid || !report.Unsigned || report.Length != 2 || report.Head != 3 {
+		t.Fatalf("unsigned history: unexpected report %#v", report)
+	}
+
+	// the key is configured now, next update gets signed checkpoint
+	if _, err := stg.ProfileUpdate(ctx, &model.Profile{ID: user.ID, FirstName: "Bob"}); err != nil {
+		t.Fatal(err)
+	}
+	head, _, err = stg.HistoryHead(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := &model.Checkpoint{Rev: head.Rev, Hash: head.Hash, Time: time.Now()}
+	signed.Sign(user.ID, key)
+	if err := stg.HistoryCheckpoint(ctx, user.ID, signed); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err = stg.HistoryGet(ctx, user.ID, &model.HistoryQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, checkpoint, err = stg.HistoryHead(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report = model.VerifyChain(user.ID, changes, head, checkpoint, key)
+	if !report.Valid || report.Unsigned || report.Checkpoint != 4 {
+		t.Fatalf("signed history: unexpected report %#v", report)
+	}
+}
+
+func testProfileCrossAccess(t *testing.T, stg storage.Storage) {
+	ctx, release := reserve(stg, nil)
+	defer release()
+
+	owner := mustConfirm(t, stg, ctx, mustInsert(t, stg, ctx, "owner@mail.com", "pass"))
+	other := mustConfirm(t, stg, ctx, mustInsert(t, stg, ctx, "other@mail.com", "pass"))
+
+	for _, user := range []*model.User{other, model.Anonym()} {
+		uctx := model.SetCtxUser(ctx, user)
+
+		_, err := stg.ProfileUpdate(uctx, &model.Profile{ID: owner.ID, FirstName: "hacked"})
+		if !stg.IsErrNotFound(err) {
+			t.Fatalf("user %s updates foreign profile: expected not found error, got %v", user.ID, err)
+		}
+
+		_, err = stg.HistoryGet(uctx, owner.ID, &model.HistoryQuery{})
+		if !stg.IsErrNotFound(err) {
+			t.Fatalf("user %s reads foreign history: expected not found error, got %v", user.ID, err)
+		}
+	}
+
+	profile, err := stg.ProfileGet(ctx, owner.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.FirstName != "" {
+		t.Fatalf("foreign update has been applied: %#v", profile)
+	}
+}
+
+func testProfileSearch(t *testing.T, stg storage.Storage) {
+	ctx, release := reserve(stg, nil)
+	defer release()
+
+	data := []model.Profile{
+		{FirstName: "John", LastName: "Smith", Age: 30, Phone: "+1 212 555"},
+		{FirstName: "Johanna", LastName: "Smith", Age: 25, Address: "Main st. 1"},
+		{FirstName: "Will", LastName: "Jones", Age: 30},
+		{FirstName: "Jack", LastName: "Black", Age: 40, Address: "MAIN square"},
+	}
+	ids := make([]string, len(data))
+	for i := range data {
+		user := mustConfirm(t, stg, ctx, mustInsert(t, stg, ctx, "p"+strconv.Itoa(i)+"@mail.com", "pass"))
+		data[i].ID = user.ID
+		if _, err := stg.ProfileUpdate(ctx, &data[i]); err != nil {
+			t.Fatal(err)
+		}
+		ids[i] = user.ID
+	}
+
+	age, byAge := 30, []model.SortKey{{Field: "Age"}, {Field: "FirstName", Desc: true}}
+	cases := []struct {
+		query model.ProfileQuery
+		ids   []string
+	}{
+		{model.ProfileQuery{FirstName: "jo"}, []string{ids[0], ids[1]}},
+		{model.ProfileQuery{LastName: "SMITH", FirstName: "johN"}, []string{ids[0]}},
+		{model.ProfileQuery{FirstName: "o"}, []string{}},
+		{model.ProfileQuery{FirstName: ".*"}, []string{}},
+		{model.ProfileQuery{AgeFrom: &age}, []string{ids[0], ids[2], ids[3]}},
+		{model.ProfileQuery{AgeTo: &age}, []string{ids[0], ids[1], ids[2]}},
+		{model.ProfileQuery{AgeFrom: &age, AgeTo: &age}, []string{ids[0], ids[2]}},
+		{model.ProfileQuery{Address: "main"}, []string{ids[1], ids[3]}},
+		{model.ProfileQuery{Phone: "212"}, []string{ids[0]}},
+		{model.ProfileQuery{Sort: byAge}, []string{ids[1], ids[2], ids[0], ids[3]}},
+		{model.ProfileQuery{Sort: []model.SortKey{{Field: "LastName"}}, Limit: 2}, []string{ids[3], ids[2]}},
+		{model.ProfileQuery{Sort: byAge, After: &model.ProfileCursor{Values: []interface{}{30, "Will"}, ID: ids[2]}}, []string{ids[0], ids[3]}},
+	}
+	for i, c := range cases {
+		profiles, err := stg.ProfileSearch(ctx, &c.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, p := range profiles {
+			got = append(got, p.ID)
+		}
+		if !reflect.DeepEqual(got, c.ids) {
+			t.Fatalf("case %d: expected profiles %v, got %v", i, c.ids, got)
+		}
+	}
+
+	// pages of cursor walk don't overlap and cover all profiles
+	query := &model.ProfileQuery{Sort: []model.SortKey{{Field: "LastName", Desc: true}}, Limit: 1}
+	seen := []string{}
+	for {
+		profiles, err := stg.ProfileSearch(ctx, query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(profiles) == 0 {
+			break
+		}
+		seen = append(seen, profiles[0].ID)
+		query.After = query.Cursor(profiles[0])
+	}
+	if expected := []string{ids[0], ids[1], ids[2], ids[3]}; !reflect.DeepEqual(seen, expected) {
+		t.Fatalf("cursor walk: expected %v, got %v", expected, seen)
+	}
+}
+
+func testProfileText(t *testing.T, stg storage.Storage) {
+	ctx, release := reserve(stg, nil)
+	defer release()
+
+	data := []model.Profile{
+		{FirstName: "Anna", LastName: "Baker", Address: "Baker street 5"},
+		{FirstName: "Baker", LastName: "Anna", Address: "Main street"},
+		{FirstName: "John", LastName: "Smith", Address: "Baker street 7", Phone: "+1 555"},
+		{FirstName: "Hidden", LastName: "Baker"},
+	}
+	ids := make([]string, len(data))
+	for i := range data {
+		user := mustConfirm(t, stg, ctx, mustInsert(t, stg, ctx, "t"+strconv.Itoa(i)+"@mail.com", "pass"))
+		data[i].ID = user.ID
+		if _, err := stg.ProfileUpdate(ctx, &data[i]); err != nil {
+			t.Fatal(err)
+		}
+		ids[i] = user.ID
+	}
+	// the last profile isn't public
+	if _, err := stg.UserSet(ctx, ids[3], model.Fields{"acl.reads": model.ROLE_USER}, nil); err != nil {
+		t.Fatal(err)
+	}
+	// unconfirmed profile is never found
+	mustInsert(t, stg, ctx, "baker@mail.com", "pass")
+
+	actx := model.SetCtxUser(ctx, model.Anonym())
+	uctx := model.SetCtxUser(ctx, &model.User{ID: ids[0]})
+	cases := []struct {
+		ctx   context.Context
+		query model.TextQuery
+		ids   []string
+	}{
+		// matches in names weigh more than in address
+		{actx, model.TextQuery{Terms: []string{"baker"}}, []string{ids[0], ids[1], ids[2]}},
+		{actx, model.TextQuery{Terms: []string{"smith", "main"}}, []string{ids[2], ids[1]}},
+		{actx, model.TextQuery{Terms: []string{"555"}}, []string{}},
+		{actx, model.TextQuery{Terms: []string{"bake"}}, []string{}},
+		{actx, model.TextQuery{Terms: []string{"baker"}, Offset: 1, Limit: 1}, []string{ids[1]}},
+		{uctx, model.TextQuery{Terms: []string{"hidden"}}, []string{ids[3]}},
+		{actx, model.TextQuery{Terms: []string{"hidden"}}, []string{}},
+	}
+	for i, c := range cases {
+		hits, err := stg.ProfileText(c.ctx, &c.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, h := range hits {
+			got = append(got, h.Profile.ID)
+			if h.Score <= 0 {
+				t.Fatalf("case %d: expected positive score, got %v", i, h.Score)
+			}
+		}
+		if !reflect.DeepEqual(got, c.ids) {
+			t.Fatalf("case %d: expected profiles %v, got %v", i, c.ids, got)
+		}
+	}
+
+	// index follows profile changes
+	data[2].Address = "Elm street"
+	data[2].Rev = 0
+	if _, err := stg.ProfileUpdate(ctx, &data[2]); err != nil {
+		t.Fatal(err)
+	}
+	if err := stg.UserDelete(ctx, ids[1]); err != nil {
+		t.Fatal(err)
+	}
+	hits, err := stg.ProfileText(uctx, &model.TextQuery{Terms: []string{"baker", "elm"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, h := range hits {
+		got = append(got, h.Profile.ID)
+	}
+	if expected := []string{ids[0], ids[3], ids[2]}; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("after update: expected profiles %v, got %v", expected, got)
+	}
+}
+
+func testProfileRevision(t *testing.T, stg storage.Storage) {
+	ctx, release := reserve(stg, nil)
+	defer release()
+
+	user := mustConfirm(t, stg, ctx, mustInsert(t, stg, ctx, "owner@mail.com", "pass"))
+
+	profile, err := stg.ProfileGet(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.Rev != 1 {
+		t.Fatalf("expected the first revision, got %d", profile.Rev)
+	}
+
+	next, err := stg.ProfileUpdate(ctx, &model.Profile{ID: user.ID, FirstName: "John", Rev: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.Rev != 2 {
+		t.Fatalf("expected revision 2, got %d", next.Rev)
+	}
+
+	_, err = stg.ProfileUpdate(ctx, &model.Profile{ID: user.ID, FirstName: "Stale", Rev: 1})
+	if !stg.IsErrConflict(err) {
+		t.Fatalf("stale revision: expected conflict error, got %v", err)
+	}
+
+	// unconditional update
+	if next, err = stg.ProfileUpdate(ctx, &model.Profile{ID: user.ID, FirstName: "Will"}); err != nil {
+		t.Fatal(err)
+	}
+	if next.Rev != 3 {
+		t.Fatalf("expected revision 3, got %d", next.Rev)
+	}
+
+	got, err := stg.ProfileGet(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Rev != 3 || got.FirstName != "Will" {
+		t.Fatalf("unexpected profile %#v", got)
+	}
+	changes, err := stg.HistoryGet(ctx, user.ID, &model.HistoryQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 {
+		t.Fatalf("conflicting update has been recorded: %d changes", len(changes))
+	}
+}
+
+// history stays consistent under concurrent updates: each change starts where the previous one ends
+func testProfileConcurrentUpdate(t *testing.T, stg storage.Storage) {
+	ctx, release := reserve(stg, nil)
+	defer release()
+
+	user := mustConfirm(t, stg, ctx, mustInsert(t, stg, ctx, "owner@mail.com", "pass"))
+
+	const n = 10
+	errs := make(chan error, n)
+	for i := 1; i <= n; i++ {
+		go func(age int) {
+			ctx, release := reserve(stg, nil)
+			defer release()
+
+			_, err := stg.ProfileUpdate(ctx, &model.Profile{ID: user.ID, Age: age})
+			if stg.IsErrConflict(err) {
+				// storage has given up, it's allowed, but the change mustn't be recorded
+				err = nil
+			}
+			errs <- err
+		}(i)
+	}
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	profile, err := stg.ProfileGet(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes, err := stg.HistoryGet(ctx, user.ID, &model.HistoryQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(changes)) != profile.Rev-1 {
+		t.Fatalf("%d changes recorded for revision %d", len(changes), profile.Rev)
+	}
+
+	var age interface{} = 0
+	for i, change := range changes {
+		f := change.Fields["Age"]
+		if f.Previous != age {
+			t.Fatalf("change %d starts from %v, but previous one ends by %v", i, f.Previous, age)
+		}
+		age = f.Current
+	}
+	if age != profile.Age {
+		t.Fatalf("history ends by %v, but profile has %d", age, profile.Age)
+	}
+}
+
+func testPermissions(t *testing.T, stg storage.Storage) {
+	ctx, release := reserve(stg, nil)
+	defer release()
+
+	owner := mustConfirm(t, stg, ctx, mustInsert(t, stg, ctx, "owner@mail.com", "pass"))
+	other := mustConfirm(t, stg, ctx, mustInsert(t, stg, ctx, "other@mail.com", "pass"))
+
+	admin, err := stg.UserInsert(ctx, &model.User{Email: "admin@mail.com", Password: "pass", Roles: model.ROLE_ADMIN})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// user records are private, but profiles are public
+	for _, user := range []*model.User{other, model.Anonym()} {
+		uctx := model.SetCtxUser(ctx, user)
+
+		if _, err := stg.UserGet(uctx, owner.ID); !stg.IsErrNotFound(err) {
+			t.Fatalf("user %s gets foreign user: expected not found error, got %v", user.ID, err)
+		}
+		if _, err := stg.UserSearch(uctx, storage.Eq("email", owner.Email)); !stg.IsErrNotFound(err) {
+			t.Fatalf("user %s searches foreign user: expected not found error, got %v", user.ID, err)
+		}
+		if _, err := stg.UserSet(uctx, owner.ID, model.Fields{"confirm": false}, nil); !stg.IsErrNotFound(err) {
+			t.Fatalf("user %s modifies foreign user: expected not found error, got %v", user.ID, err)
+		}
+		if _, err := stg.ProfileGet(uctx, owner.ID); err != nil {
+			t.Fatalf("user %s gets public profile: %v", user.ID, err)
+		}
+	}
+
+	// owner accesses own record, but can't grant roles
+	octx := model.SetCtxUser(ctx, owner)
+	if _, err := stg.UserGet(octx, owner.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stg.UserSet(octx, owner.ID, model.Fields{"roles": model.ROLE_ADMIN}, nil); !stg.IsErrNotFound(err) {
+		t.Fatalf("owner grants role: expected not found error, got %v", err)
+	}
+
+	// role can't be granted on registration
+	self, err := stg.UserInsert(model.SetCtxUser(ctx, model.Anonym()), &model.User{Email: "self@mail.com", Roles: model.ROLE_ADMIN})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if self.Roles.Has(model.ROLE_ADMIN) {
+		t.Fatalf("anonym has granted admin role: %#v", self)
+	}
+
+	// admin manages any account
+	actx := model.SetCtxUser(ctx, &model.User{ID: admin.ID, Roles: admin.Roles})
+	if _, err := stg.ProfileUpdate(actx, &model.Profile{ID: owner.ID, FirstName: "Fixed"}); err != nil {
+		t.Fatal(err)
+	}
+	if changes, err := stg.HistoryGet(actx, owner.ID, &model.HistoryQuery{}); err != nil || len(changes) != 1 {
+		t.Fatalf("admin reads history: expected 1 change, got %v, %v", changes, err)
+	}
+	if _, err := stg.UserGet(actx, owner.ID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testACL(t *testing.T, stg storage.Storage) {
+	ctx, release := reserve(stg, nil)
+	defer release()
+
+	owner := mustConfirm(t, stg, ctx, mustInsert(t, stg, ctx, "owner@mail.com", "pass"))
+	other := mustConfirm(t, stg, ctx, mustInsert(t, stg, ctx, "other@mail.com", "pass"))
+
+	// profile is visible to registered users only
+	if _, err := stg.UserSet(ctx, owner.ID, model.Fields{"acl.reads": model.ROLE_USER}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	actx := model.SetCtxUser(ctx, model.Anonym())
+	if _, err := stg.ProfileGet(actx, owner.ID); !stg.IsErrNotFound(err) {
+		t.Fatalf("anonym gets restricted profile: expected not found error, got %v", err)
+	}
+	profiles, err := stg.ProfileSearch(actx, &model.ProfileQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(profiles) != 1 || profiles[0].ID != other.ID {
+		t.Fatalf("anonym expects only public profile %s, got %v", other.ID, profiles)
+	}
+
+	if _, err := stg.ProfileGet(model.SetCtxUser(ctx, other), owner.ID); err != nil {
+		t.Fatalf("user gets restricted profile: %v", err)
+	}
+}
+
+func testNotFound(t *testing.T, stg storage.Storage) {
+	ctx, release := reserve(stg, nil)
+	defer release()
+
+	id := bson.NewObjectId().Hex()
+
+	if _, err := stg.UserGet(ctx, id); !stg.IsErrNotFound(err) {
+		t.Fatalf("UserGet: expected not found error, got %v", err)
+	}
+	if _, err := stg.UserSet(ctx, id, model.Fields{"confirm": true}, nil); !stg.IsErrNotFound(err) {
+		t.Fatalf("UserSet: expected not found error, got %v", err)
+	}
+	if _, err := stg.ProfileGet(ctx, id); !stg.IsErrNotFound(err) {
+		t.Fatalf("ProfileGet: expected not found error, got %v", err)
+	}
+
+	// arbitrary id is an error, but it isn't a dup
+	_, err := stg.ProfileGet(ctx, "arbitrary"+strconv.FormatInt(time.Now().UnixNano(), 16))
+	if err == nil || stg.IsErrDup(err) {
+		t.Fatalf("ProfileGet with arbitrary id: unexpected error %v", err)
+	}
+}
+
+// ######################## Session Section ##########################
+
+func testSession(t *testing.T, stg storage.Storage) {
+	ctx, release := reserve(stg, nil)
+	defer release()
+
+	owner := mustInsert(t, stg, ctx, "owner@mail.com", "pass")
+	other := mustInsert(t, stg, ctx, "other@mail.com", "pass")
+
+	expire := time.Now().Add(time.Hour)
+	sess, err := stg.SessionInsert(ctx, &model.Session{UserID: owner.ID, Refresh: "r1", Expire: expire})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sess.ID == "" {
+		t.Fatal("insert has to assign new ID")
+	}
+
+	_, err = stg.SessionInsert(ctx, &model.Session{UserID: other.ID, Refresh: "expired", Expire: time.Now().Add(-time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = stg.SessionByRefresh(ctx, "expired"); !stg.IsErrNotFound(err) {
+		t.Fatalf("expired session: expected not found error, got %v", err)
+	}
+
+	got, err := stg.SessionByRefresh(ctx, "r1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != sess.ID || got.UserID != owner.ID {
+		t.Fatalf("unexpected session %#v", got)
+	}
+
+	// rotation succeeds only once
+	filter := storage.Eq("refresh", "r1")
+	if _, err = stg.SessionSet(ctx, sess.ID, model.Fields{"refresh": "r2"}, filter); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = stg.SessionSet(ctx, sess.ID, model.Fields{"refresh": "r3"}, filter); !stg.IsErrNotFound(err) {
+		t.Fatalf("second rotation: expected not found error, got %v", err)
+	}
+	if _, err = stg.SessionByRefresh(ctx, "r1"); !stg.IsErrNotFound(err) {
+		t.Fatalf("rotated refresh: expected not found error, got %v", err)
+	}
+
+	// only owner revokes session
+	if err = stg.SessionDelete(model.SetCtxUser(ctx, other), sess.ID); !stg.IsErrNotFound(err) {
+		t.Fatalf("foreign revoke: expected not found error, got %v", err)
+	}
+	if err = stg.SessionDelete(model.SetCtxUser(ctx, owner), sess.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = stg.SessionByRefresh(ctx, "r2"); !stg.IsErrNotFound(err) {
+		t.Fatalf("revoked session: expected not found error, got %v", err)
+	}
+
+	// revoke all user sessions, others are kept
+	for _, r := range []string{"a1", "a2"} {
+		if _, err = stg.SessionInsert(ctx, &model.Session{UserID: owner.ID, Refresh: r, Expire: expire}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = stg.SessionInsert(ctx, &model.Session{UserID: other.ID, Refresh: "b1", Expire: expire}); err != nil {
+		t.Fatal(err)
+	}
+	if err = stg.SessionDeleteByUser(ctx, owner.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = stg.SessionByRefresh(ctx, "a2"); !stg.IsErrNotFound(err) {
+		t.Fatalf("revoked by user session: expected not found error, got %v", err)
+	}
+	if _, err = stg.SessionByRefresh(ctx, "b1"); err != nil {
+		t.Fatalf("foreign session has been revoked: %v", err)
+	}
+}
+
+// ######################## Audit Section ##########################
+
+func testAudit(t *testing.T, stg storage.Storage) {
+	ctx, release := reserve(stg, nil)
+	defer release()
+
+	owner := mustInsert(t, stg, ctx, "owner@mail.com", "pass")
+	other := mustInsert(t, stg, ctx, "other@mail.com", "pass")
+
+	now := time.Now()
+	recs := []*model.AuditRecord{
+		{UserID: owner.ID, Time: now, Action: model.AUDIT_EMAIL_REQUEST, Previous: "a", Current: "b"},
+		{UserID: other.ID, Time: now, Action: model.AUDIT_EMAIL_REQUEST, Previous: "c", Current: "d"},
+		{UserID: owner.ID, Time: now.Add(time.Second), Action: model.AUDIT_EMAIL_CHANGE, Previous: "a", Current: "b"},
+	}
+	for _, rec := range recs {
+		if _, err := stg.AuditInsert(ctx, rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := stg.AuditGet(model.SetCtxUser(ctx, other), owner.ID); !stg.IsErrNotFound(err) {
+		t.Fatalf("foreign audit: expected not found error, got %v", err)
+	}
+
+	got, err := stg.AuditGet(model.SetCtxUser(ctx, owner), owner.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Action != model.AUDIT_EMAIL_REQUEST || got[1].Action != model.AUDIT_EMAIL_CHANGE {
+		t.Fatalf("unexpected audit trail %#v", got)
+	}
+	if got[1].Previous != "a" || got[1].Current != "b" {
+		t.Fatalf("unexpected audit values %#v", got[1])
+	}
+}
+
+// ######################## Help Functions ##########################
+
+// reserve creates context the same way middleware does.
+// Fixtures are prepared on behalf of system user by default
+func reserve(stg storage.Storage, user *model.User) (context.Context, storage.ReleaseFunc) {
+	if user == nil {
+		user = model.System()
+	}
+	ctx := model.SetCtxUser(context.Background(), user)
+	return stg.Reserve(ctx)
+}
+
+func mustInsert(t *testing.T, stg storage.Storage, ctx context.Context, email, pass string) *model.User {
+	user, err := stg.UserInsert(ctx, &model.User{Email: email, Password: pass})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func mustConfirm(t *testing.T, stg storage.Storage, ctx context.Context, user *model.User) *model.User {
+	user, err := stg.UserSet(ctx, user.ID, model.Fields{"confirm": true}, storage.Eq("confirm", false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"github.com/dimfeld/httptreemux"
+	"juno/common/token"
+	"juno/controller"
+	"juno/mailer"
+	"juno/middle"
+	"juno/model"
+	"juno/model/storage"
+	"net/http"
+	"os"
+)
+
+const VER = "v1"
+
+// Config keeps server dependencies and settings
+type Config struct {
+	// Storage is owned by caller, it has to be closed by caller
+	Storage storage.Storage
+	// TokenKey signs access tokens. Tokens are invalidated when key is changed
+	TokenKey []byte
+	// BasicAuth enables HTTP Basic authentication as fallback for bearer tokens
+	BasicAuth bool
+	// Mailer sends letters to users, it's expected to be asynchronous (see mailer.Async).
+	// Letters are dumped to stderr if it's nil
+	Mailer mailer.Mailer
+	// PublicURL is the address clients reach the server by (e.g. https://juno.com), it's used in letters
+	PublicURL string
+	// HistoryKey signs checkpoints of profile history, checkpoints aren't made if it's nil
+	HistoryKey []byte
+}
+
+// Server is http.Handler that serves juno API.
+// It wires router, middlewares and controller together, so it can be started by main or by tests
+type Server struct {
+	http.Handler
+}
+
+// New builds server by config
+func New(cfg Config) *Server {
+	s := cfg.Storage
+	tokens := token.NewSigner(cfg.TokenKey)
+
+	mail := cfg.Mailer
+	if mail == nil {
+		mail = mailer.NewDump(os.Stderr, "juno@localhost")
+	}
+
+	// controller have to work with storage
+	c := controller.New(s, tokens, mail, cfg.PublicURL+"/"+VER, cfg.HistoryKey)
+
+	// init router. httptreemux is fast and convinient
+	r := httptreemux.New()
+
+	// some of the endpoints are available in anonymous mode and some of them aren't.
+	// we can perform different middleware operations - with auth checks and without.
+
+	// build middleware that creates context and pass it to handlers
+	rc := middle.Context(r, s)
+	// add version
+	rc = middle.Version(rc, VER)
+	rc.Handle("POST", "/user", c.UserCreate)
+	rc.Handle("GET", "/user/confirm/:token", c.UserConfirm)
+	rc.Handle("POST", "/user/confirm/resend", c.UserConfirmResend)
+	rc.Handle("POST", "/user/password/forgot", c.PasswordForgot)
+	rc.Handle("POST", "/user/password/reset", c.PasswordReset)
+	rc.Handle("GET", "/user/email/confirm/:token", c.EmailConfirm)
+
+	// point-in-time profile is shown to the owner and admins only, so asOf requests are authenticated
+	rao := middle.AuthenticationIf(rc, s, tokens, cfg.BasicAuth, func(r *http.Request) bool {
+		_, ok := r.URL.Query()["asOf"]
+		return ok
+	})
+	rao.Handle("GET", "/profile/:profid", c.ProfileGet)
+	rc.Handle("GET", "/profile/all", c.ProfileAll)
+	rc.Handle("GET", "/profile/search", c.ProfileText)
+
+	rc.Handle("POST", "/session", c.SessionCreate)
+	rc.Handle("POST", "/session/refresh", c.SessionRefresh)
+
+	// Add middleware that checks authentication.
+	ra := middle.Authentication(rc, s, tokens, cfg.BasicAuth)
+	ra.Handle("PUT", "/profile", c.ProfileUpdate)
+	ra.Handle("PATCH", "/profile", c.ProfilePatch)
+	ra.Handle("GET", "/profile/:profid/history", c.ProfileHistory)
+	ra.Handle("GET", "/profile/:profid/diff", c.ProfileDiff)
+	ra.Handle("POST", "/profile/:profid/revert", c.ProfileRevert)
+	ra.Handle("DELETE", "/session", c.SessionDelete)
+	ra.Handle("PUT", "/user/password", c.PasswordChange)
+	ra.Handle("POST", "/user/email", c.EmailChange)
+	ra.Handle("GET", "/user/audit", c.UserAudit)
+
+	// administrative api requires admin role on top of authentication
+	rad := middle.Role(ra, model.ROLE_ADMIN)
+	rad.Handle("GET", "/admin/user", c.AdminUserList)
+	rad.Handle("POST", "/admin/user/:userid/confirm", c.AdminUserConfirm)
+	rad.Handle("POST", "/admin/user/:userid/disable", c.AdminUserDisable)
+	rad.Handle("POST", "/admin/user/:userid/enable", c.AdminUserEnable)
+	rad.Handle("PUT", "/admin/user/:userid/profile", c.AdminProfileUpdate)
+	rad.Handle("DELETE", "/admin/user/:userid", c.AdminUserDelete)
+	rad.Handle("GET", "/admin/user/:userid/history/check", c.AdminHistoryCheck)
+	rad.Handle("GET", "/admin/user/:userid/history/verify", c.AdminHistoryVerify)
+
+	// add middleware that decorates router and checks that Content-Type is application/json
+	rj := middle.JSONContentType(r)
+
+	return &Server{rj}
+}